@@ -10,6 +10,7 @@ import (
 	"github.com/rombintu/goyametricsv2/internal/agent"
 	"github.com/rombintu/goyametricsv2/internal/config"
 	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
 	"go.uber.org/zap"
 )
 
@@ -39,6 +40,16 @@ func main() {
 	logger.Initialize(conf.EnvMode)
 	a.Configure()
 
+	// Configure tracing of collection and sending
+	shutdownTracing, err := tracing.Initialize(ctx, "metrics-agent", tracing.Config{
+		Exporter: conf.TraceExporter,
+		Endpoint: conf.TraceEndpoint,
+		File:     conf.TraceFile,
+	})
+	if err != nil {
+		logger.Log.Error("cannot configure tracing", zap.Error(err))
+	}
+
 	logger.Log.Info("Agent starting", zap.String("address", conf.Address))
 	logger.OnStartUp(buildVersion, buildDate, buildCommit)
 
@@ -69,5 +80,12 @@ func main() {
 
 	// Wait for all workers to finish
 	wg.Wait()
+
+	// Flush pending spans
+	if shutdownTracing != nil {
+		if err := shutdownTracing(context.Background()); err != nil {
+			logger.Log.Error("cannot shutdown tracing", zap.Error(err))
+		}
+	}
 	logger.Log.Info("All workers have shut down. Exiting program.")
 }
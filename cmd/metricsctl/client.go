@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/agent"
+	"github.com/rombintu/goyametricsv2/lib/mycrypt"
+	"github.com/rombintu/goyametricsv2/lib/myhash"
+)
+
+// client talks to the metrics server the way the agent does: request bodies are
+// gzip-compressed, encrypted with the server's public key and signed with the hash key.
+// Signed responses of the server are checked with the same key.
+type client struct {
+	address    string // URL of the metrics listener
+	admin      string // URL of the admin listener, empty - not set
+	adminToken string
+	hashKey    string
+	publicKey  *rsa.PublicKey
+	http       *http.Client
+}
+
+// clientFlags registers the flags of the server connection on fs. They default to
+// the environment variables of the agent, so the tool works where the agent is configured.
+// The returned function creates the client after fs is parsed.
+func clientFlags(fs *flag.FlagSet) func() (*client, error) {
+	address := fs.String("a", envOr("ADDRESS", "localhost:8080"), "Server address, env ADDRESS")
+	hashKey := fs.String("k", os.Getenv("KEY"), "Key for hash, env KEY")
+	publicKeyFile := fs.String("crypto-key", os.Getenv("CRYPTO_KEY"), "Path to the public key of the server, env CRYPTO_KEY")
+	admin := fs.String("admin", os.Getenv("ADMIN_LISTEN"), "Address of the admin listener, env ADMIN_LISTEN")
+	adminToken := fs.String("admin-token", os.Getenv("ADMIN_TOKEN"), "Bearer token of the admin listener, env ADMIN_TOKEN")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout of a request")
+
+	return func() (*client, error) {
+		c := &client{
+			address:    serverURL(*address),
+			adminToken: *adminToken,
+			hashKey:    *hashKey,
+			http:       &http.Client{Timeout: *timeout},
+		}
+		if *admin != "" {
+			c.admin = serverURL(*admin)
+		}
+		if *publicKeyFile != "" {
+			publicKey, err := mycrypt.LoadPublicKey(*publicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load public key: %w", err)
+			}
+			c.publicKey = publicKey
+		}
+		return c, nil
+	}
+}
+
+func envOr(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// serverURL prepends "http://" to an address without a scheme.
+func serverURL(address string) string {
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return strings.TrimSuffix(address, "/")
+	}
+	return "http://" + strings.TrimSuffix(address, "/")
+}
+
+// postJSON sends in to the path of the metrics listener and decodes the response into out.
+func (c *client) postJSON(ctx context.Context, path string, in, out any) error {
+	jsonData, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := agent.NewRequestJSON(ctx, c.address+path, jsonData, c.hashKey, c.publicKey)
+	if err != nil {
+		return err
+	}
+	return c.do(req, out)
+}
+
+// getJSON requests the path of the metrics listener as JSON and decodes the response into out.
+func (c *client) getJSON(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.address+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	return c.do(req, out)
+}
+
+// postAdmin sends an empty POST request to the path of the admin listener.
+func (c *client) postAdmin(ctx context.Context, path string) error {
+	if c.admin == "" {
+		return errors.New("admin address is not set")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.admin+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.adminToken != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+c.adminToken)
+	}
+	return c.do(req, nil)
+}
+
+// do sends the request and decodes the JSON response into out, if out is not nil.
+// A response with an error status is returned as an error with the server's message.
+func (c *client) do(req *http.Request, out any) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	// The server signs the JSON without the trailing newline of its encoder
+	if hash := resp.Header.Get(myhash.Sha256Header); c.hashKey != "" && hash != "" {
+		if hash != myhash.ToSHA256AndHMAC(bytes.TrimSpace(body), c.hashKey) {
+			return fmt.Errorf("%s %s: hash of the response is not valid", req.Method, req.URL.Path)
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
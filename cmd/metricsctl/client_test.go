@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"flag"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/config"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	models "github.com/rombintu/goyametricsv2/internal/models"
+	"github.com/rombintu/goyametricsv2/internal/server"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/lib/mycrypt"
+	"github.com/rombintu/goyametricsv2/lib/ptrhelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// freeAddr returns an address to listen on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServer runs the server on the in-memory storage with the hash key and the encryption,
+// and returns the client flags to talk to it.
+func startServer(t *testing.T) []string {
+	dir := t.TempDir()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "key")
+	require.NoError(t, mycrypt.SavePrivateKey(keyFile, privateKey))
+	require.NoError(t, mycrypt.SavePublicKey(keyFile+".pub", &privateKey.PublicKey))
+
+	st, err := storage.New(storage.MemDriver, storage.Config{})
+	require.NoError(t, err)
+	require.NoError(t, st.Open(context.Background()))
+	conf := config.ServerConfig{
+		Listen:         freeAddr(t),
+		AdminListen:    freeAddr(t),
+		AdminToken:     "secret",
+		HashKey:        "key",
+		PrivateKeyFile: keyFile,
+		SecureMode:     true,
+		EnvMode:        logger.ProdMode,
+		LogLevel:       "fatal",
+	}
+	s := server.NewServer(st, conf)
+	s.ConfigureMiddlewares()
+	s.ConfigureRouter()
+	s.ConfigureAdminRouter()
+	go s.Run()
+	t.Cleanup(s.Shutdown)
+	// Shutdown waits for connections dialed by the client but never used
+	t.Cleanup(http.DefaultClient.CloseIdleConnections)
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + conf.Listen + "/ping")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return []string{
+		"-a", conf.Listen, "-k", conf.HashKey, "-crypto-key", keyFile + ".pub",
+		"-admin", conf.AdminListen, "-admin-token", conf.AdminToken,
+	}
+}
+
+func newTestClient(t *testing.T, args []string) *client {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	require.NoError(t, fs.Parse(args))
+	c, err := newClient()
+	require.NoError(t, err)
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	args := startServer(t)
+	c := newTestClient(t, args)
+
+	// Одиночная метрика и пачка проходят сжатие, шифрование и подпись
+	metric, err := parseMetric(storage.CounterType, "requests", "5")
+	require.NoError(t, err)
+	metric, err = c.push(ctx, metric)
+	require.NoError(t, err)
+	assert.Equal(t, "5", formatValue(metric))
+	require.NoError(t, runPush(append(args, storage.GaugeType, "cpu_user", "1.5")))
+	require.NoError(t, c.pushBatch(ctx, []models.Metrics{
+		{ID: "requests", MType: storage.CounterType, Delta: ptrhelper.Int64Ptr(2)},
+		{ID: "cpu_system", MType: storage.GaugeType, Value: ptrhelper.Float64Ptr(0.25)},
+	}))
+
+	metric, err = c.value(ctx, storage.CounterType, "requests")
+	require.NoError(t, err)
+	assert.Equal(t, "7", formatValue(metric))
+	require.NoError(t, runGet(append(args, storage.GaugeType, "cpu_user", "cpu_system")))
+	assert.Error(t, runGet(append(args, storage.GaugeType, "unknown")))
+
+	data, err := c.list(ctx)
+	require.NoError(t, err)
+	data, err = filterMetrics(data, "", "cpu_*")
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, printMetrics(&out, data))
+	assert.Equal(t, "TYPE   NAME        VALUE\ngauge  cpu_system  0.25\ngauge  cpu_user    1.5\n", out.String())
+
+	// Наблюдение печатает текущее значение и прирост счетчика
+	watchCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	out.Reset()
+	done := make(chan error)
+	go func() { done <- c.watch(watchCtx, storage.CounterType, "requests", 10*time.Millisecond, 2, &out) }()
+	time.Sleep(50 * time.Millisecond)
+	_, err = c.push(ctx, models.Metrics{ID: "requests", MType: storage.CounterType, Delta: ptrhelper.Int64Ptr(3)})
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasSuffix(lines[0], "\t7"))
+	assert.True(t, strings.HasSuffix(lines[1], "\t10\t+3"))
+
+	require.NoError(t, runSnapshot(args))
+
+	// Запрос с чужим ключом подписи и снимок с чужим токеном отклоняются
+	assert.Error(t, runGet(append(args, "-k", "wrong", storage.CounterType, "requests")))
+	assert.Error(t, runSnapshot(append(args, "-admin-token", "wrong")))
+}
+
+func TestParseMetric(t *testing.T) {
+	_, err := parseMetric(storage.CounterType, "c", "1.5")
+	assert.Error(t, err)
+	_, err = parseMetric("histogram", "h", "1")
+	assert.ErrorIs(t, err, storage.ErrInvalidType)
+	metric, err := parseMetric(storage.GaugeType, "g", "-2.5")
+	require.NoError(t, err)
+	assert.Equal(t, "-2.5", formatValue(metric))
+}
+
+func TestFilterMetrics(t *testing.T) {
+	data := storage.Data{
+		Counters: storage.Counters{"PollCount": 1},
+		Gauges:   storage.Gauges{"Alloc": 1, "TotalAlloc": 2},
+	}
+	filtered, err := filterMetrics(data, storage.GaugeType, "*Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, storage.Data{Counters: storage.Counters{}, Gauges: data.Gauges}, filtered)
+
+	_, err = filterMetrics(data, "", "[")
+	assert.Error(t, err)
+	_, err = filterMetrics(data, "histogram", "")
+	assert.ErrorIs(t, err, storage.ErrInvalidType)
+}
@@ -0,0 +1,81 @@
+// Command metricsctl is the command-line tool of the metrics server.
+//
+// Usage:
+//
+//	metricsctl migrate -from DRIVER:LOCATION -to DRIVER:LOCATION [-dry-run] [-verify]
+//	                   [-from-wal] [-from-store-encrypt -from-store-key KEY] [-to-...]
+//	metricsctl push [flags] TYPE NAME VALUE | push [flags] -f FILE
+//	metricsctl get [flags] TYPE NAME...
+//	metricsctl list [flags] [-type TYPE] [PATTERN]
+//	metricsctl watch [flags] [-interval 1s] [-count N] TYPE NAME
+//	metricsctl snapshot [flags]
+//
+// The server commands send requests the way the agent does: set -k and -crypto-key
+// (or KEY and CRYPTO_KEY) as for the agent to talk to a server requiring them.
+// snapshot is sent to the admin listener set with -admin and -admin-token.
+//
+// A file store is read and written with the options of the server that uses it:
+// set -from-wal, -from-store-backups, -from-store-encrypt... as the server flags.
+//
+// Run a command with -h for its flags.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+)
+
+// command is a subcommand of metricsctl.
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{name: "migrate", usage: "copy all metrics from one storage to another", run: runMigrate},
+	{name: "push", usage: "send a metric or a batch of metrics to the server", run: runPush},
+	{name: "get", usage: "print values of metrics", run: runGet},
+	{name: "list", usage: "print metrics of the server matching a pattern", run: runList},
+	{name: "watch", usage: "print the value of a metric on every change", run: runWatch},
+	{name: "snapshot", usage: "make the server save its storage now", run: runSnapshot},
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "metricsctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		return errors.New("command is required")
+	}
+	// Storage drivers only warn, e.g. of a database they reconnect to
+	logger.InitializeWithConfig("dev", logger.Config{Level: "warn"})
+
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	flag.Usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s COMMAND [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
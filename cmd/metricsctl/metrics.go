@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	models "github.com/rombintu/goyametricsv2/internal/models"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/lib/common"
+	"github.com/rombintu/goyametricsv2/lib/myparser"
+)
+
+// runPush sends one metric to /update/ or a batch from a file to /updates/.
+func runPush(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	file := fs.String("f", "", `JSON array of metrics as /updates/ takes it, "-" - stdin`)
+	fs.Usage = commandUsage(fs, "push [flags] TYPE NAME VALUE | push [flags] -f FILE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if *file != "" {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			return errors.New("metric arguments cannot be used with -f")
+		}
+		metrics, err := readBatch(*file)
+		if err != nil {
+			return err
+		}
+		if err := c.pushBatch(ctx, metrics); err != nil {
+			return err
+		}
+		fmt.Printf("pushed %d metrics\n", len(metrics))
+		return nil
+	}
+
+	if fs.NArg() != 3 {
+		fs.Usage()
+		return errors.New("type, name and value are required")
+	}
+	metric, err := parseMetric(fs.Arg(0), fs.Arg(1), fs.Arg(2))
+	if err != nil {
+		return err
+	}
+	if metric, err = c.push(ctx, metric); err != nil {
+		return err
+	}
+	fmt.Println(formatValue(metric))
+	return nil
+}
+
+// runGet prints the values of metrics of one type, one per line in the order of the names.
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	fs.Usage = commandUsage(fs, "get [flags] TYPE NAME...")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("type and name are required")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	for _, mname := range fs.Args()[1:] {
+		metric, err := c.value(context.Background(), fs.Arg(0), mname)
+		if err != nil {
+			return fmt.Errorf("%s: %w", mname, err)
+		}
+		fmt.Println(formatValue(metric))
+	}
+	return nil
+}
+
+// runList prints the metrics of the server, those matching the pattern if it is given.
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	mtype := fs.String("type", "", "List only metrics of the type: counter or gauge")
+	fs.Usage = commandUsage(fs, "list [flags] [PATTERN]\n\nPATTERN is a shell pattern of metric names, e.g. 'cpu*'")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("only one pattern is allowed")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	data, err := c.list(context.Background())
+	if err != nil {
+		return err
+	}
+	data, err = filterMetrics(data, *mtype, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printMetrics(os.Stdout, data)
+}
+
+// runWatch polls a metric and prints its value every time it changes, until interrupted.
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	interval := fs.Duration("interval", time.Second, "Interval of polling")
+	count := fs.Int("count", 0, "Stop after the number of changes, 0 - until interrupted")
+	fs.Usage = commandUsage(fs, "watch [flags] TYPE NAME")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("type and name are required")
+	}
+	if *interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	return c.watch(ctx, fs.Arg(0), fs.Arg(1), *interval, *count, os.Stdout)
+}
+
+// runSnapshot makes the server save its storage now.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	newClient := clientFlags(fs)
+	fs.Usage = commandUsage(fs, "snapshot [flags]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+	if err := c.snapshot(context.Background()); err != nil {
+		return err
+	}
+	fmt.Println("storage saved")
+	return nil
+}
+
+// push updates one metric and returns its value after the update.
+func (c *client) push(ctx context.Context, metric models.Metrics) (models.Metrics, error) {
+	var updated models.Metrics
+	err := c.postJSON(ctx, "/update/", metric, &updated)
+	return updated, err
+}
+
+// pushBatch updates the metrics in one request.
+func (c *client) pushBatch(ctx context.Context, metrics []models.Metrics) error {
+	return c.postJSON(ctx, "/updates/", metrics, nil)
+}
+
+// value returns the metric with its value.
+func (c *client) value(ctx context.Context, mtype, mname string) (models.Metrics, error) {
+	var metric models.Metrics
+	err := c.postJSON(ctx, "/value/", models.Metrics{ID: mname, MType: mtype}, &metric)
+	return metric, err
+}
+
+// list returns all metrics of the server.
+func (c *client) list(ctx context.Context) (storage.Data, error) {
+	var data storage.Data
+	err := c.getJSON(ctx, "/", &data)
+	return data, err
+}
+
+// snapshot makes the server save its storage.
+func (c *client) snapshot(ctx context.Context) error {
+	return c.postAdmin(ctx, "/admin/storage/snapshot")
+}
+
+// watch prints the time and the value of the metric on every change, and the growth of a counter.
+// A failed poll is reported and polling goes on: the server may be restarting.
+func (c *client) watch(ctx context.Context, mtype, mname string, interval time.Duration, count int, w io.Writer) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last *models.Metrics
+	changes := 0
+	for {
+		metric, err := c.value(ctx, mtype, mname)
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "metricsctl:", err)
+		case last == nil || formatValue(metric) != formatValue(*last):
+			line := time.Now().Format(time.TimeOnly) + "\t" + formatValue(metric)
+			if last != nil && metric.Delta != nil && last.Delta != nil {
+				line += fmt.Sprintf("\t%+d", *metric.Delta-*last.Delta)
+			}
+			fmt.Fprintln(w, line)
+			last = &metric
+			if changes++; count > 0 && changes >= count {
+				return nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// parseMetric makes the metric of the command line arguments.
+func parseMetric(mtype, mname, mvalue string) (models.Metrics, error) {
+	metric := models.Metrics{ID: mname, MType: mtype}
+	switch mtype {
+	case storage.CounterType:
+		delta, err := myparser.Str2Int64(mvalue)
+		if err != nil {
+			return metric, fmt.Errorf("invalid counter value %q", mvalue)
+		}
+		metric.SetDelta(delta)
+	case storage.GaugeType:
+		value, err := myparser.Str2Float64(mvalue)
+		if err != nil {
+			return metric, fmt.Errorf("invalid gauge value %q", mvalue)
+		}
+		metric.SetValue(value)
+	default:
+		return metric, storage.ErrInvalidType
+	}
+	return metric, nil
+}
+
+// readBatch reads a JSON array of metrics from the file, "-" - from stdin.
+func readBatch(file string) ([]models.Metrics, error) {
+	var (
+		body []byte
+		err  error
+	)
+	if file == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("%s: no metrics", file)
+	}
+	return metrics, nil
+}
+
+// filterMetrics keeps the metrics of the type, all types if it is empty,
+// with names matching the shell pattern, all names if it is empty.
+func filterMetrics(data storage.Data, mtype, pattern string) (storage.Data, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return data, fmt.Errorf("pattern %q: %w", pattern, err)
+	}
+	match := func(mname string) bool {
+		ok, _ := path.Match(pattern, mname)
+		return pattern == "" || ok
+	}
+	filtered := storage.Data{Counters: storage.Counters{}, Gauges: storage.Gauges{}}
+	switch mtype {
+	case "", storage.CounterType, storage.GaugeType:
+	default:
+		return data, storage.ErrInvalidType
+	}
+	if mtype != storage.GaugeType {
+		for mname, value := range data.Counters {
+			if match(mname) {
+				filtered.Counters[mname] = value
+			}
+		}
+	}
+	if mtype != storage.CounterType {
+		for mname, value := range data.Gauges {
+			if match(mname) {
+				filtered.Gauges[mname] = value
+			}
+		}
+	}
+	return filtered, nil
+}
+
+// printMetrics prints the metrics as a table sorted by type and name.
+func printMetrics(w io.Writer, data storage.Data) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tVALUE")
+	for _, mname := range common.SortedKeys(data.Counters) {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", storage.CounterType, mname, data.Counters[mname])
+	}
+	for _, mname := range common.SortedKeys(data.Gauges) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", storage.GaugeType, mname, strconv.FormatFloat(data.Gauges[mname], 'f', -1, 64))
+	}
+	return tw.Flush()
+}
+
+// formatValue returns the value of the metric as the server prints it.
+func formatValue(metric models.Metrics) string {
+	switch {
+	case metric.Delta != nil:
+		return strconv.FormatInt(*metric.Delta, 10)
+	case metric.Value != nil:
+		return strconv.FormatFloat(*metric.Value, 'f', -1, 64)
+	}
+	return ""
+}
+
+// commandUsage returns the usage function of a subcommand.
+func commandUsage(fs *flag.FlagSet, synopsis string) func() {
+	return func() {
+		fmt.Fprintf(fs.Output(), "Usage: metricsctl %s\n\nFlags:\n", synopsis)
+		fs.PrintDefaults()
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.json")
+	dst := filepath.Join(dir, "dst.json")
+	require.NoError(t, os.WriteFile(src, []byte(`{"counters":{"c":5},"gauges":{"g":1.5}}`), 0o644))
+	require.NoError(t, os.WriteFile(dst, []byte(`{"counters":{"c":2,"extra":1},"gauges":{}}`), 0o644))
+	args := []string{"-from", "file:" + src, "-to", "file:" + dst}
+
+	// Проверка без записи находит расхождение
+	assert.Error(t, runMigrate(append(args, "-dry-run", "-verify")))
+
+	// Счетчики доводятся до значений источника, и повторный перенос их не удваивает
+	require.NoError(t, runMigrate(append(args, "-verify")))
+	require.NoError(t, runMigrate(append(args, "-verify")))
+	require.NoError(t, runMigrate(append(args, "-dry-run", "-verify")))
+
+	st, err := openStorage(ctx, "file:"+dst, "", nil)
+	require.NoError(t, err)
+	defer st.Close(ctx)
+	assert.Equal(t, storage.Data{
+		Counters: storage.Counters{"c": 5, "extra": 1},
+		Gauges:   storage.Gauges{"g": 1.5},
+	}, st.GetAll(ctx))
+
+	assert.Error(t, runMigrate([]string{"-from", "file:" + src}))
+	assert.Error(t, runMigrate([]string{"-from", "unknown:" + src, "-to", "file:" + dst}))
+}
+
+func TestMigrateWAL(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "store.json")
+	dst := filepath.Join(dir, "dst.json")
+
+	// Зашифрованное хранилище сервера с журналом: обновления после снапшота только в журнале
+	st, err := storage.New(storage.FileDriver, storage.Config{
+		Path:    src,
+		Options: []storage.Option{storage.WithWAL(0), storage.WithEncryption([]byte("secret"))},
+	})
+	require.NoError(t, err)
+	require.NoError(t, st.Open(ctx))
+	require.NoError(t, st.UpdateAll(ctx, storage.Data{Counters: storage.Counters{"c": 2}}))
+	require.NoError(t, st.Save(ctx))
+	require.NoError(t, st.UpdateAll(ctx, storage.Data{Counters: storage.Counters{"c": 3}, Gauges: storage.Gauges{"g": 1}}))
+	require.NoError(t, st.Close(ctx))
+
+	args := []string{"-from", "file:" + src, "-to", "file:" + dst, "-verify"}
+	// Без журнала перенос потерял бы обновления, без ключа снапшот не читается
+	assert.Error(t, runMigrate(args))
+	assert.ErrorIs(t, runMigrate(append(args, "-from-wal")), storage.ErrSnapshotKey)
+	assert.Error(t, runMigrate(append(args, "-from-wal", "-from-store-encrypt")))
+
+	require.NoError(t, runMigrate(append(args, "-from-wal", "-from-store-encrypt", "-from-store-key", "secret")))
+	st, err = openStorage(ctx, "file:"+dst, "", nil)
+	require.NoError(t, err)
+	defer st.Close(ctx)
+	assert.Equal(t, storage.Data{
+		Counters: storage.Counters{"c": 5},
+		Gauges:   storage.Gauges{"g": 1},
+	}, st.GetAll(ctx))
+}
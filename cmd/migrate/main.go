@@ -0,0 +1,133 @@
+// Command migrate manages the schema of the pgx storage.
+//
+// Usage:
+//
+//	migrate -d DSN up [N]    apply N pending migrations, all by default
+//	migrate -d DSN down [N]  revert N applied migrations, 1 by default
+//	migrate -d DSN down all  revert all applied migrations, dropping the stored metrics
+//	migrate -d DSN status    list migrations and when they were applied
+//
+// The DSN may also be set with DATABASE_DSN, as for the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/storage/migrations"
+)
+
+func main() {
+	dsn := flag.String("d", os.Getenv("DATABASE_DSN"), "URL or Plain creds to database")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-d DSN] up [N] | down [N|all] | status\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if err := run(*dsn, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "migrate:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dsn string, args []string) error {
+	if dsn == "" || len(args) == 0 {
+		flag.Usage()
+		return fmt.Errorf("DSN and command are required")
+	}
+	logger.Initialize("dev")
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	migrator, err := migrations.New(conn)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		steps, err := stepsArg(args, 0)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx, steps)
+		printMigrations("applied", applied)
+		return err
+	case "down":
+		steps, err := downArg(args)
+		if err != nil {
+			return err
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		printMigrations("reverted", reverted)
+		return err
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	}
+	flag.Usage()
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// stepsArg parses the optional number of migrations after the command.
+func stepsArg(args []string, def int) (int, error) {
+	if len(args) < 2 {
+		return def, nil
+	}
+	steps, err := strconv.Atoi(args[1])
+	if err != nil || steps < 0 {
+		return 0, fmt.Errorf("invalid number of migrations %q", args[1])
+	}
+	return steps, nil
+}
+
+// downArg parses the number of migrations to revert: 1 by default, a positive number
+// or "all". Zero is rejected, so reverting everything is always explicit.
+func downArg(args []string) (int, error) {
+	if len(args) < 2 {
+		return 1, nil
+	}
+	if args[1] == "all" {
+		return migrations.All, nil
+	}
+	steps, err := strconv.Atoi(args[1])
+	if err != nil || steps <= 0 {
+		return 0, fmt.Errorf("invalid number of migrations %q, use a positive number or all", args[1])
+	}
+	return steps, nil
+}
+
+func printMigrations(action string, done []migrations.Migration) {
+	if len(done) == 0 {
+		fmt.Println("no migrations", action)
+		return
+	}
+	for _, m := range done {
+		fmt.Printf("%s %04d_%s\n", action, m.Version, m.Name)
+	}
+}
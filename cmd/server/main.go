@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -8,8 +11,11 @@ import (
 
 	"github.com/rombintu/goyametricsv2/internal/config"
 	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/replication"
 	"github.com/rombintu/goyametricsv2/internal/server"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/lib/common"
+	"github.com/rombintu/goyametricsv2/lib/mycrypt"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +25,18 @@ var (
 	buildCommit  string
 )
 
+// storeKey returns the secret of the store file encryption: the passphrase
+// in the config or the server's private key.
+func storeKey(conf config.ServerConfig) ([]byte, error) {
+	if conf.StoreKey != "" {
+		return []byte(conf.StoreKey), nil
+	}
+	if conf.PrivateKeyFile != "" {
+		return mycrypt.PrivateKeySecret(conf.PrivateKeyFile)
+	}
+	return nil, errors.New("set store key or crypto key")
+}
+
 // main is the entry point of the application.
 // It initializes the server, configures it, and starts the necessary workers.
 // The application listens for termination signals to gracefully shut down.
@@ -26,18 +44,84 @@ func main() {
 	// Load the server configuration
 	conf := config.LoadServerConfig()
 
-	// If the storage URL is provided and the storage driver is PgxDriver, set the storage path to the storage URL
-	if conf.StorageURL != "" && conf.StorageDriver == storage.PgxDriver {
-		conf.StoragePath = conf.StorageURL
-	}
-
 	// inc 21
 	if conf.PrivateKeyFile != "" {
 		conf.SecureMode = true
 	}
 
+	// Cluster nodes forward plain bodies, the decrypting middleware would reject them
+	if conf.SecureMode && conf.ClusterNodes != "" {
+		fmt.Println("cluster mode does not support encrypted requests, unset crypto key")
+		os.Exit(1)
+	}
+
 	// Create a new storage instance based on the configuration
-	storage := storage.NewStorage(conf.StorageDriver, conf.StoragePath)
+	storageOpts := []storage.Option{
+		storage.WithBackups(int(conf.StoreBackups)),
+		storage.WithCompression(conf.StoreCompression),
+		storage.WithPool(storage.Pool{
+			MaxConns:          int(conf.DatabaseMaxConns),
+			MinConns:          int(conf.DatabaseMinConns),
+			MaxConnLifetime:   time.Duration(conf.DatabaseMaxConnLifetime) * time.Second,
+			HealthCheckPeriod: time.Duration(conf.DatabaseHealthCheckPeriod) * time.Second,
+			StatementCache:    conf.DatabaseStatementCache,
+			ApplicationName:   conf.DatabaseAppName,
+			ReplicaURL:        conf.DatabaseReplicaDSN,
+		}),
+	}
+	if conf.StoreEncrypt {
+		key, err := storeKey(conf)
+		if err != nil {
+			fmt.Println("cannot get store encryption key:", err.Error())
+			os.Exit(1)
+		}
+		storageOpts = append(storageOpts, storage.WithEncryption(key))
+	}
+	if conf.WAL {
+		storageOpts = append(storageOpts, storage.WithWAL(time.Duration(conf.WALSyncInterval)*time.Millisecond))
+	}
+	st, err := storage.New(conf.StorageDriver, storage.Config{
+		Path:    conf.StoragePath,
+		URL:     conf.StorageURL,
+		Params:  []byte(conf.StorageParams),
+		Options: storageOpts,
+	})
+	if err != nil {
+		fmt.Println("cannot create storage:", err.Error())
+		os.Exit(1)
+	}
+	st = storage.WithTimeouts(st, storage.Timeouts{
+		Read:  time.Duration(conf.StorageReadTimeout) * time.Millisecond,
+		Write: time.Duration(conf.StorageWriteTimeout) * time.Millisecond,
+	})
+	// The cache is outside the timeouts: reads never wait for the backend, flushes are bounded
+	storage := storage.WithWriteBehind(st, storage.WriteBehind{
+		FlushInterval: time.Duration(conf.StorageCacheInterval) * time.Millisecond,
+		MaxPending:    int(conf.StorageCacheSize),
+	})
+
+	// Replication goes outermost: followers get exactly the updates the primary accepted
+	switch conf.ReplicationRole {
+	case "":
+	case replication.PrimaryRole, replication.FollowerRole:
+		if conf.ReplicationRole == replication.FollowerRole && conf.AdminListen == "" {
+			fmt.Println("follower needs admin listener to receive updates of the primary")
+			os.Exit(1)
+		}
+		// The follower applies updates and promotions from its admin listener, the primary signs them
+		if conf.AdminToken == "" {
+			fmt.Println("replication needs admin token to authenticate the primary and promotions")
+			os.Exit(1)
+		}
+		storage = replication.NewNode(storage, replication.Config{
+			Role:      conf.ReplicationRole,
+			Followers: common.SplitList(conf.ReplicationFollowers),
+			Token:     conf.AdminToken,
+		})
+	default:
+		fmt.Println("unknown replication role:", conf.ReplicationRole)
+		os.Exit(1)
+	}
 
 	// Create a new server instance with the storage and configuration
 	server := server.NewServer(storage, conf)
@@ -60,7 +144,7 @@ func main() {
 			for {
 				select {
 				case <-ticker.C:
-					server.SyncStorage()
+					server.SyncStorage(context.Background())
 				case <-done:
 					logger.Log.Debug("worker is shutdown", zap.String("name", "sync_storage"))
 					return
@@ -20,12 +20,17 @@ import (
 	"github.com/rombintu/goyametricsv2/internal/logger"
 	models "github.com/rombintu/goyametricsv2/internal/models"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
 	"github.com/rombintu/goyametricsv2/lib/mycrypt"
 	"github.com/rombintu/goyametricsv2/lib/mygzip"
 	"github.com/rombintu/goyametricsv2/lib/myhash"
 	"github.com/rombintu/goyametricsv2/lib/patterns"
 	"github.com/shirou/gopsutil/v4/cpu"
 	"github.com/shirou/gopsutil/v4/mem"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -126,14 +131,20 @@ func (a *Agent) incPollCount() {
 
 // postRequestJSON sends a POST request with JSON data to the specified URL.
 // It compresses the data using gzip and includes a hash if a secret key is set.
+// Every request carries a fresh X-Request-ID, which is also added to the agent's own logs,
+// and the W3C traceparent of the client span, so the server continues the same trace.
 //
 // Parameters:
+// - ctx: The context of the request, carries the parent span.
 // - url: The URL to which the request is sent.
 // - data: The data to be sent in the request body.
 //
 // Returns:
 // - An error if the request fails, otherwise nil.
-func (a *Agent) postRequestJSON(url string, data any) error {
+func (a *Agent) postRequestJSON(ctx context.Context, url string, data any) (err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "POST "+url, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	if err := a.TryConnectToServer(); err != nil {
 		return err
 	}
@@ -141,64 +152,94 @@ func (a *Agent) postRequestJSON(url string, data any) error {
 	if err != nil {
 		return err
 	}
-
-	// Start gzip compression
-	var buff bytes.Buffer
-	gzipWriter, err := gzip.NewWriterLevel(&buff, gzip.BestCompression)
+	req, err := NewRequestJSON(ctx, url, jsonData, a.hashKey, a.publicKey)
 	if err != nil {
-		logger.Log.Error("failed init compress writer", zap.Error(err))
+		logger.Log.Error("failed prepare request", zap.Error(err))
 		return err
 	}
-	_, err = gzipWriter.Write(jsonData)
+	tracing.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	// Send own request ID, so agent and server logs can be joined
+	requestID := logger.NewRequestID()
+	req.Header.Set(logger.RequestIDHeader, requestID)
+	log := logger.Log.With(zap.String(logger.RequestIDField, requestID))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
 	if err != nil {
-		logger.Log.Error("failed write data to compress temporary buffer", zap.Error(err))
+		log.Debug("failed send request", zap.String("url", url), zap.Error(err))
 		return err
 	}
-	gzipWriter.Close()
 
+	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	log.Debug("request sent", zap.String("url", url), zap.Int("status", resp.StatusCode))
+	return nil
+}
+
+// NewRequestJSON builds a POST request with the JSON body the way the server expects it:
+// gzip-compressed, encrypted with the public key and signed with the hash key, if they are set.
+// The hash is of the plain JSON: the server checks it after decrypting and unpacking the body.
+//
+// Parameters:
+// - ctx: The context of the request.
+// - url: The URL to which the request is sent.
+// - jsonData: The JSON body of the request.
+// - hashKey: The key of the HashSHA256 header, empty - not signed.
+// - publicKey: The server's public key, nil - not encrypted.
+//
+// Returns:
+// - The request ready to be sent, or an error if the body cannot be compressed or encrypted.
+func NewRequestJSON(ctx context.Context, url string, jsonData []byte, hashKey string, publicKey *rsa.PublicKey) (*http.Request, error) {
+	// Start gzip compression
+	var buff bytes.Buffer
+	gzipWriter, err := gzip.NewWriterLevel(&buff, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = gzipWriter.Write(jsonData); err != nil {
+		return nil, err
+	}
+	if err = gzipWriter.Close(); err != nil {
+		return nil, err
+	}
 	// End gzip compression
 
 	// Start crypto
-	if err := mycrypt.EncryptWithPublicKey(a.publicKey, &buff); err != nil {
-		logger.Log.Error("failed encrypt data with public key", zap.Error(err))
-		return err
+	if publicKey != nil {
+		if err := mycrypt.EncryptWithPublicKey(publicKey, &buff); err != nil {
+			return nil, err
+		}
 	}
 	// End crypto
 
-	req, err := http.NewRequest(http.MethodPost, url, &buff)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &buff)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
 	// If secret key is set, include the hash in the request header
-	if a.hashKey != "" {
-		hashPayload := myhash.ToSHA256AndHMAC(jsonData, a.hashKey)
-		req.Header.Set(myhash.Sha256Header, hashPayload)
+	if hashKey != "" {
+		req.Header.Set(myhash.Sha256Header, myhash.ToSHA256AndHMAC(jsonData, hashKey))
 	}
-
 	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 	// Set header for gzip compression
 	req.Header.Set(echo.HeaderContentEncoding, mygzip.GzipHeader)
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	defer resp.Body.Close()
-	return nil
+	return req, nil
 }
 
 // sendAllDataOnServer sends all collected metrics data to the server.
 // It converts the data into the appropriate format and sends it using a POST request.
 //
 // Parameters:
+// - ctx: The context of the report cycle, carries the parent span.
 // - data: The data to be sent to the server.
 //
 // Returns:
 // - An error if the request fails, otherwise nil.
-func (a *Agent) sendAllDataOnServer(data Data) error {
+func (a *Agent) sendAllDataOnServer(ctx context.Context, data Data) (err error) {
+	ctx, span := tracing.Start(ctx, "send_batch")
+	defer func() { tracing.End(span, err) }()
+
 	url := fmt.Sprintf("%s/updates/", a.serverAddress)
 	var metrics []models.Metrics
 
@@ -220,7 +261,8 @@ func (a *Agent) sendAllDataOnServer(data Data) error {
 		metrics = append(metrics, m)
 	}
 
-	if err := a.postRequestJSON(url, metrics); err != nil {
+	span.SetAttributes(attribute.Int("batch.size", len(metrics)))
+	if err := a.postRequestJSON(ctx, url, metrics); err != nil {
 		return err
 	}
 	return nil
@@ -248,7 +290,10 @@ func (a *Agent) RunReport(ctx context.Context, wg *sync.WaitGroup) {
 				logger.Log.Debug("Acquire", zap.String("worker", "pollv1"))
 				a.semaphore.Acquire()
 			}
-			if err := a.sendAllDataOnServer(a.data); err != nil {
+			reportCtx, span := tracing.Start(ctx, "report")
+			err := a.sendAllDataOnServer(reportCtx, a.data)
+			tracing.End(span, err)
+			if err != nil {
 				logger.Log.Debug("message from worker", zap.String("name", "report"), zap.String("error", err.Error()))
 				time.Sleep(time.Duration(a.reportInterval) * time.Second)
 			}
@@ -275,7 +320,9 @@ func (a *Agent) RunPoll(ctx context.Context, wg *sync.WaitGroup) {
 			logger.Log.Debug("worker is shutdown", zap.String("name", "poll"))
 			return
 		default:
+			_, span := tracing.Start(ctx, "collect_runtime")
 			a.loadMetrics()
+			span.End()
 			logger.Log.Debug("message from worker", zap.String("name", "poll"), zap.String("action", "load metrics common"))
 			time.Sleep(time.Duration(a.pollInterval) * time.Second)
 		}
@@ -296,12 +343,17 @@ func (a *Agent) RunPollv2(ctx context.Context, wg *sync.WaitGroup) {
 			logger.Log.Debug("worker is shutdown", zap.String("name", "pollv2"))
 			return
 		default:
+			pollCtx, span := tracing.Start(ctx, "pollv2")
+			_, collectSpan := tracing.Start(pollCtx, "collect_psutil")
 			optData := a.loadPSUtilsMetrics()
+			collectSpan.End()
 			if a.rateLimit > 0 {
 				logger.Log.Debug("Acquire", zap.String("worker", "pollv2"))
 				a.semaphore.Acquire()
 			}
-			if err := a.sendAllDataOnServer(optData); err != nil {
+			err := a.sendAllDataOnServer(pollCtx, optData)
+			tracing.End(span, err)
+			if err != nil {
 				logger.Log.Warn(err.Error())
 			}
 			if a.rateLimit > 0 {
@@ -1,15 +1,22 @@
 package agent
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"crypto/rsa"
 	"errors"
+	"io"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/rombintu/goyametricsv2/internal/config"
 	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/lib/mygzip"
+	"github.com/rombintu/goyametricsv2/lib/myhash"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.uber.org/zap"
@@ -101,13 +108,44 @@ func TestAgent_postRequestJSON(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := NewAgent(config.AgentConfig{})
-			if err := a.postRequestJSON(tt.args.url, tt.args.data); (err != nil) != tt.wantErr {
+			if err := a.postRequestJSON(context.Background(), tt.args.url, tt.args.data); (err != nil) != tt.wantErr {
 				t.Errorf("Agent.postRequestJSON() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
 
+func TestNewRequestJSON(t *testing.T) {
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+
+	// Без ключа тело только сжимается
+	req, err := NewRequestJSON(context.Background(), "http://localhost:8080/updates/", body, "", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, req.Header.Get(myhash.Sha256Header))
+	assert.Equal(t, mygzip.GzipHeader, req.Header.Get(echo.HeaderContentEncoding))
+	assert.Equal(t, body, gunzip(t, req.Body))
+
+	// С ключами тело шифруется, а подпись считается от исходного JSON
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	req, err = NewRequestJSON(context.Background(), "http://localhost:8080/updates/", body, "key", &privateKey.PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, myhash.ToSHA256AndHMAC(body, "key"), req.Header.Get(myhash.Sha256Header))
+	encrypted, err := io.ReadAll(req.Body)
+	assert.NoError(t, err)
+	decrypted, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, body, gunzip(t, bytes.NewReader(decrypted)))
+}
+
+func gunzip(t *testing.T, r io.Reader) []byte {
+	zr, err := gzip.NewReader(r)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	return data
+}
+
 func TestAgent_incPollCount(t *testing.T) {
 	t.Run("PollCountIncrement", func(t *testing.T) {
 		a := NewAgent(config.AgentConfig{})
@@ -0,0 +1,256 @@
+// Package cluster splits the metric keyspace between servers by consistent hashing
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// ForwardedHeader marks a request forwarded by a cluster node. It is always
+// handled by the receiving node, so nodes with different membership never loop.
+// The value is the forwarding node and, with a Secret, its signature of the request.
+const ForwardedHeader = "X-Metrics-Forwarded"
+
+const (
+	defaultHealthInterval = 2 * time.Second
+	healthTimeout         = time.Second
+	forwardTimeout        = 10 * time.Second
+)
+
+// ErrNodeDown is returned when the owner of a metric fails its health checks.
+var ErrNodeDown = errors.New("cluster node is down")
+
+// Config describes the static membership of the cluster.
+type Config struct {
+	// Self is the address of this node as it is listed in Nodes.
+	Self string
+	// Nodes are listen addresses of all nodes: host:port or URL.
+	Nodes []string
+	// HealthInterval is the period of health checks. 0 - the default.
+	HealthInterval time.Duration
+	// Secret signs forwarded requests, so clients cannot pass for a node.
+	// Empty - a request naming a cluster node in ForwardedHeader is trusted.
+	Secret string
+}
+
+// NodeStatus is the health of a node as seen by this one.
+type NodeStatus struct {
+	Addr      string    `json:"addr"`
+	Self      bool      `json:"self,omitempty"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Cluster knows which node owns a metric, checks the health of the other nodes
+// and forwards requests to them.
+type Cluster struct {
+	self     string
+	nodes    []string
+	ring     *Ring
+	interval time.Duration
+	secret   string
+	client   *http.Client
+
+	mu     sync.RWMutex
+	health map[string]*NodeStatus
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New creates the cluster. Nodes are healthy until the first check says otherwise.
+func New(conf Config) (*Cluster, error) {
+	found := false
+	for _, node := range conf.Nodes {
+		found = found || node == conf.Self
+	}
+	if !found {
+		return nil, fmt.Errorf("node %q is not in the cluster nodes %v", conf.Self, conf.Nodes)
+	}
+	c := &Cluster{
+		self:     conf.Self,
+		nodes:    conf.Nodes,
+		ring:     NewRing(conf.Nodes, defaultVirtualNodes),
+		interval: conf.HealthInterval,
+		secret:   conf.Secret,
+		client:   &http.Client{Timeout: forwardTimeout},
+		health:   make(map[string]*NodeStatus, len(conf.Nodes)),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultHealthInterval
+	}
+	for _, node := range conf.Nodes {
+		c.health[node] = &NodeStatus{Addr: node, Self: node == conf.Self, Healthy: true}
+	}
+	return c, nil
+}
+
+// Owner returns the node owning the metric.
+func (c *Cluster) Owner(mname string) string {
+	return c.ring.Owner(mname)
+}
+
+// IsSelf reports whether node is this one.
+func (c *Cluster) IsSelf(node string) bool {
+	return node == c.self
+}
+
+// Healthy reports whether node passed its last health check.
+func (c *Cluster) Healthy(node string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	status, ok := c.health[node]
+	return ok && status.Healthy
+}
+
+// Status returns the health of all nodes.
+func (c *Cluster) Status() []NodeStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	statuses := make([]NodeStatus, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		statuses = append(statuses, *c.health[node])
+	}
+	return statuses
+}
+
+// Start starts the health checks of the other nodes.
+func (c *Cluster) Start() {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.healthLoop()
+}
+
+// Stop stops the health checks.
+func (c *Cluster) Stop() {
+	if c.stop == nil {
+		return
+	}
+	close(c.stop)
+	<-c.done
+	c.stop = nil
+}
+
+func (c *Cluster) healthLoop() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.CheckHealth(context.Background())
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// CheckHealth pings the other nodes at /ping concurrently and records the results.
+func (c *Cluster) CheckHealth(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, node := range c.nodes {
+		if c.IsSelf(node) {
+			continue
+		}
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			err := c.ping(ctx, node)
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			status := c.health[node]
+			if status.Healthy != (err == nil) {
+				logger.Log.Warn("cluster node health changed", zap.String("node", node), zap.Bool("healthy", err == nil), zap.Error(err))
+			}
+			status.Healthy = err == nil
+			status.LastCheck = time.Now()
+			status.LastError = ""
+			if err != nil {
+				status.LastError = err.Error()
+			}
+		}(node)
+	}
+	wg.Wait()
+}
+
+func (c *Cluster) ping(ctx context.Context, node string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeURL(node)+"/ping", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Forward sends the request to node marked with ForwardedHeader. header is copied to the request.
+// The caller closes the response body. A node failing health checks is not tried: ErrNodeDown.
+func (c *Cluster) Forward(ctx context.Context, node, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	if !c.Healthy(node) {
+		return nil, fmt.Errorf("%w: %s", ErrNodeDown, node)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, nodeURL(node)+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set(ForwardedHeader, c.forwardedBy(c.self, method, path, body))
+	return c.client.Do(req)
+}
+
+// Forwarded reports whether the request with body was forwarded by a node of the cluster:
+// ForwardedHeader names the node and, with a Secret, carries its signature of the request.
+func (c *Cluster) Forwarded(r *http.Request, body []byte) bool {
+	value := r.Header.Get(ForwardedHeader)
+	node, _, _ := strings.Cut(value, " ")
+	if !slices.Contains(c.nodes, node) {
+		return false
+	}
+	return hmac.Equal([]byte(value), []byte(c.forwardedBy(node, r.Method, r.URL.RequestURI(), body)))
+}
+
+// forwardedBy returns the ForwardedHeader value of a request forwarded by node.
+func (c *Cluster) forwardedBy(node, method, path string, body []byte) string {
+	if c.secret == "" {
+		return node
+	}
+	mac := hmac.New(sha256.New, []byte(c.secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", node, method, path)
+	mac.Write(body)
+	return node + " " + hex.EncodeToString(mac.Sum(nil))
+}
+
+// nodeURL returns the base URL of a node address.
+func nodeURL(node string) string {
+	if !strings.Contains(node, "://") {
+		node = "http://" + node
+	}
+	return strings.TrimSuffix(node, "/")
+}
@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	assert.Equal(t, "", NewRing(nil, defaultVirtualNodes).Owner("m"))
+
+	nodes := []string{"a:8080", "b:8080", "c:8080"}
+	ring := NewRing(nodes, defaultVirtualNodes)
+
+	// Ключи распределены между всеми узлами
+	owned := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		owned[ring.Owner(fmt.Sprintf("metric%d", i))]++
+	}
+	for _, node := range nodes {
+		assert.Greater(t, owned[node], 500, node)
+	}
+
+	// Порядок узлов не важен, а добавленный узел забирает ключи только себе
+	assert.Equal(t, ring.Owner("metric1"), NewRing([]string{"c:8080", "a:8080", "b:8080"}, defaultVirtualNodes).Owner("metric1"))
+	grown := NewRing(append(nodes, "d:8080"), defaultVirtualNodes)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("metric%d", i)
+		if owner := grown.Owner(key); owner != "d:8080" {
+			assert.Equal(t, ring.Owner(key), owner, key)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Config{Self: "c:8080", Nodes: []string{"a:8080", "b:8080"}})
+	assert.Error(t, err)
+
+	c, err := New(Config{Self: "a:8080", Nodes: []string{"a:8080", "b:8080"}})
+	require.NoError(t, err)
+	assert.True(t, c.IsSelf("a:8080"))
+	assert.False(t, c.IsSelf("b:8080"))
+	assert.True(t, c.Healthy("b:8080"))
+	assert.False(t, c.Healthy("unknown:8080"))
+}
+
+func TestCheckHealthAndForward(t *testing.T) {
+	var down atomic.Bool
+	var forwardedBy atomic.Value
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		forwardedBy.Store(r.Header.Get(ForwardedHeader))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer peer.Close()
+	peerAddr := strings.TrimPrefix(peer.URL, "http://")
+
+	c, err := New(Config{Self: "self:8080", Nodes: []string{"self:8080", peerAddr}})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	c.CheckHealth(ctx)
+	assert.True(t, c.Healthy(peerAddr))
+	resp, err := c.Forward(ctx, peerAddr, http.MethodPost, "/updates/", http.Header{}, []byte("[]"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "self:8080", forwardedBy.Load())
+
+	// Упавший узел не пробуем, пока проверка не скажет обратного
+	down.Store(true)
+	c.CheckHealth(ctx)
+	assert.False(t, c.Healthy(peerAddr))
+	_, err = c.Forward(ctx, peerAddr, http.MethodPost, "/updates/", http.Header{}, nil)
+	assert.ErrorIs(t, err, ErrNodeDown)
+
+	status := c.Status()
+	require.Len(t, status, 2)
+	assert.True(t, status[0].Self)
+	assert.NotEmpty(t, status[1].LastError)
+
+	down.Store(false)
+	c.Start()
+	defer c.Stop()
+	assert.Eventually(t, func() bool { return c.Healthy(peerAddr) }, time.Second, 10*time.Millisecond)
+}
+
+func TestForwarded(t *testing.T) {
+	nodes := []string{"a:8080", "b:8080"}
+	a, err := New(Config{Self: "a:8080", Nodes: nodes, Secret: "secret"})
+	require.NoError(t, err)
+	b, err := New(Config{Self: "b:8080", Nodes: nodes, Secret: "secret"})
+	require.NoError(t, err)
+
+	request := func(value, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+		r.Header.Set(ForwardedHeader, value)
+		return r
+	}
+	signed := a.forwardedBy("a:8080", http.MethodPost, "/updates/", []byte("[]"))
+	assert.True(t, b.Forwarded(request(signed, "[]"), []byte("[]")))
+
+	// Клиент не может выдать себя за узел: имени узла без подписи мало
+	assert.False(t, b.Forwarded(request("a:8080", "[]"), []byte("[]")))
+	assert.False(t, b.Forwarded(request(signed, "[1]"), []byte("[1]")))
+	other, err := New(Config{Self: "a:8080", Nodes: nodes, Secret: "other"})
+	require.NoError(t, err)
+	assert.False(t, b.Forwarded(request(other.forwardedBy("a:8080", http.MethodPost, "/updates/", []byte("[]")), "[]"), []byte("[]")))
+
+	// Без секрета достаточно имени узла кластера
+	c, err := New(Config{Self: "b:8080", Nodes: nodes})
+	require.NoError(t, err)
+	assert.True(t, c.Forwarded(request("a:8080", "[]"), []byte("[]")))
+	assert.False(t, c.Forwarded(request("client", "[]"), []byte("[]")))
+}
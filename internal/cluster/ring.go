@@ -0,0 +1,57 @@
+// Package cluster consistent hash ring
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// defaultVirtualNodes is the number of points of a node on the ring.
+// More points spread the keyspace more evenly between nodes.
+const defaultVirtualNodes = 128
+
+// Ring maps metric names to nodes by consistent hashing: every node owns the arcs
+// before its points, so adding or removing a node moves only the keys of its arcs.
+type Ring struct {
+	hashes []uint64          // Sorted points of all nodes
+	owners map[uint64]string // Node of every point
+}
+
+// NewRing places virtualNodes points of every node on the ring.
+func NewRing(nodes []string, virtualNodes int) *Ring {
+	r := &Ring{owners: make(map[uint64]string, len(nodes)*virtualNodes)}
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			h := hashKey(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[h]; taken {
+				continue
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Owner returns the node owning key, empty if the ring has no nodes.
+func (r *Ring) Owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// hashKey is the first 8 bytes of SHA-256: the same on every node and across restarts,
+// and spread evenly even for similar names like node#1 and node#2.
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -20,6 +20,11 @@ type AgentConfig struct {
 	SecureMode    bool
 
 	ConfigPathFile string
+
+	// Трассировка
+	TraceExporter string `json:"trace_exporter"`
+	TraceEndpoint string `json:"trace_endpoint"`
+	TraceFile     string `json:"trace_file"`
 }
 
 // Try load Server Config from flags
@@ -33,6 +38,10 @@ func loadAgentConfigFromFlags() AgentConfig {
 	pubkey := flag.String("crypto-key", defaultPubkeyFile, hintPubkeyFile)
 
 	c := flag.String("c", defaultPathConfig, hintPathConfig)
+
+	traceExporter := flag.String("trace-exporter", defaultTraceExporter, hintTraceExporter)
+	traceEndpoint := flag.String("trace-endpoint", defaultTraceEndpoint, hintTraceEndpoint)
+	traceFile := flag.String("trace-file", defaultTraceFile, hintTraceFile)
 	flag.Parse()
 
 	config.Address = *a
@@ -43,6 +52,10 @@ func loadAgentConfigFromFlags() AgentConfig {
 
 	config.PublicKeyFile = *pubkey
 	config.ConfigPathFile = *c
+
+	config.TraceExporter = *traceExporter
+	config.TraceEndpoint = *traceEndpoint
+	config.TraceFile = *traceFile
 	return config
 }
 
@@ -72,6 +85,10 @@ func LoadAgentConfig() AgentConfig {
 	config.RateLimit = tryLoadFromEnv("RATE_LIMIT", fromFlags.RateLimit, fromFile.RateLimit)
 
 	config.PublicKeyFile = tryLoadFromEnv("CRYPTO_KEY", fromFlags.PublicKeyFile, fromFile.PublicKeyFile)
+
+	config.TraceExporter = tryLoadFromEnv("TRACE_EXPORTER", fromFlags.TraceExporter, fromFile.TraceExporter)
+	config.TraceEndpoint = tryLoadFromEnv("TRACE_ENDPOINT", fromFlags.TraceEndpoint, fromFile.TraceEndpoint)
+	config.TraceFile = tryLoadFromEnv("TRACE_FILE", fromFlags.TraceFile, fromFile.TraceFile)
 	return config
 }
 
@@ -10,7 +10,7 @@ import (
 const (
 	// Server
 	defaultListen        = "localhost:8080"
-	defaultStorageDriver = "mem"
+	defaultStorageDriver = ""
 	defaultEnvMode       = "dev"
 	defaultStoreInterval = 300
 	defaultStoragePath   = "store.json"
@@ -23,13 +23,60 @@ const (
 
 	// Server
 	hintListen        = "Server address"
-	hintStorageDriver = "Storage driver"
+	hintStorageDriver = "Storage driver: mem, file, log, pgx, redis. Empty - pgx with a database DSN, file with a store path, mem otherwise"
 	hintEnvMode       = "Enviriment server mode"
 	hintStoreInterval = "Interval between saves"
 	hintStoragePath   = "Path to store data"
 	hintStorageURL    = "URL or Plain creds to database"
 	hintRestoreFlag   = "Restore data from store?"
 
+	defaultStorageParams = ""
+	hintStorageParams    = "JSON config block of the storage driver"
+
+	defaultStoreBackups = 2
+	hintStoreBackups    = "Number of previous store files kept to restore from"
+
+	defaultStoreCompression = ""
+	defaultStoreEncrypt     = false
+	defaultStoreKey         = ""
+	hintStoreCompression    = "Compression of the store file: gzip, zstd. Empty - none"
+	hintStoreEncrypt        = "Encrypt the store file with AES-GCM"
+	hintStoreKey            = "Passphrase of the store file encryption. Empty - derive from the crypto key"
+
+	// Storage operation timeouts
+	defaultStorageReadTimeout  = 5000
+	defaultStorageWriteTimeout = 10000
+	hintStorageReadTimeout     = "Timeout of storage reads in milliseconds. 0 - no timeout"
+	hintStorageWriteTimeout    = "Timeout of storage writes in milliseconds. 0 - no timeout"
+
+	// Database pool
+	defaultDatabaseMaxConns          = 0
+	defaultDatabaseMinConns          = 0
+	defaultDatabaseMaxConnLifetime   = 0
+	defaultDatabaseHealthCheckPeriod = 0
+	defaultDatabaseStatementCache    = ""
+	defaultDatabaseAppName           = ""
+	defaultDatabaseReplicaDSN        = ""
+	hintDatabaseMaxConns             = "Max connections of the database pool. 0 - pgx default"
+	hintDatabaseMinConns             = "Connections the database pool keeps open. 0 - pgx default"
+	hintDatabaseMaxConnLifetime      = "Lifetime of a database connection in seconds. 0 - pgx default"
+	hintDatabaseHealthCheckPeriod    = "Health check period of idle database connections in seconds. 0 - pgx default"
+	hintDatabaseStatementCache       = "Statement cache mode: cache_statement, cache_describe, describe_exec, exec, simple_protocol. Empty - cache_statement"
+	hintDatabaseAppName              = "Application name of database connections. Empty - none"
+	hintDatabaseReplicaDSN           = "DSN of a read-only replica serving metric reads. Empty - reads from the primary"
+
+	// Write-behind cache
+	defaultStorageCacheInterval = 0
+	defaultStorageCacheSize     = 1000
+	hintStorageCacheInterval    = "Flush interval of the write-behind storage cache in milliseconds. 0 - no cache"
+	hintStorageCacheSize        = "Number of pending metrics that triggers an early flush of the storage cache. 0 - no limit"
+
+	// Write-ahead log
+	defaultWAL             = false
+	defaultWALSyncInterval = 0
+	hintWAL                = "Append every update of the file storage to a write-ahead log"
+	hintWALSyncInterval    = "Fsync interval of the write-ahead log in milliseconds. 0 - fsync on every update"
+
 	// Iter 14
 	hintHashKey    = "Key for hash"
 	defaultHashKey = ""
@@ -49,6 +96,50 @@ const (
 	// Inter 22
 	defaultPathConfig = ""
 	hintPathConfig    = "Path to config file"
+
+	// Logging
+	defaultLogLevel            = ""
+	defaultLogEncoding         = ""
+	defaultLogFile             = ""
+	defaultLogMaxSize          = 0
+	defaultLogMaxAge           = 0
+	defaultLogMaxBackups       = 0
+	defaultLogSampleInitial    = 0
+	defaultLogSampleThereafter = 0
+	hintLogLevel               = "Log level: debug, info, warn, error. Empty - by env mode"
+	hintLogEncoding            = "Log encoding: json or console. Empty - by env mode"
+	hintLogFile                = "Path to log file. Empty - stderr"
+	hintLogMaxSize             = "Max size of log file in megabytes before rotation"
+	hintLogMaxAge              = "Max age of rotated log files in days. 0 - keep forever"
+	hintLogMaxBackups          = "Max count of rotated log files. 0 - keep all"
+	hintLogSampleInitial       = "Request logs: first N identical entries per second. 0 - no sampling"
+	hintLogSampleThereafter    = "Request logs: then every Nth entry per second"
+
+	// Tracing
+	defaultTraceExporter = ""
+	defaultTraceEndpoint = ""
+	defaultTraceFile     = ""
+	hintTraceExporter    = "Trace exporter: stdout, file or otlp. Empty - tracing disabled"
+	hintTraceEndpoint    = "OTLP/HTTP endpoint of trace collector (host:port or URL)"
+	hintTraceFile        = "Path to trace file for file exporter"
+
+	// Admin listener
+	defaultAdminListen = ""
+	defaultAdminToken  = ""
+	hintAdminListen    = "Address of admin listener with pprof and log level control. Empty - disabled"
+	hintAdminToken     = "Bearer token for admin listener, also signs requests between cluster nodes. Empty - no auth"
+
+	// Replication
+	defaultReplicationRole      = ""
+	defaultReplicationFollowers = ""
+	hintReplicationRole         = "Replication role: primary or follower. Empty - no replication"
+	hintReplicationFollowers    = "Comma-separated admin addresses of the followers, streamed to by the primary"
+
+	// Cluster
+	defaultClusterNodes = ""
+	defaultClusterSelf  = ""
+	hintClusterNodes    = "Comma-separated addresses of all cluster nodes sharing the metrics by name. Empty - no cluster"
+	hintClusterSelf     = "Address of this node as listed in cluster nodes. Empty - server address"
 )
 
 // Костыль который еще никто не видел на этом свете
@@ -14,13 +14,44 @@ import (
 
 type ServerConfig struct {
 	Listen        string `env-default:"localhost:8080" json:"address"`
-	StorageDriver string `env-default:"mem" json:"-"`
+	StorageDriver string `env-default:"mem" json:"storage_driver"`
 	EnvMode       string `env-default:"dev" json:"-"`
 	StoreInterval int64  `env-default:"300" json:"store_interval"`
 	StoragePath   string `env-default:"store.json" json:"store_file"`
 	StorageURL    string `json:"database_dsn"`
 	RestoreFlag   bool   `env-default:"true" json:"restore"`
 	SyncMode      bool   `env-default:"false"`
+	StoreBackups  int64  `json:"store_backups"`
+
+	// Собственный блок настроек драйвера хранилища, JSON.
+	// Строка, а не json.RawMessage, чтобы конфиг оставался сравнимым
+	StorageParams string `json:"-"`
+
+	// Формат файла хранилища: сжатие и шифрование
+	StoreCompression string `json:"store_compression"`
+	StoreEncrypt     bool   `json:"store_encrypt"`
+	StoreKey         string `json:"store_key"`
+
+	// Таймауты операций хранилища, миллисекунды
+	StorageReadTimeout  int64 `json:"storage_read_timeout"`
+	StorageWriteTimeout int64 `json:"storage_write_timeout"`
+
+	// Пул соединений с базой, время жизни и период проверки в секундах
+	DatabaseMaxConns          int64  `json:"database_max_conns"`
+	DatabaseMinConns          int64  `json:"database_min_conns"`
+	DatabaseMaxConnLifetime   int64  `json:"database_max_conn_lifetime"`
+	DatabaseHealthCheckPeriod int64  `json:"database_health_check_period"`
+	DatabaseStatementCache    string `json:"database_statement_cache"`
+	DatabaseAppName           string `json:"database_app_name"`
+	DatabaseReplicaDSN        string `json:"database_replica_dsn"`
+
+	// Кэш отложенной записи перед хранилищем
+	StorageCacheInterval int64 `json:"storage_cache_interval"`
+	StorageCacheSize     int64 `json:"storage_cache_size"`
+
+	// Журнал упреждающей записи файлового хранилища
+	WAL             bool  `json:"wal"`
+	WALSyncInterval int64 `json:"wal_sync_interval"`
 
 	// Ключ для подписи
 	HashKey string `json:"-"`
@@ -30,6 +61,33 @@ type ServerConfig struct {
 
 	// Config parse from json
 	ConfigPathFile string `json:"-"`
+
+	// Логирование
+	LogLevel            string `json:"log_level"`
+	LogEncoding         string `json:"log_encoding"`
+	LogFile             string `json:"log_file"`
+	LogMaxSize          int64  `json:"log_max_size"`
+	LogMaxAge           int64  `json:"log_max_age"`
+	LogMaxBackups       int64  `json:"log_max_backups"`
+	LogSampleInitial    int64  `json:"log_sample_initial"`
+	LogSampleThereafter int64  `json:"log_sample_thereafter"`
+
+	// Трассировка
+	TraceExporter string `json:"trace_exporter"`
+	TraceEndpoint string `json:"trace_endpoint"`
+	TraceFile     string `json:"trace_file"`
+
+	// Админский listener: pprof, уровень логов
+	AdminListen string `json:"admin_listen"`
+	AdminToken  string `json:"admin_token"`
+
+	// Репликация: фолловеры принимают обновления первичного сервера через админский listener
+	ReplicationRole      string `json:"replication_role"`
+	ReplicationFollowers string `json:"replication_followers"`
+
+	// Кластер: метрики распределены между узлами по имени
+	ClusterNodes string `json:"cluster_nodes"`
+	ClusterSelf  string `json:"cluster_self"`
 }
 
 // Try load Server Config from flags
@@ -42,12 +100,52 @@ func loadServerConfigFromFlags() ServerConfig {
 	f := flag.String("f", defaultStoragePath, hintStoragePath)
 	r := flag.Bool("r", defaultRestoreFlag, hintRestoreFlag)
 	d := flag.String("d", "", hintStorageURL)
+	storageParams := flag.String("storage-params", defaultStorageParams, hintStorageParams)
+	storeBackups := flag.Int64("store-backups", defaultStoreBackups, hintStoreBackups)
+	storeCompression := flag.String("store-compression", defaultStoreCompression, hintStoreCompression)
+	storeEncrypt := flag.Bool("store-encrypt", defaultStoreEncrypt, hintStoreEncrypt)
+	storeKey := flag.String("store-key", defaultStoreKey, hintStoreKey)
+	storageReadTimeout := flag.Int64("storage-read-timeout", defaultStorageReadTimeout, hintStorageReadTimeout)
+	storageWriteTimeout := flag.Int64("storage-write-timeout", defaultStorageWriteTimeout, hintStorageWriteTimeout)
+	databaseMaxConns := flag.Int64("database-max-conns", defaultDatabaseMaxConns, hintDatabaseMaxConns)
+	databaseMinConns := flag.Int64("database-min-conns", defaultDatabaseMinConns, hintDatabaseMinConns)
+	databaseMaxConnLifetime := flag.Int64("database-max-conn-lifetime", defaultDatabaseMaxConnLifetime, hintDatabaseMaxConnLifetime)
+	databaseHealthCheckPeriod := flag.Int64("database-health-check-period", defaultDatabaseHealthCheckPeriod, hintDatabaseHealthCheckPeriod)
+	databaseStatementCache := flag.String("database-statement-cache", defaultDatabaseStatementCache, hintDatabaseStatementCache)
+	databaseAppName := flag.String("database-app-name", defaultDatabaseAppName, hintDatabaseAppName)
+	databaseReplicaDSN := flag.String("database-replica-dsn", defaultDatabaseReplicaDSN, hintDatabaseReplicaDSN)
+	storageCacheInterval := flag.Int64("storage-cache-interval", defaultStorageCacheInterval, hintStorageCacheInterval)
+	storageCacheSize := flag.Int64("storage-cache-size", defaultStorageCacheSize, hintStorageCacheSize)
+	walFlag := flag.Bool("wal", defaultWAL, hintWAL)
+	walSyncInterval := flag.Int64("wal-sync-interval", defaultWALSyncInterval, hintWALSyncInterval)
 
 	k := flag.String("k", defaultHashKey, hintHashKey)
 	privateKeyFile := flag.String("crypto-key", defaultPrivateKeyFile, hintPrivateKeyFile)
 
 	configFile := flag.String("c", defaultPathConfig, hintPathConfig)
 
+	logLevel := flag.String("log-level", defaultLogLevel, hintLogLevel)
+	logEncoding := flag.String("log-encoding", defaultLogEncoding, hintLogEncoding)
+	logFile := flag.String("log-file", defaultLogFile, hintLogFile)
+	logMaxSize := flag.Int64("log-max-size", defaultLogMaxSize, hintLogMaxSize)
+	logMaxAge := flag.Int64("log-max-age", defaultLogMaxAge, hintLogMaxAge)
+	logMaxBackups := flag.Int64("log-max-backups", defaultLogMaxBackups, hintLogMaxBackups)
+	logSampleInitial := flag.Int64("log-sample-initial", defaultLogSampleInitial, hintLogSampleInitial)
+	logSampleThereafter := flag.Int64("log-sample-thereafter", defaultLogSampleThereafter, hintLogSampleThereafter)
+
+	traceExporter := flag.String("trace-exporter", defaultTraceExporter, hintTraceExporter)
+	traceEndpoint := flag.String("trace-endpoint", defaultTraceEndpoint, hintTraceEndpoint)
+	traceFile := flag.String("trace-file", defaultTraceFile, hintTraceFile)
+
+	adminListen := flag.String("admin-listen", defaultAdminListen, hintAdminListen)
+	adminToken := flag.String("admin-token", defaultAdminToken, hintAdminToken)
+
+	replicationRole := flag.String("replication-role", defaultReplicationRole, hintReplicationRole)
+	replicationFollowers := flag.String("replication-followers", defaultReplicationFollowers, hintReplicationFollowers)
+
+	clusterNodes := flag.String("cluster-nodes", defaultClusterNodes, hintClusterNodes)
+	clusterSelf := flag.String("cluster-self", defaultClusterSelf, hintClusterSelf)
+
 	flag.Parse()
 
 	config.Listen = *a
@@ -58,6 +156,24 @@ func loadServerConfigFromFlags() ServerConfig {
 	config.StoreInterval = *i
 	config.StoragePath = *f
 	config.RestoreFlag = *r
+	config.StorageParams = *storageParams
+	config.StoreBackups = *storeBackups
+	config.StoreCompression = *storeCompression
+	config.StoreEncrypt = *storeEncrypt
+	config.StoreKey = *storeKey
+	config.StorageReadTimeout = *storageReadTimeout
+	config.StorageWriteTimeout = *storageWriteTimeout
+	config.DatabaseMaxConns = *databaseMaxConns
+	config.DatabaseMinConns = *databaseMinConns
+	config.DatabaseMaxConnLifetime = *databaseMaxConnLifetime
+	config.DatabaseHealthCheckPeriod = *databaseHealthCheckPeriod
+	config.DatabaseStatementCache = *databaseStatementCache
+	config.DatabaseAppName = *databaseAppName
+	config.DatabaseReplicaDSN = *databaseReplicaDSN
+	config.StorageCacheInterval = *storageCacheInterval
+	config.StorageCacheSize = *storageCacheSize
+	config.WAL = *walFlag
+	config.WALSyncInterval = *walSyncInterval
 
 	// increment 10
 	config.StorageURL = *d
@@ -70,6 +186,28 @@ func loadServerConfigFromFlags() ServerConfig {
 	// increment 22
 	config.ConfigPathFile = *configFile
 
+	config.LogLevel = *logLevel
+	config.LogEncoding = *logEncoding
+	config.LogFile = *logFile
+	config.LogMaxSize = *logMaxSize
+	config.LogMaxAge = *logMaxAge
+	config.LogMaxBackups = *logMaxBackups
+	config.LogSampleInitial = *logSampleInitial
+	config.LogSampleThereafter = *logSampleThereafter
+
+	config.TraceExporter = *traceExporter
+	config.TraceEndpoint = *traceEndpoint
+	config.TraceFile = *traceFile
+
+	config.AdminListen = *adminListen
+	config.AdminToken = *adminToken
+
+	config.ReplicationRole = *replicationRole
+	config.ReplicationFollowers = *replicationFollowers
+
+	config.ClusterNodes = *clusterNodes
+	config.ClusterSelf = *clusterSelf
+
 	return config
 }
 
@@ -97,23 +235,74 @@ func LoadServerConfig() ServerConfig {
 	// increment 10
 	config.StorageDriver = tryLoadFromEnv("STORAGE_DRIVER", fromFlags.StorageDriver, fromFile.StorageDriver)
 	config.StorageURL = tryLoadFromEnv("DATABASE_DSN", fromFlags.StorageURL, fromFile.StorageURL)
+	config.StorageParams = tryLoadFromEnv("STORAGE_PARAMS", fromFlags.StorageParams, fromFile.StorageParams)
+	config.StoreBackups = tryLoadFromEnv("STORE_BACKUPS", fromFlags.StoreBackups, fromFile.StoreBackups)
+	config.StoreCompression = tryLoadFromEnv("STORE_COMPRESSION", fromFlags.StoreCompression, fromFile.StoreCompression)
+	config.StoreEncrypt = tryLoadFromEnv("STORE_ENCRYPT", fromFlags.StoreEncrypt, fromFile.StoreEncrypt)
+	config.StoreKey = tryLoadFromEnv("STORE_KEY", fromFlags.StoreKey, fromFile.StoreKey)
+	config.StorageReadTimeout = tryLoadFromEnv("STORAGE_READ_TIMEOUT", fromFlags.StorageReadTimeout, fromFile.StorageReadTimeout)
+	config.StorageWriteTimeout = tryLoadFromEnv("STORAGE_WRITE_TIMEOUT", fromFlags.StorageWriteTimeout, fromFile.StorageWriteTimeout)
+	config.DatabaseMaxConns = tryLoadFromEnv("DATABASE_MAX_CONNS", fromFlags.DatabaseMaxConns, fromFile.DatabaseMaxConns)
+	config.DatabaseMinConns = tryLoadFromEnv("DATABASE_MIN_CONNS", fromFlags.DatabaseMinConns, fromFile.DatabaseMinConns)
+	config.DatabaseMaxConnLifetime = tryLoadFromEnv("DATABASE_MAX_CONN_LIFETIME", fromFlags.DatabaseMaxConnLifetime, fromFile.DatabaseMaxConnLifetime)
+	config.DatabaseHealthCheckPeriod = tryLoadFromEnv("DATABASE_HEALTH_CHECK_PERIOD", fromFlags.DatabaseHealthCheckPeriod, fromFile.DatabaseHealthCheckPeriod)
+	config.DatabaseStatementCache = tryLoadFromEnv("DATABASE_STATEMENT_CACHE", fromFlags.DatabaseStatementCache, fromFile.DatabaseStatementCache)
+	config.DatabaseAppName = tryLoadFromEnv("DATABASE_APP_NAME", fromFlags.DatabaseAppName, fromFile.DatabaseAppName)
+	config.DatabaseReplicaDSN = tryLoadFromEnv("DATABASE_REPLICA_DSN", fromFlags.DatabaseReplicaDSN, fromFile.DatabaseReplicaDSN)
+	config.StorageCacheInterval = tryLoadFromEnv("STORAGE_CACHE_INTERVAL", fromFlags.StorageCacheInterval, fromFile.StorageCacheInterval)
+	config.StorageCacheSize = tryLoadFromEnv("STORAGE_CACHE_SIZE", fromFlags.StorageCacheSize, fromFile.StorageCacheSize)
+	config.WAL = tryLoadFromEnv("WAL", fromFlags.WAL, fromFile.WAL)
+	config.WALSyncInterval = tryLoadFromEnv("WAL_SYNC_INTERVAL", fromFlags.WALSyncInterval, fromFile.WALSyncInterval)
 	// Change to sync mode
 	if config.StoreInterval == 0 {
-		config.SyncMode = true
+		if config.WAL {
+			// WAL makes every update durable, snapshots are only needed to cut the log
+			config.StoreInterval = defaultStoreInterval
+		} else {
+			config.SyncMode = true
+		}
 	}
 
 	// increment 14
 	config.HashKey = tryLoadFromEnv("KEY", fromFlags.HashKey, fromFile.HashKey)
 
-	if config.StorageURL != "" {
-		config.StorageDriver = storage.PgxDriver
-	} else if (config.StoragePath != "") && (config.StoragePath != defaultStoragePath) {
-		config.StorageDriver = storage.FileDriver
+	// Без явного драйвера он следует из заданных настроек хранилища
+	if config.StorageDriver == "" {
+		switch {
+		case config.StorageURL != "":
+			config.StorageDriver = storage.PgxDriver
+		case (config.StoragePath != "") && (config.StoragePath != defaultStoragePath):
+			config.StorageDriver = storage.FileDriver
+		default:
+			config.StorageDriver = storage.MemDriver
+		}
 	}
 
 	// increment 21
 	config.PrivateKeyFile = tryLoadFromEnv("CRYPTO_KEY", fromFlags.PrivateKeyFile, fromFile.PrivateKeyFile)
 
+	config.LogLevel = tryLoadFromEnv("LOG_LEVEL", fromFlags.LogLevel, fromFile.LogLevel)
+	config.LogEncoding = tryLoadFromEnv("LOG_ENCODING", fromFlags.LogEncoding, fromFile.LogEncoding)
+	config.LogFile = tryLoadFromEnv("LOG_FILE", fromFlags.LogFile, fromFile.LogFile)
+	config.LogMaxSize = tryLoadFromEnv("LOG_MAX_SIZE", fromFlags.LogMaxSize, fromFile.LogMaxSize)
+	config.LogMaxAge = tryLoadFromEnv("LOG_MAX_AGE", fromFlags.LogMaxAge, fromFile.LogMaxAge)
+	config.LogMaxBackups = tryLoadFromEnv("LOG_MAX_BACKUPS", fromFlags.LogMaxBackups, fromFile.LogMaxBackups)
+	config.LogSampleInitial = tryLoadFromEnv("LOG_SAMPLE_INITIAL", fromFlags.LogSampleInitial, fromFile.LogSampleInitial)
+	config.LogSampleThereafter = tryLoadFromEnv("LOG_SAMPLE_THEREAFTER", fromFlags.LogSampleThereafter, fromFile.LogSampleThereafter)
+
+	config.TraceExporter = tryLoadFromEnv("TRACE_EXPORTER", fromFlags.TraceExporter, fromFile.TraceExporter)
+	config.TraceEndpoint = tryLoadFromEnv("TRACE_ENDPOINT", fromFlags.TraceEndpoint, fromFile.TraceEndpoint)
+	config.TraceFile = tryLoadFromEnv("TRACE_FILE", fromFlags.TraceFile, fromFile.TraceFile)
+
+	config.AdminListen = tryLoadFromEnv("ADMIN_LISTEN", fromFlags.AdminListen, fromFile.AdminListen)
+	config.AdminToken = tryLoadFromEnv("ADMIN_TOKEN", fromFlags.AdminToken, fromFile.AdminToken)
+
+	config.ReplicationRole = tryLoadFromEnv("REPLICATION_ROLE", fromFlags.ReplicationRole, fromFile.ReplicationRole)
+	config.ReplicationFollowers = tryLoadFromEnv("REPLICATION_FOLLOWERS", fromFlags.ReplicationFollowers, fromFile.ReplicationFollowers)
+
+	config.ClusterNodes = tryLoadFromEnv("CLUSTER_NODES", fromFlags.ClusterNodes, fromFile.ClusterNodes)
+	config.ClusterSelf = tryLoadFromEnv("CLUSTER_SELF", fromFlags.ClusterSelf, fromFile.ClusterSelf)
+
 	return config
 }
 
@@ -140,7 +329,8 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 	type Alias ServerConfig // Создаем алиас для структуры, чтобы избежать рекурсии
 	aux := &struct {
 		*Alias
-		StoreInterval string `json:"store_interval"`
+		StoreInterval string          `json:"store_interval"`
+		StorageParams json.RawMessage `json:"storage_params"`
 	}{
 		Alias: (*Alias)(c),
 	}
@@ -148,6 +338,7 @@ func (c *ServerConfig) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &aux); err != nil {
 		return err
 	}
+	c.StorageParams = string(aux.StorageParams)
 
 	// Проверяем, что поле store_interval не пустое
 	if aux.StoreInterval == "" {
@@ -28,6 +28,16 @@ func TestLoadServerConfig(t *testing.T) {
 	env["RESTORE_FLAG"] = "true"
 	env["DATABASE_DSN"] = ""
 	env["CONFIG"] = confFileAbsPath
+	env["WAL"] = "false"
+	env["WAL_SYNC_INTERVAL"] = "0"
+
+	walEnv := make(map[string]string)
+	for key, value := range env {
+		walEnv[key] = value
+	}
+	walEnv["STORE_INTERVAL"] = "0"
+	walEnv["WAL"] = "true"
+	walEnv["WAL_SYNC_INTERVAL"] = "100"
 
 	tests := []struct {
 		name string
@@ -43,10 +53,36 @@ func TestLoadServerConfig(t *testing.T) {
 				StoragePath:    "store.json",
 				RestoreFlag:    true,
 				SyncMode:       false,
+				StoreBackups:   2,
 				ConfigPathFile: confFileAbsPath,
+
+				StorageReadTimeout:  5000,
+				StorageWriteTimeout: 10000,
+				StorageCacheSize:    1000,
 			},
 			env: env,
 		},
+		{
+			// С журналом запись на каждый запрос не нужна, снапшот по умолчанию
+			name: "wal_disables_sync_mode",
+			want: ServerConfig{
+				Listen:          "localhost:8080",
+				StorageDriver:   "mem",
+				StoreInterval:   300,
+				StoragePath:     "store.json",
+				RestoreFlag:     true,
+				SyncMode:        false,
+				StoreBackups:    2,
+				WAL:             true,
+				WALSyncInterval: 100,
+				ConfigPathFile:  confFileAbsPath,
+
+				StorageReadTimeout:  5000,
+				StorageWriteTimeout: 10000,
+				StorageCacheSize:    1000,
+			},
+			env: walEnv,
+		},
 	}
 
 	for _, tt := range tests {
@@ -90,6 +126,18 @@ func TestLoadServerConfigFromFile(t *testing.T) {
 			},
 			expectedError: false,
 		},
+		{
+			// Блок настроек драйвера передается ему как есть
+			name:           "Storage_Driver_Params",
+			configPathFile: "testconfig.json",
+			createFile:     true,
+			configData:     `{"storage_driver": "file", "storage_params": {"segment_size": 1024}}`,
+			expectedConfig: ServerConfig{
+				StorageDriver: "file",
+				StorageParams: `{"segment_size": 1024}`,
+			},
+			expectedError: false,
+		},
 		{
 			name:           "Non-Existent_File",
 			configPathFile: "nonexistentfile.json",
@@ -2,18 +2,25 @@
 package logger
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 const (
 	debugLevel = "debug"
 	infoLevel  = "info"
 
+	jsonEncoding    = "json"
+	consoleEncoding = "console"
+
 	DevMode  = "dev"
 	ProdMode = "prod"
 )
@@ -25,46 +32,151 @@ type Logger interface {
 	Info(msg string, fields ...zapcore.Field)
 	Level() zapcore.Level
 	Warn(msg string, fields ...zapcore.Field)
+	With(fields ...zapcore.Field) *zap.Logger
 }
 
 // Взял пример из урока, реализация логгера по паттерну Singleton
 var Log Logger = zap.NewNop()
 
+// level — общий уровень логирования. Меняется на лету через LevelHandler
+// и переживает повторные вызовы Initialize.
+var level = zap.NewAtomicLevel()
+
+// accessLog — отдельный логер с сэмплированием для RequestLogger.
+// nil, если сэмплирование выключено.
+var accessLog *zap.Logger
+
+// Config описывает формат и вывод логов. Нулевое значение — поведение по умолчанию:
+// уровень и кодировка по режиму, вывод в stderr, без сэмплирования.
+type Config struct {
+	Level    string // debug, info, warn, error. Пусто — по режиму
+	Encoding string // json или console. Пусто — по режиму
+	File     string // Путь до файла логов. Пусто — stderr
+
+	// Ротация файла логов
+	MaxSize    int // Размер файла в мегабайтах, после которого он ротируется
+	MaxAge     int // Сколько дней хранить старые файлы. 0 — не удалять по возрасту
+	MaxBackups int // Сколько старых файлов хранить. 0 — все
+
+	// Сэмплирование логов запросов: в секунду пишутся первые SampleInitial
+	// одинаковых записей, затем каждая SampleThereafter. 0 — без сэмплирования
+	SampleInitial    int
+	SampleThereafter int
+}
+
 // Initialize инициализирует синглтон логера с необходимым уровнем логирования.
 func Initialize(mode string) (err error) {
-	var cfg zap.Config
-	var lvl zap.AtomicLevel
+	return InitializeWithConfig(mode, Config{})
+}
+
+// InitializeWithConfig инициализирует синглтон логера по режиму и настройкам cfg.
+func InitializeWithConfig(mode string, cfg Config) error {
+	var encCfg zapcore.EncoderConfig
+	var opts []zap.Option
+	defaultLevel, defaultEncoding := debugLevel, consoleEncoding
 	switch mode {
 	case ProdMode:
-		cfg = zap.NewProductionConfig()
-		lvl, err = zap.ParseAtomicLevel(infoLevel)
-		if err != nil {
-			return err
-		}
+		encCfg = zap.NewProductionEncoderConfig()
+		opts = append(opts, zap.AddStacktrace(zapcore.ErrorLevel))
+		defaultLevel, defaultEncoding = infoLevel, jsonEncoding
 	default:
-		cfg = zap.NewDevelopmentConfig()
-		lvl, err = zap.ParseAtomicLevel(debugLevel)
-		if err != nil {
-			return err
-		}
+		encCfg = zap.NewDevelopmentEncoderConfig()
+		opts = append(opts, zap.Development(), zap.AddStacktrace(zapcore.WarnLevel))
 	}
+	opts = append(opts, zap.AddCaller())
 
-	// устанавливаем уровень
-	cfg.Level = lvl
-	// создаём логер на основе конфигурации
-	zl, err := cfg.Build()
+	if cfg.Level == "" {
+		cfg.Level = defaultLevel
+	}
+	if cfg.Encoding == "" {
+		cfg.Encoding = defaultEncoding
+	}
+
+	// сначала проверяем всю конфигурацию: при ошибке глобальный логер и уровень не меняются
+	lvl, err := zapcore.ParseLevel(cfg.Level)
 	if err != nil {
 		return err
 	}
+
+	var enc zapcore.Encoder
+	switch cfg.Encoding {
+	case jsonEncoding:
+		enc = zapcore.NewJSONEncoder(encCfg)
+	case consoleEncoding:
+		enc = zapcore.NewConsoleEncoder(encCfg)
+	default:
+		return fmt.Errorf("unknown log encoding: %s", cfg.Encoding)
+	}
+	if err := checkLogFile(cfg.File); err != nil {
+		return err
+	}
+
+	// устанавливаем уровень
+	level.SetLevel(lvl)
+	core := zapcore.NewCore(enc, newWriteSyncer(cfg), level)
+
+	// создаём логер на основе конфигурации
+	zl := zap.New(core, opts...)
 	defer zl.Sync()
 	// устанавливаем синглтон
 	Log = zl
 
+	accessLog = nil
+	if cfg.SampleInitial > 0 {
+		accessLog = zap.New(
+			zapcore.NewSamplerWithOptions(core, time.Second, cfg.SampleInitial, cfg.SampleThereafter),
+			opts...,
+		)
+	}
 	return nil
 }
 
+// checkLogFile проверяет, что файл логов можно открыть на запись:
+// lumberjack открывает его только при первой записи.
+func checkLogFile(file string) error {
+	if file == "" {
+		return nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("log file: %w", err)
+	}
+	return f.Close()
+}
+
+// newWriteSyncer возвращает вывод логов: stderr или файл с ротацией.
+func newWriteSyncer(cfg Config) zapcore.WriteSyncer {
+	if cfg.File == "" {
+		return zapcore.Lock(os.Stderr)
+	}
+	return zapcore.AddSync(&lumberjack.Logger{
+		Filename:   cfg.File,
+		MaxSize:    cfg.MaxSize,
+		MaxAge:     cfg.MaxAge,
+		MaxBackups: cfg.MaxBackups,
+	})
+}
+
+// LevelHandler возвращает HTTP-обработчик текущего уровня логирования.
+// GET отдает уровень, PUT с телом {"level":"info"} меняет его без перезапуска.
+func LevelHandler() http.Handler {
+	return level
+}
+
+// accessLogger возвращает логер для записи запроса: с сэмплированием, если оно включено.
+func accessLogger(ctx context.Context) Logger {
+	if accessLog == nil {
+		return FromContext(ctx)
+	}
+	if id := RequestIDFromContext(ctx); id != "" {
+		return accessLog.With(zap.String(RequestIDField, id))
+	}
+	return accessLog
+}
+
 // RequestLogger — middleware-логер для входящих HTTP-запросов.
-// Custom middleware
+// Пишет одну строку на запрос: параметры запроса и ответа вместе с request_id,
+// если перед ним подключен RequestID.
 func RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		startTimestamp := time.Now()
@@ -76,25 +188,27 @@ func RequestLogger(next echo.HandlerFunc) echo.HandlerFunc {
 		res := c.Response()
 
 		duration := time.Since(startTimestamp)
-		Log.Info("REQEST",
-			zap.String("URI", req.URL.Path),
-			zap.String("Method", req.Method),
+		accessLogger(req.Context()).Info("HTTP",
+			zap.Dict("request",
+				zap.String("URI", req.URL.Path),
+				zap.String("Method", req.Method),
+				// add for Iter7
+				zap.String("Content-Type", req.Header.Get("Content-Type")),
+				// add for Iter8
+				zap.String("Accept-Encoding", req.Header.Get("Accept-Encoding")),
+				// add for Iter 14
+				zap.String("Hash", req.Header.Get("HashSHA256")),
+			),
+			zap.Dict("response",
+				zap.Int("Status Code", res.Status),
+				zap.Int64("Size", res.Size),
+				// add for Iter7
+				zap.String("Content-Type", res.Header().Get("Content-Type")),
+				// add for Iter8
+				zap.String("Content-Encoding", res.Header().Get("Content-Encoding")),
+				zap.String("Hash", res.Header().Get("HashSHA256")),
+			),
 			zap.String("Duration", duration.String()),
-			// add for Iter7
-			zap.String("Content-Type", req.Header.Get("Content-Type")),
-			// add for Iter8
-			zap.String("Accept-Encoding", req.Header.Get("Accept-Encoding")),
-			// add for Iter 14
-			zap.String("Hash", req.Header.Get("HashSHA256")),
-		)
-		Log.Info("RESPONSE",
-			zap.Int("Status Code", res.Status),
-			zap.Int64("Size", res.Size),
-			// add for Iter7
-			zap.String("Content-Type", res.Header().Get("Content-Type")),
-			// add for Iter8
-			zap.String("Content-Encoding", res.Header().Get("Content-Encoding")),
-			zap.String("Hash", res.Header().Get("HashSHA256")),
 		)
 		return err
 	}
@@ -1,9 +1,13 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
@@ -170,26 +174,160 @@ func TestRequestLogger(t *testing.T) {
 	// Проверяем, что ответ имеет статус 200
 	assert.Equal(t, http.StatusOK, rec.Code)
 
-	// Проверяем, что логи были записаны корректно
+	// Проверяем, что запрос и ответ записаны одной строкой
 	allLogs := logs.All()
-	assert.Equal(t, 2, len(allLogs))
-
-	// Проверяем логи запроса
-	reqLog := allLogs[0]
-	assert.Equal(t, "REQEST", reqLog.Message)
-	assert.Equal(t, "/test", reqLog.ContextMap()["URI"])
-	assert.Equal(t, "GET", reqLog.ContextMap()["Method"])
-	assert.NotEmpty(t, reqLog.ContextMap()["Duration"])
-	assert.Equal(t, "application/json", reqLog.ContextMap()["Content-Type"])
-	assert.Equal(t, "gzip", reqLog.ContextMap()["Accept-Encoding"])
-	assert.Equal(t, "hash123", reqLog.ContextMap()["Hash"])
-
-	// Проверяем логи ответа
-	resLog := allLogs[1]
-	assert.Equal(t, "RESPONSE", resLog.Message)
-	assert.Equal(t, int64(http.StatusOK), resLog.ContextMap()["Status Code"])
-	assert.Equal(t, int64(4), resLog.ContextMap()["Size"])
-	assert.Equal(t, "application/json", resLog.ContextMap()["Content-Type"])
-	assert.Equal(t, "gzip", resLog.ContextMap()["Content-Encoding"])
-	assert.Equal(t, "hash123", resLog.ContextMap()["Hash"])
+	assert.Equal(t, 1, len(allLogs))
+	assert.Equal(t, "HTTP", allLogs[0].Message)
+	assert.NotEmpty(t, allLogs[0].ContextMap()["Duration"])
+
+	// Проверяем параметры запроса
+	reqLog, ok := allLogs[0].ContextMap()["request"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "/test", reqLog["URI"])
+	assert.Equal(t, "GET", reqLog["Method"])
+	assert.Equal(t, "application/json", reqLog["Content-Type"])
+	assert.Equal(t, "gzip", reqLog["Accept-Encoding"])
+	assert.Equal(t, "hash123", reqLog["Hash"])
+
+	// Проверяем параметры ответа
+	resLog, ok := allLogs[0].ContextMap()["response"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, int64(http.StatusOK), resLog["Status Code"])
+	assert.Equal(t, int64(4), resLog["Size"])
+	assert.Equal(t, "application/json", resLog["Content-Type"])
+	assert.Equal(t, "gzip", resLog["Content-Encoding"])
+	assert.Equal(t, "hash123", resLog["Hash"])
+}
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	Log = zap.New(core)
+
+	e := echo.New()
+	handler := func(c echo.Context) error {
+		FromContext(c.Request().Context()).Info("handler")
+		return c.String(http.StatusOK, RequestIDFromContext(c.Request().Context()))
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		generate bool
+	}{
+		{name: "honor_client_id", header: "agent-42"},
+		{name: "generate_when_empty", header: "", generate: true},
+		{name: "generate_when_invalid", header: "bad id\n", generate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/test", nil)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := RequestID(RequestLogger(handler))(c)
+			assert.NoError(t, err)
+
+			id := rec.Header().Get(RequestIDHeader)
+			if tt.generate {
+				assert.Len(t, id, 32)
+			} else {
+				assert.Equal(t, tt.header, id)
+			}
+			assert.Equal(t, id, rec.Body.String())
+
+			// Логи обработчика и access log связаны одним request_id
+			for _, entry := range logs.TakeAll() {
+				assert.Equal(t, id, entry.ContextMap()[RequestIDField])
+			}
+		})
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	Log = zap.NewNop()
+	assert.Equal(t, Log, FromContext(context.Background()))
+
+	l := zap.NewExample()
+	assert.Equal(t, Logger(l), FromContext(WithContext(context.Background(), l)))
+}
+
+func TestInitializeWithConfig(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "server.log")
+	tests := []struct {
+		name    string
+		mode    string
+		cfg     Config
+		wantErr bool
+	}{
+		{
+			name: "json_to_file",
+			mode: ProdMode,
+			cfg:  Config{Encoding: "json", File: logFile, MaxSize: 1, MaxAge: 1, MaxBackups: 1},
+		},
+		{
+			name: "console_with_sampling",
+			mode: DevMode,
+			cfg:  Config{Level: "warn", Encoding: "console", SampleInitial: 1, SampleThereafter: 100},
+		},
+		{
+			name:    "unknown_encoding",
+			mode:    DevMode,
+			cfg:     Config{Encoding: "xml"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown_level",
+			mode:    DevMode,
+			cfg:     Config{Level: "loud"},
+			wantErr: true,
+		},
+		{
+			name:    "log_file_in_missing_dir",
+			mode:    DevMode,
+			cfg:     Config{File: path.Join(t.TempDir(), "missing", "server.log")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := InitializeWithConfig(tt.mode, tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("InitializeWithConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Неверная конфигурация не меняет уровень текущего логера
+	assert.NoError(t, InitializeWithConfig(ProdMode, Config{Level: "warn"}))
+	assert.Error(t, InitializeWithConfig(ProdMode, Config{Level: "debug", Encoding: "xml"}))
+	assert.Equal(t, zapcore.WarnLevel, level.Level())
+
+	// Запись должна попасть в файл
+	assert.NoError(t, InitializeWithConfig(ProdMode, Config{File: logFile}))
+	Log.Info("to file")
+	data, err := os.ReadFile(logFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"msg":"to file"`)
+}
+
+func TestLevelHandler(t *testing.T) {
+	assert.NoError(t, Initialize(ProdMode))
+
+	// Читаем текущий уровень
+	rec := httptest.NewRecorder()
+	LevelHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/loglevel", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"level":"info"}`, rec.Body.String())
+
+	// Меняем уровень на лету
+	rec = httptest.NewRecorder()
+	LevelHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/loglevel", strings.NewReader(`{"level":"debug"}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, zapcore.DebugLevel, Log.Level())
+
+	// Повторная инициализация не ломает обработчик
+	assert.NoError(t, Initialize(ProdMode))
+	assert.Equal(t, zapcore.InfoLevel, Log.Level())
 }
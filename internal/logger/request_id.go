@@ -0,0 +1,91 @@
+// Package logger
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+)
+
+const (
+	// RequestIDHeader — заголовок, в котором передается идентификатор запроса.
+	RequestIDHeader = echo.HeaderXRequestID
+	// RequestIDField — имя поля с идентификатором запроса в логах.
+	RequestIDField = "request_id"
+
+	// maxRequestIDLen ограничивает длину идентификатора, пришедшего от клиента.
+	maxRequestIDLen = 128
+)
+
+type ctxLoggerKey struct{}
+type ctxRequestIDKey struct{}
+
+// NewRequestID генерирует случайный идентификатор запроса.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID проверяет, что идентификатор от клиента можно безопасно писать в логи.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// WithContext возвращает копию ctx, содержащую логер l.
+func WithContext(ctx context.Context, l Logger) context.Context {
+	return context.WithValue(ctx, ctxLoggerKey{}, l)
+}
+
+// FromContext возвращает логер запроса из ctx.
+// Если логер в контексте не найден, возвращается глобальный Log.
+func FromContext(ctx context.Context) Logger {
+	if ctx == nil {
+		return Log
+	}
+	if l, ok := ctx.Value(ctxLoggerKey{}).(Logger); ok {
+		return l
+	}
+	return Log
+}
+
+// RequestIDFromContext возвращает идентификатор запроса из ctx или пустую строку.
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(ctxRequestIDKey{}).(string)
+	return id
+}
+
+// RequestID — middleware, которое берет идентификатор запроса из заголовка X-Request-ID
+// или генерирует новый, возвращает его в ответе и кладет в контекст запроса
+// логер с полем request_id.
+func RequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+		c.Response().Header().Set(RequestIDHeader, id)
+
+		ctx := context.WithValue(req.Context(), ctxRequestIDKey{}, id)
+		ctx = WithContext(ctx, Log.With(zap.String(RequestIDField, id)))
+		c.SetRequest(req.WithContext(ctx))
+		return next(c)
+	}
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestMetrics_setDelta(t *testing.T) {
+func TestMetrics_SetDelta(t *testing.T) {
 	type fields struct {
 		ID    string
 		MType string
@@ -48,13 +48,13 @@ func TestMetrics_setDelta(t *testing.T) {
 				Delta: tt.fields.Delta,
 				Value: tt.fields.Value,
 			}
-			m.setDelta(tt.args.delta)
+			m.SetDelta(tt.args.delta)
 			assert.Equal(t, &tt.args.delta, m.Delta, "Delta should be set correctly")
 		})
 	}
 }
 
-func TestMetrics_setValue(t *testing.T) {
+func TestMetrics_SetValue(t *testing.T) {
 	type fields struct {
 		ID    string
 		MType string
@@ -94,84 +94,8 @@ func TestMetrics_setValue(t *testing.T) {
 				Delta: tt.fields.Delta,
 				Value: tt.fields.Value,
 			}
-			m.setValue(tt.args.value)
+			m.SetValue(tt.args.value)
 			assert.Equal(t, &tt.args.value, m.Value, "Value should be set correctly")
 		})
 	}
 }
-
-func TestMetrics_SetValueOrDelta(t *testing.T) {
-	type fields struct {
-		ID    string
-		MType string
-		Delta *int64
-		Value *float64
-	}
-	type args struct {
-		s string
-	}
-	tests := []struct {
-		name    string
-		fields  fields
-		args    args
-		wantErr bool
-	}{
-		{
-			name: "set_with_minus",
-			fields: fields{
-				ID:    "1",
-				MType: storage.CounterType,
-				Delta: ptrhelper.Int64Ptr(1),
-				Value: ptrhelper.Float64Ptr(-1),
-			},
-			args:    args{s: "1"},
-			wantErr: false,
-		},
-		{
-			name: "set_with_plus",
-			fields: fields{
-				ID:    "2",
-				MType: storage.CounterType,
-				Delta: ptrhelper.Int64Ptr(1),
-				Value: ptrhelper.Float64Ptr(1),
-			},
-			args:    args{s: "1"},
-			wantErr: false,
-		},
-		{
-			name: "set_value_without_err",
-			fields: fields{
-				ID:    "3",
-				MType: storage.CounterType,
-				Delta: ptrhelper.Int64Ptr(1),
-				Value: ptrhelper.Float64Ptr(1),
-			},
-			args:    args{s: "1"},
-			wantErr: false,
-		},
-		{
-			name: "set_value_with_err",
-			fields: fields{
-				ID:    "4",
-				MType: storage.CounterType,
-				Delta: ptrhelper.Int64Ptr(1),
-				Value: ptrhelper.Float64Ptr(1),
-			},
-			args:    args{s: "ggg"},
-			wantErr: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			m := &Metrics{
-				ID:    tt.fields.ID,
-				MType: tt.fields.MType,
-				Delta: tt.fields.Delta,
-				Value: tt.fields.Value,
-			}
-			if err := m.SetValueOrDelta(tt.args.s); (err != nil) != tt.wantErr {
-				t.Errorf("Metrics.SetValueOrDelta() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
@@ -0,0 +1,53 @@
+package replication
+
+import (
+	"sync"
+
+	"github.com/rombintu/goyametricsv2/lib/common"
+)
+
+// keyLocks are mutexes by metric name, created on demand.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int // Holders and waiters, the lock is dropped at 0
+}
+
+// Lock locks the names of the metrics in sorted order, so batches with common
+// names do not deadlock, and returns the function that unlocks them.
+func (l *keyLocks) Lock(metrics map[string]float64) func() {
+	if len(metrics) == 0 {
+		return func() {}
+	}
+	names := common.SortedKeys(metrics)
+	held := make([]*keyLock, 0, len(names))
+	for _, mname := range names {
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = make(map[string]*keyLock)
+		}
+		k, ok := l.locks[mname]
+		if !ok {
+			k = &keyLock{}
+			l.locks[mname] = k
+		}
+		k.refs++
+		l.mu.Unlock()
+		k.Lock()
+		held = append(held, k)
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, k := range held {
+			k.Unlock()
+			if k.refs--; k.refs == 0 {
+				delete(l.locks, names[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Package replication streams accepted updates from a primary server to followers
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"go.uber.org/zap"
+)
+
+// Roles of a server in replication.
+const (
+	// PrimaryRole accepts updates and streams them to followers.
+	PrimaryRole = "primary"
+	// FollowerRole applies updates of the primary and serves reads.
+	FollowerRole = "follower"
+)
+
+// ApplyPath is the admin route of a follower that accepts batches of the primary.
+const ApplyPath = "/admin/replication/apply"
+
+var (
+	// ErrReadOnly is returned for updates sent to a follower.
+	ErrReadOnly = errors.New("read-only replica, send updates to the primary")
+	// ErrOutOfSync is returned by a follower for a batch that does not follow the last applied one.
+	// The primary then sends a snapshot.
+	ErrOutOfSync = errors.New("replica is out of sync")
+)
+
+// Config configures a replicated server.
+type Config struct {
+	// Role is PrimaryRole or FollowerRole.
+	Role string
+	// Followers are admin addresses of the followers: host:port or URL.
+	// A follower uses them when it is promoted.
+	Followers []string
+	// Token is the admin token of the followers.
+	Token string
+}
+
+// Batch is a message of the replication stream. Epoch identifies the primary run:
+// sequence numbers start over after a restart or promotion.
+// A snapshot carries the full state instead of the updates after Seq-1.
+type Batch struct {
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+	Snapshot bool   `json:"snapshot,omitempty"`
+	storage.Data
+}
+
+// Status describes the replication state of the server.
+type Status struct {
+	Role      string           `json:"role"`
+	Epoch     string           `json:"epoch"`
+	Seq       uint64           `json:"seq"`
+	Followers []FollowerStatus `json:"followers,omitempty"`
+}
+
+// Node wraps the storage of a replicated server. On the primary updates are written
+// concurrently, and each one is numbered and queued for the followers once written,
+// so a slow write does not stall the others. Updates of the same gauge are written
+// and numbered one at a time, so followers apply them in the order of the primary.
+// On a follower updates come only from the primary through Apply.
+type Node struct {
+	storage.Storage
+	conf Config
+
+	// Updates of the primary hold it shared while writing, snapshots exclusive,
+	// so a snapshot holds exactly the numbered batches
+	writes sync.RWMutex
+	gauges keyLocks // Orders the write and the numbering of updates of a gauge
+
+	mu      sync.Mutex // Guards the state below, serializes applies of a follower
+	role    string
+	epoch   string
+	seq     uint64    // Last accepted (primary) or applied (follower) batch
+	senders []*sender // Streams to followers, primary only
+}
+
+// NewNode wraps the storage with replication in the configured role.
+func NewNode(s storage.Storage, conf Config) *Node {
+	n := &Node{
+		Storage: s,
+		conf:    conf,
+		role:    conf.Role,
+	}
+	if n.role == PrimaryRole {
+		n.epoch = newEpoch()
+	}
+	return n
+}
+
+// newEpoch returns a random identifier of a primary run.
+func newEpoch() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Open opens the storage and, on the primary, starts streaming to the followers.
+func (n *Node) Open(ctx context.Context) error {
+	if err := n.Storage.Open(ctx); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == PrimaryRole {
+		n.startSenders()
+	}
+	return nil
+}
+
+// Close stops streaming and closes the storage.
+func (n *Node) Close(ctx context.Context) error {
+	n.mu.Lock()
+	senders := n.senders
+	n.senders = nil
+	n.mu.Unlock()
+	for _, s := range senders {
+		s.Stop()
+	}
+	return n.Storage.Close(ctx)
+}
+
+// startSenders starts a stream to every follower. Callers hold mu.
+func (n *Node) startSenders() {
+	for _, addr := range n.conf.Followers {
+		s := newSender(addr, n.conf.Token, n.snapshot)
+		n.senders = append(n.senders, s)
+		go s.Run()
+	}
+}
+
+// Unwrap returns the wrapped storage.
+func (n *Node) Unwrap() storage.Storage {
+	return n.Storage
+}
+
+// Role returns the current role of the server.
+func (n *Node) Role() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+func (n *Node) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	return n.UpdateAll(ctx, storage.Data{Counters: storage.Counters{mname: delta}})
+}
+
+func (n *Node) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	return n.UpdateAll(ctx, storage.Data{Gauges: storage.Gauges{mname: value}})
+}
+
+// UpdateAll applies the batch on the primary and queues it for the followers.
+// A follower rejects it with ErrReadOnly.
+func (n *Node) UpdateAll(ctx context.Context, data storage.Data) error {
+	n.writes.RLock()
+	defer n.writes.RUnlock()
+	if n.Role() != PrimaryRole {
+		return ErrReadOnly
+	}
+	// Counter deltas commute, gauges are ordered: the last one written is the last one sent
+	unlock := n.gauges.Lock(data.Gauges)
+	defer unlock()
+	if err := n.Storage.UpdateAll(ctx, data); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	batch := Batch{Epoch: n.epoch, Seq: n.seq, Data: data}
+	for _, s := range n.senders {
+		s.Enqueue(batch)
+	}
+	return nil
+}
+
+// snapshot returns the full state of the primary as of its last accepted batch.
+func (n *Node) snapshot(ctx context.Context) Batch {
+	n.writes.Lock()
+	defer n.writes.Unlock()
+	n.mu.Lock()
+	epoch, seq := n.epoch, n.seq
+	n.mu.Unlock()
+	return Batch{Epoch: epoch, Seq: seq, Snapshot: true, Data: n.Storage.GetAll(ctx)}
+}
+
+// Apply applies a batch of the primary on a follower. A batch already applied
+// is ignored, so the primary may retry after a lost response. A gap in the stream
+// or a batch of another primary run is ErrOutOfSync.
+func (n *Node) Apply(ctx context.Context, batch Batch) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != FollowerRole {
+		return errors.New("not a follower")
+	}
+
+	if batch.Snapshot {
+		if err := n.Storage.UpdateAll(ctx, n.snapshotDiff(ctx, batch.Data)); err != nil {
+			return err
+		}
+		n.epoch, n.seq = batch.Epoch, batch.Seq
+		logger.Log.Info("replica synchronized", zap.String("epoch", n.epoch), zap.Uint64("seq", n.seq))
+		return nil
+	}
+
+	switch {
+	case batch.Epoch != n.epoch || batch.Seq > n.seq+1:
+		return ErrOutOfSync
+	case batch.Seq <= n.seq:
+		return nil
+	}
+	if err := n.Storage.UpdateAll(ctx, batch.Data); err != nil {
+		return err
+	}
+	n.seq = batch.Seq
+	return nil
+}
+
+// snapshotDiff converts the primary's state into an update of the local one:
+// counters are incremented by the difference, gauges are overwritten.
+func (n *Node) snapshotDiff(ctx context.Context, primary storage.Data) storage.Data {
+	local := n.Storage.GetAll(ctx)
+	data := storage.Data{Counters: storage.Counters{}, Gauges: primary.Gauges}
+	for mname, value := range primary.Counters {
+		if delta := value - local.Counters[mname]; delta != 0 {
+			data.Counters[mname] = delta
+		}
+	}
+	return data
+}
+
+// Promote makes a follower the primary. It starts a new epoch, so the followers
+// get a snapshot first. The old primary must be stopped or demoted by the operator.
+func (n *Node) Promote() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == PrimaryRole {
+		return errors.New("already the primary")
+	}
+	n.role = PrimaryRole
+	n.epoch, n.seq = newEpoch(), 0
+	n.startSenders()
+	logger.Log.Warn("promoted to primary", zap.String("epoch", n.epoch), zap.Strings("followers", n.conf.Followers))
+	return nil
+}
+
+// Status returns the replication state of the server and its streams.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	status := Status{Role: n.role, Epoch: n.epoch, Seq: n.seq}
+	for _, s := range n.senders {
+		status.Followers = append(status.Followers, s.Status(n.seq))
+	}
+	return status
+}
+
+// ApplyHandler returns the HTTP handler of ApplyPath: it applies the batch
+// in the body and answers 409 Conflict if the primary has to send a snapshot.
+func (n *Node) ApplyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch Batch
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err := n.Apply(r.Context(), batch)
+		switch {
+		case errors.Is(err, ErrOutOfSync):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err != nil:
+			logger.FromContext(r.Context()).Error("cannot apply replicated batch", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// StatusHandler returns the HTTP handler of the replication status:
+// GET answers Status, POST promotes a follower.
+func (n *Node) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := n.Promote(); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(n.Status())
+	})
+}
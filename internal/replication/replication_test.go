@@ -0,0 +1,236 @@
+package replication
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openNode opens a node on the in-memory storage.
+func openNode(t *testing.T, conf Config) *Node {
+	st, err := storage.New(storage.MemDriver, storage.Config{})
+	require.NoError(t, err)
+	n := NewNode(st, conf)
+	require.NoError(t, n.Open(context.Background()))
+	t.Cleanup(func() { n.Close(context.Background()) })
+	return n
+}
+
+// serveFollower serves the apply route of the follower. While down is set it answers 503.
+func serveFollower(t *testing.T, n *Node, down *atomic.Bool) *httptest.Server {
+	mux := http.NewServeMux()
+	apply := n.ApplyHandler()
+	mux.HandleFunc(ApplyPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if down != nil && down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		apply.ServeHTTP(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// assertReplicated waits until the follower has the metrics of the primary.
+func assertReplicated(t *testing.T, primary, follower *Node) {
+	ctx := context.Background()
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(primary.GetAll(ctx), follower.GetAll(ctx))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	follower := openNode(t, Config{Role: FollowerRole})
+	var down atomic.Bool
+	srv := serveFollower(t, follower, &down)
+
+	// Follower joins a primary with data: the first message is a snapshot
+	primary := openNode(t, Config{Role: PrimaryRole, Followers: []string{srv.URL}, Token: "secret"})
+	require.NoError(t, primary.UpdateCounter(ctx, "c", 5))
+	require.NoError(t, primary.UpdateGauge(ctx, "g", 1))
+	require.NoError(t, primary.UpdateAll(ctx, storage.Data{
+		Counters: storage.Counters{"c": 1},
+		Gauges:   storage.Gauges{"g": 2, "g2": 3},
+	}))
+	assertReplicated(t, primary, follower)
+	assert.Equal(t, storage.Data{
+		Counters: storage.Counters{"c": 6},
+		Gauges:   storage.Gauges{"g": 2, "g2": 3},
+	}, follower.GetAll(ctx))
+
+	// Follower accepts updates only from the primary
+	assert.ErrorIs(t, follower.UpdateCounter(ctx, "c", 1), ErrReadOnly)
+
+	// Batches accepted while the follower is down are delivered after it is back
+	down.Store(true)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, primary.UpdateCounter(ctx, "c", 1))
+	}
+	assert.Eventually(t, func() bool {
+		return primary.Status().Followers[0].LastError != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	down.Store(false)
+	assertReplicated(t, primary, follower)
+
+	status := primary.Status()
+	assert.Equal(t, PrimaryRole, status.Role)
+	assert.Equal(t, uint64(13), status.Seq)
+	assert.Eventually(t, func() bool {
+		return primary.Status().Followers[0].Lag == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestApply(t *testing.T) {
+	ctx := context.Background()
+	follower := openNode(t, Config{Role: FollowerRole})
+
+	// Без снапшота фолловер не знает эпоху первичного
+	batch := Batch{Epoch: "a", Seq: 1, Data: storage.Data{Counters: storage.Counters{"c": 1}}}
+	assert.ErrorIs(t, follower.Apply(ctx, batch), ErrOutOfSync)
+
+	require.NoError(t, follower.Apply(ctx, Batch{Epoch: "a", Seq: 1, Snapshot: true,
+		Data: storage.Data{Counters: storage.Counters{"c": 10}}}))
+	require.NoError(t, follower.Apply(ctx, Batch{Epoch: "a", Seq: 2,
+		Data: storage.Data{Counters: storage.Counters{"c": 1}}}))
+
+	// Повтор уже примененной пачки игнорируется, пропуск - рассинхронизация
+	require.NoError(t, follower.Apply(ctx, Batch{Epoch: "a", Seq: 2,
+		Data: storage.Data{Counters: storage.Counters{"c": 1}}}))
+	assert.ErrorIs(t, follower.Apply(ctx, Batch{Epoch: "a", Seq: 4}), ErrOutOfSync)
+	assert.ErrorIs(t, follower.Apply(ctx, Batch{Epoch: "b", Seq: 3}), ErrOutOfSync)
+
+	delta, err := follower.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), delta)
+
+	// Снапшот нового первичного приводит счетчики к его значениям
+	require.NoError(t, follower.Apply(ctx, Batch{Epoch: "b", Seq: 7, Snapshot: true,
+		Data: storage.Data{Counters: storage.Counters{"c": 4}}}))
+	delta, err = follower.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), delta)
+	assert.Equal(t, Status{Role: FollowerRole, Epoch: "b", Seq: 7}, follower.Status())
+}
+
+func TestPromote(t *testing.T) {
+	ctx := context.Background()
+	second := openNode(t, Config{Role: FollowerRole})
+	srv := serveFollower(t, second, nil)
+
+	first := openNode(t, Config{Role: FollowerRole, Followers: []string{srv.URL}, Token: "secret"})
+	require.NoError(t, first.Apply(ctx, Batch{Epoch: "old", Seq: 1, Snapshot: true,
+		Data: storage.Data{Gauges: storage.Gauges{"g": 1}}}))
+
+	// Повышенный фолловер принимает обновления и передает их своим фолловерам
+	require.NoError(t, first.Promote())
+	assert.Error(t, first.Promote())
+	require.NoError(t, first.UpdateCounter(ctx, "c", 1))
+	assertReplicated(t, first, second)
+	assert.Equal(t, storage.Gauges{"g": 1}, second.GetAll(ctx).Gauges)
+}
+
+// slowStorage blocks updates of the metric "slow" until release is closed.
+type slowStorage struct {
+	storage.Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStorage) UpdateAll(ctx context.Context, data storage.Data) error {
+	if _, ok := data.Counters["slow"]; ok {
+		close(s.started)
+		<-s.release
+	}
+	return s.Storage.UpdateAll(ctx, data)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	st, err := storage.New(storage.MemDriver, storage.Config{})
+	require.NoError(t, err)
+	slow := &slowStorage{Storage: st, started: make(chan struct{}), release: make(chan struct{})}
+	n := NewNode(slow, Config{Role: PrimaryRole})
+	require.NoError(t, n.Open(ctx))
+	defer n.Close(ctx)
+
+	done := make(chan error)
+	go func() { done <- n.UpdateCounter(ctx, "slow", 1) }()
+	<-slow.started
+
+	// Медленная запись не задерживает остальные, номер получает завершенная запись
+	require.NoError(t, n.UpdateCounter(ctx, "fast", 1))
+	assert.Equal(t, uint64(1), n.Status().Seq)
+
+	// Снапшот ждет незавершенную запись: она в нем и под своим номером
+	snapshot := make(chan Batch)
+	go func() { snapshot <- n.snapshot(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	close(slow.release)
+	require.NoError(t, <-done)
+	batch := <-snapshot
+	assert.Equal(t, uint64(2), batch.Seq)
+	assert.Equal(t, storage.Counters{"slow": 1, "fast": 1}, batch.Counters)
+}
+
+// lateStorage writes an update of the gauge "late" and then blocks until release is closed.
+type lateStorage struct {
+	storage.Storage
+	written chan struct{}
+	release chan struct{}
+}
+
+func (s *lateStorage) UpdateAll(ctx context.Context, data storage.Data) error {
+	if err := s.Storage.UpdateAll(ctx, data); err != nil {
+		return err
+	}
+	if data.Gauges["late"] == 1 {
+		close(s.written)
+		<-s.release
+	}
+	return nil
+}
+
+func TestConcurrentGaugeUpdates(t *testing.T) {
+	ctx := context.Background()
+	follower := openNode(t, Config{Role: FollowerRole})
+	srv := serveFollower(t, follower, nil)
+
+	st, err := storage.New(storage.MemDriver, storage.Config{})
+	require.NoError(t, err)
+	late := &lateStorage{Storage: st, written: make(chan struct{}), release: make(chan struct{})}
+	primary := NewNode(late, Config{Role: PrimaryRole, Followers: []string{srv.URL}, Token: "secret"})
+	require.NoError(t, primary.Open(ctx))
+	defer primary.Close(ctx)
+	require.NoError(t, primary.UpdateGauge(ctx, "late", 0))
+	assertReplicated(t, primary, follower)
+
+	first := make(chan error)
+	go func() { first <- primary.UpdateGauge(ctx, "late", 1) }()
+	<-late.written
+
+	// Вторая запись того же gauge ждет первую, иначе она получила бы меньший номер
+	second := make(chan error)
+	go func() { second <- primary.UpdateGauge(ctx, "late", 2) }()
+	time.Sleep(10 * time.Millisecond)
+	close(late.release)
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+
+	value, err := primary.GetGauge(ctx, "late")
+	require.NoError(t, err)
+	assert.Equal(t, float64(2), value)
+	assertReplicated(t, primary, follower)
+}
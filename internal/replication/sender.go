@@ -0,0 +1,208 @@
+// Package replication sender
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// queueSize is the number of batches buffered for a follower.
+	// A follower that falls further behind gets a snapshot instead.
+	queueSize = 1024
+
+	sendTimeout   = 10 * time.Second
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 10 * time.Second
+)
+
+// FollowerStatus describes the stream to one follower.
+type FollowerStatus struct {
+	Addr string `json:"addr"`
+	// Acked is the last batch confirmed by the follower.
+	Acked uint64 `json:"acked"`
+	// Lag is the number of accepted batches the follower has not confirmed.
+	Lag       uint64 `json:"lag"`
+	Resync    bool   `json:"resync"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// sender streams batches of the primary to one follower in order.
+// The first message and the first one after a queue overflow or
+// an out-of-sync answer is a snapshot.
+type sender struct {
+	url      string
+	token    string
+	client   *http.Client
+	snapshot func(context.Context) Batch
+
+	queue chan Batch
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu      sync.Mutex
+	resync  bool
+	acked   uint64
+	lastErr error
+}
+
+func newSender(addr, token string, snapshot func(context.Context) Batch) *sender {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &sender{
+		url:      strings.TrimSuffix(addr, "/") + ApplyPath,
+		token:    token,
+		client:   &http.Client{Timeout: sendTimeout},
+		snapshot: snapshot,
+		queue:    make(chan Batch, queueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		resync:   true,
+	}
+}
+
+// Enqueue queues the batch without blocking. On overflow the queue
+// is abandoned and the follower gets a snapshot.
+func (s *sender) Enqueue(batch Batch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.resync {
+		return
+	}
+	select {
+	case s.queue <- batch:
+	default:
+		logger.Log.Warn("replication queue is full, follower will be resynchronized", zap.String("url", s.url))
+		s.resync = true
+	}
+}
+
+// Run sends batches until Stop.
+func (s *sender) Run() {
+	defer close(s.done)
+	var sent uint64 // Last batch sent, older queued ones are in a snapshot already
+	for {
+		s.mu.Lock()
+		resync := s.resync
+		s.mu.Unlock()
+
+		var batch Batch
+		if resync {
+			// Resume queueing first: batches queued before the snapshot is taken
+			// are in it and skipped, the later ones follow it
+			s.mu.Lock()
+			s.resync = false
+			s.mu.Unlock()
+			batch = s.snapshot(context.Background())
+		} else {
+			select {
+			case batch = <-s.queue:
+			case <-s.stop:
+				return
+			}
+			if batch.Seq <= sent {
+				continue
+			}
+		}
+
+		if !s.deliver(batch) {
+			return
+		}
+		sent = batch.Seq
+	}
+}
+
+// deliver sends the batch until the follower accepts it or asks for a snapshot.
+// It returns false if the sender was stopped.
+func (s *sender) deliver(batch Batch) bool {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		logger.Log.Error("cannot encode replicated batch", zap.Error(err))
+		return true
+	}
+	delay := minRetryDelay
+	for {
+		err := s.post(body)
+		s.mu.Lock()
+		s.lastErr = err
+		switch {
+		case err == nil:
+			s.acked = batch.Seq
+		case errors.Is(err, ErrOutOfSync):
+			s.resync = true
+		}
+		s.mu.Unlock()
+		if err == nil || errors.Is(err, ErrOutOfSync) {
+			return true
+		}
+
+		logger.Log.Warn("cannot replicate batch", zap.String("url", s.url), zap.Uint64("seq", batch.Seq), zap.Error(err))
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return false
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// post sends one encoded batch. A 409 Conflict answer is ErrOutOfSync.
+func (s *sender) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return ErrOutOfSync
+	}
+	return fmt.Errorf("follower answered %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+}
+
+// Stop stops the sender and waits for it.
+func (s *sender) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Status returns the state of the stream. seq is the last batch accepted by the primary.
+func (s *sender) Status(seq uint64) FollowerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := FollowerStatus{
+		Addr:   s.url,
+		Acked:  s.acked,
+		Resync: s.resync,
+	}
+	if seq > s.acked {
+		status.Lag = seq - s.acked
+	}
+	if s.lastErr != nil {
+		status.LastError = s.lastErr.Error()
+	}
+	return status
+}
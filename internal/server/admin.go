@@ -0,0 +1,115 @@
+// Package server internal server Admin
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo-contrib/pprof"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/replication"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"go.uber.org/zap"
+)
+
+// ConfigureAdminRouter sets up the admin router: request logging, optional bearer-token
+// auth and the log level control. The admin router is served only on AdminListen,
+// so profiling and runtime settings are never exposed on the public metrics port.
+func (s *Server) ConfigureAdminRouter() {
+	s.adminRouter.Use(logger.RequestID)
+	s.adminRouter.Use(logger.RequestLogger)
+
+	if s.config.AdminToken != "" {
+		s.adminRouter.Use(adminAuthMiddleware(s.config.AdminToken))
+	}
+
+	// Runtime log level control
+	s.adminRouter.GET("/admin/loglevel", echo.WrapHandler(logger.LevelHandler()))
+	s.adminRouter.PUT("/admin/loglevel", echo.WrapHandler(logger.LevelHandler()))
+
+	// Replication stream from the primary, status and promotion
+	if node, ok := s.storage.(*replication.Node); ok {
+		s.adminRouter.POST(replication.ApplyPath, echo.WrapHandler(node.ApplyHandler()))
+		s.adminRouter.GET("/admin/replication", echo.WrapHandler(node.StatusHandler()))
+		s.adminRouter.POST("/admin/replication/promote", echo.WrapHandler(node.StatusHandler()))
+	}
+
+	// Health of the cluster nodes
+	if s.cluster != nil {
+		s.adminRouter.GET("/admin/cluster", s.ClusterHandler)
+	}
+
+	// On-demand snapshot, e.g. before an upgrade
+	s.adminRouter.POST("/admin/storage/snapshot", s.StorageSnapshotHandler)
+
+	// Flush lag of the write-behind storage cache
+	if _, ok := storage.WriteBehindStatsOf(s.storage); ok {
+		s.adminRouter.GET("/admin/storage/cache", s.StorageCacheHandler)
+	}
+}
+
+// StorageCacheHandler returns the stats of the write-behind storage cache as JSON.
+func (s *Server) StorageCacheHandler(c echo.Context) error {
+	stats, _ := storage.WriteBehindStatsOf(s.storage)
+	return c.JSON(http.StatusOK, stats)
+}
+
+// StorageSnapshotHandler saves the storage now instead of waiting for the store interval:
+// the store file is written and the write-behind cache is flushed.
+func (s *Server) StorageSnapshotHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	err := s.storage.Ping(ctx)
+	if err == nil {
+		err = s.storage.Save(ctx)
+	}
+	if err != nil {
+		logger.FromContext(ctx).Error("cannot save storage", zap.Error(err))
+		return c.String(http.StatusInternalServerError, err.Error())
+	}
+	return c.String(http.StatusOK, "OK")
+}
+
+// ConfigurePprof registers the pprof handlers with the server's admin router.
+// This allows for profiling the server's performance.
+func (s *Server) ConfigurePprof() {
+	pprof.Register(s.adminRouter)
+}
+
+// primaryOnly rejects updates on a replication follower: they are accepted only by the primary.
+func (s *Server) primaryOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	node, ok := s.storage.(*replication.Node)
+	if !ok {
+		return next
+	}
+	return func(c echo.Context) error {
+		if node.Role() != replication.PrimaryRole {
+			return c.String(http.StatusServiceUnavailable, replication.ErrReadOnly.Error())
+		}
+		return next(c)
+	}
+}
+
+// adminAuthMiddleware checks the "Authorization: Bearer <token>" header.
+func adminAuthMiddleware(token string) echo.MiddlewareFunc {
+	return middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+	})
+}
+
+// runAdmin starts the admin listener. It does nothing if AdminListen is not set.
+func (s *Server) runAdmin() {
+	if s.adminServer == nil {
+		logger.Log.Debug("Admin listener is disabled")
+		return
+	}
+	if s.config.AdminToken == "" {
+		logger.Log.Warn("Admin listener is not protected, set admin token", zap.String("url", s.config.AdminListen))
+	}
+	logger.Log.Info("Admin server is starting on: ", zap.String("url", s.config.AdminListen))
+	if err := s.adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log.Error("cannot run admin server", zap.Error(err))
+	}
+}
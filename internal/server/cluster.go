@@ -0,0 +1,302 @@
+// Package server internal server Cluster
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/cluster"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	models "github.com/rombintu/goyametricsv2/internal/models"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
+	"github.com/rombintu/goyametricsv2/lib/common"
+	"github.com/rombintu/goyametricsv2/lib/myhash"
+	"go.uber.org/zap"
+)
+
+// ConfigureCluster joins the cluster of ClusterNodes and starts health checks of the other nodes.
+// Without ClusterNodes the server owns all metrics.
+func (s *Server) ConfigureCluster() {
+	nodes := common.SplitList(s.config.ClusterNodes)
+	if len(nodes) == 0 {
+		return
+	}
+	self := s.config.ClusterSelf
+	if self == "" {
+		self = s.config.Listen
+	}
+	// Nodes share the admin token, it signs the requests they forward to each other
+	c, err := cluster.New(cluster.Config{Self: self, Nodes: nodes, Secret: s.config.AdminToken})
+	if err != nil {
+		logger.Log.Fatal("cannot configure cluster", zap.Error(err))
+	}
+	s.cluster = c
+	s.cluster.Start()
+	s.router.Pre(s.checkForwarded)
+	logger.Log.Info("Cluster configured", zap.String("self", self), zap.Strings("nodes", nodes))
+}
+
+// ClusterHandler returns the health of the cluster nodes as JSON.
+func (s *Server) ClusterHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.cluster.Status())
+}
+
+// checkForwarded strips ForwardedHeader from requests not forwarded by a cluster node,
+// so a client cannot skip the ownership checks with it.
+func (s *Server) checkForwarded(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if req.Header.Get(cluster.ForwardedHeader) == "" {
+			return next(c)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		if !s.cluster.Forwarded(req, body) {
+			logger.FromContext(req.Context()).Warn("forwarded header is not signed by a cluster node",
+				zap.String("remote", req.RemoteAddr))
+			req.Header.Del(cluster.ForwardedHeader)
+		}
+		return next(c)
+	}
+}
+
+// remoteOwner returns the node owning the metric if it is not this one.
+// Requests forwarded by another node are always handled here.
+func (s *Server) remoteOwner(c echo.Context, mname string) (string, bool) {
+	if s.cluster == nil || c.Request().Header.Get(cluster.ForwardedHeader) != "" {
+		return "", false
+	}
+	owner := s.cluster.Owner(mname)
+	return owner, !s.cluster.IsSelf(owner)
+}
+
+// proxy sends the request to the owner of the metric with body and relays the answer.
+func (s *Server) proxy(c echo.Context, owner string, body []byte) error {
+	req := c.Request()
+	header := http.Header{}
+	if contentType := req.Header.Get(echo.HeaderContentType); contentType != "" {
+		header.Set(echo.HeaderContentType, contentType)
+	}
+	s.signForward(header, body)
+
+	resp, err := s.cluster.Forward(req.Context(), owner, req.Method, req.URL.RequestURI(), header, body)
+	if err != nil {
+		logger.FromContext(req.Context()).Error("cannot proxy to owner", zap.String("owner", owner), zap.Error(err))
+		return c.String(forwardErrorStatus(err), err.Error())
+	}
+	defer resp.Body.Close()
+
+	for _, key := range []string{echo.HeaderContentType, myhash.Sha256Header} {
+		if value := resp.Header.Get(key); value != "" {
+			c.Response().Header().Set(key, value)
+		}
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+	_, err = io.Copy(c.Response(), resp.Body)
+	return err
+}
+
+// signForward adds the hash of the body, so the owner checks it like the agent's requests.
+func (s *Server) signForward(header http.Header, body []byte) {
+	if s.config.HashKey != "" && len(body) > 0 {
+		header.Set(myhash.Sha256Header, myhash.ToSHA256AndHMAC(body, s.config.HashKey))
+	}
+}
+
+// forwardErrorStatus is 503 for an owner failing health checks and 502 for other forward errors.
+func forwardErrorStatus(err error) int {
+	if errors.Is(err, cluster.ErrNodeDown) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// splitByOwner returns the metrics owned by this node and those of every other node.
+// Without a cluster, or for a forwarded request, all metrics are local.
+func (s *Server) splitByOwner(c echo.Context, data storage.Data) (storage.Data, map[string]storage.Data) {
+	if s.cluster == nil || c.Request().Header.Get(cluster.ForwardedHeader) != "" {
+		return data, nil
+	}
+	local := storage.Data{Counters: storage.Counters{}, Gauges: storage.Gauges{}}
+	remote := make(map[string]storage.Data)
+	part := func(mname string) storage.Data {
+		owner := s.cluster.Owner(mname)
+		if s.cluster.IsSelf(owner) {
+			return local
+		}
+		if _, ok := remote[owner]; !ok {
+			remote[owner] = storage.Data{Counters: storage.Counters{}, Gauges: storage.Gauges{}}
+		}
+		return remote[owner]
+	}
+	for mname, delta := range data.Counters {
+		part(mname).Counters[mname] = delta
+	}
+	for mname, value := range data.Gauges {
+		part(mname).Gauges[mname] = value
+	}
+	return local, remote
+}
+
+// checkOwners fails with ErrNodeDown if any owner fails health checks,
+// so a batch is rejected as a whole instead of being applied partly.
+func (s *Server) checkOwners(remote map[string]storage.Data) error {
+	for owner := range remote {
+		if !s.cluster.Healthy(owner) {
+			return fmt.Errorf("%w: %s", cluster.ErrNodeDown, owner)
+		}
+	}
+	return nil
+}
+
+// updatesPath is the batch update endpoint, also used to roll back forwarded counters.
+const updatesPath = "/updates/"
+
+// errRejected marks an owner that answered the batch with an error status: it applied nothing.
+var errRejected = errors.New("batch rejected")
+
+// batchError is the response to a batch that was not applied as a whole.
+// Applied lists the metrics that may remain applied by other nodes:
+// a retry must leave them out, or their counters are added twice.
+type batchError struct {
+	Message string           `json:"error"`
+	Applied []models.Metrics `json:"applied"`
+	status  int
+}
+
+func (e *batchError) Error() string {
+	return e.Message
+}
+
+// batchFailed answers with the batchError, other errors go to the error handler of echo.
+func batchFailed(c echo.Context, err error) error {
+	var be *batchError
+	if errors.As(err, &be) {
+		return c.JSON(be.status, be)
+	}
+	return err
+}
+
+// applyBatch forwards the metrics of other nodes to path and applies the local ones
+// only after every owner has accepted its part, so a failed batch can be retried as a whole.
+// If an owner or the storage fails, counters accepted by other owners are rolled back
+// with negated deltas. Gauges stay set, a retry sets them again. Imports in the replace
+// mode set values and need no rollback. Without remote metrics the error of the storage
+// is returned as is, otherwise a *batchError.
+func (s *Server) applyBatch(c echo.Context, path string, local storage.Data, remote map[string]storage.Data) error {
+	log := logger.FromContext(c.Request().Context())
+	failed := s.forwardUpdates(c.Request().Context(), path, remote)
+	var err error
+	if len(failed) == 0 {
+		ctx, span := storageSpan(c, "UpdateAll")
+		err = s.storage.UpdateAll(ctx, local)
+		tracing.End(span, err)
+		if err == nil {
+			return nil
+		}
+		log.Error(err.Error())
+		if len(remote) == 0 {
+			return err
+		}
+	}
+
+	resp := &batchError{Applied: []models.Metrics{}, status: http.StatusInternalServerError}
+	errs := []error{err}
+	rollback := make(map[string]storage.Data)
+	for owner, data := range remote {
+		ownerErr, ok := failed[owner]
+		switch {
+		case !ok:
+			if path == updatesPath && len(data.Counters) > 0 {
+				rollback[owner] = storage.Data{Counters: negate(data.Counters)}
+			}
+			continue
+		case notApplied(ownerErr):
+		default:
+			// The owner did not answer, it may have applied its part
+			resp.Applied = append(resp.Applied, metricsOf(data)...)
+		}
+		resp.status = http.StatusBadGateway
+		errs = append(errs, ownerErr)
+	}
+	for owner := range s.forwardUpdates(c.Request().Context(), updatesPath, rollback) {
+		log.Error("cannot roll back forwarded counters", zap.String("owner", owner))
+		resp.Applied = append(resp.Applied, metricsOf(remote[owner])...)
+	}
+	resp.Message = errors.Join(errs...).Error()
+	return resp
+}
+
+// notApplied reports whether the owner certainly did not apply the forwarded batch:
+// it was down, could not be dialed or answered with an error.
+func notApplied(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, cluster.ErrNodeDown) || errors.Is(err, errRejected) ||
+		errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// negate returns the counters with negated deltas.
+func negate(counters storage.Counters) storage.Counters {
+	negated := make(storage.Counters, len(counters))
+	for mname, delta := range counters {
+		negated[mname] = -delta
+	}
+	return negated
+}
+
+// forwardUpdates sends the metrics of other nodes to their path concurrently:
+// /updates/ or the import of the same mode. It returns the errors of the owners that failed.
+func (s *Server) forwardUpdates(ctx context.Context, path string, remote map[string]storage.Data) map[string]error {
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	var mu sync.Mutex
+	for owner, data := range remote {
+		wg.Add(1)
+		go func(owner string, data storage.Data) {
+			defer wg.Done()
+			err := s.forwardBatch(ctx, owner, path, data)
+			if err != nil {
+				logger.FromContext(ctx).Error("cannot forward updates", zap.String("owner", owner), zap.Error(err))
+				mu.Lock()
+				failed[owner] = err
+				mu.Unlock()
+			}
+		}(owner, data)
+	}
+	wg.Wait()
+	return failed
+}
+
+// forwardBatch sends the metrics as a JSON array to the path of the owner.
+func (s *Server) forwardBatch(ctx context.Context, owner, path string, data storage.Data) error {
+	body, err := json.Marshal(metricsOf(data))
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	s.signForward(header, body)
+
+	resp, err := s.cluster.Forward(ctx, owner, http.MethodPost, path, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: node %s answered %d: %s", errRejected, owner, resp.StatusCode, msg)
+	}
+	return nil
+}
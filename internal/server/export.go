@@ -0,0 +1,330 @@
+// Package server internal server Export and import
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	models "github.com/rombintu/goyametricsv2/internal/models"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
+	"github.com/rombintu/goyametricsv2/lib/common"
+	"github.com/rombintu/goyametricsv2/lib/myhash"
+	"github.com/rombintu/goyametricsv2/lib/myparser"
+	"go.uber.org/zap"
+)
+
+// Formats of the export and import
+const (
+	formatJSON   = "json"   // JSON array of metrics as /updates/ takes it
+	formatNDJSON = "ndjson" // One JSON metric per line
+	formatCSV    = "csv"    // type,id,value rows with a header
+)
+
+// Modes of the import
+const (
+	// importMerge adds imported counters to the current ones, as /updates/ does.
+	importMerge = "merge"
+	// importReplace sets counters to the imported values.
+	importReplace = "replace"
+)
+
+// exportContentTypes maps the formats to their content types.
+var exportContentTypes = map[string]string{
+	formatJSON:   echo.MIMEApplicationJSON,
+	formatNDJSON: "application/x-ndjson",
+	formatCSV:    "text/csv",
+}
+
+// csvHeader is the first row of the CSV format.
+var csvHeader = []string{"type", "id", "value"}
+
+// importResult is the response of the import: the numbers of imported metrics.
+type importResult struct {
+	Counters int `json:"counters"`
+	Gauges   int `json:"gauges"`
+}
+
+// ExportHandler streams all metrics in the format of the query, JSON by default.
+// Counters carry their values in delta, as in /value/ responses.
+//
+// Endpoint:
+//   - URL: /api/v1/export?format=json|ndjson|csv
+//   - Method: GET
+//
+// Example Response (csv):
+//
+//	type,id,value
+//	counter,PollCount,5
+//	gauge,Alloc,1.5
+//
+// In a cluster only the metrics of this node are exported.
+func (s *Server) ExportHandler(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatJSON
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unknown format %q, use json, ndjson or csv", format))
+	}
+
+	ctx, span := storageSpan(c, "GetAll")
+	data := s.storage.GetAll(ctx)
+	tracing.End(span, nil)
+
+	c.Response().Header().Set(echo.HeaderContentType, contentType)
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"metrics.%s\"", format))
+	c.Response().WriteHeader(http.StatusOK)
+	// The status is sent, a failed write can only be logged
+	if err := writeMetrics(c.Response(), format, metricsOf(data)); err != nil {
+		logger.FromContext(c.Request().Context()).Error("cannot export metrics", zap.Error(err))
+	}
+	return nil
+}
+
+// ImportHandler applies metrics in the format of the query, JSON by default, as one batch.
+// With mode=merge (default) counters are added as by /updates/, with mode=replace they are set
+// to the imported values. Gauges are set in both modes, metrics not in the import are kept.
+//
+// Endpoint:
+//   - URL: /api/v1/import?format=json|ndjson|csv&mode=merge|replace
+//   - Method: POST
+//
+// Example Response:
+//
+//	{"counters": 1, "gauges": 30}
+//
+// Replace reads the current counters first: updates made meanwhile by agents may be lost.
+// In a cluster the metrics of other nodes are imported by their owners, and the local ones
+// after all owners have accepted theirs, so a failed import can be retried.
+func (s *Server) ImportHandler(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatJSON
+	}
+	if _, ok := exportContentTypes[format]; !ok {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unknown format %q, use json, ndjson or csv", format))
+	}
+	mode := c.QueryParam("mode")
+	if mode == "" {
+		mode = importMerge
+	}
+	if mode != importMerge && mode != importReplace {
+		return c.String(http.StatusBadRequest, fmt.Sprintf("unknown mode %q, use merge or replace", mode))
+	}
+
+	metrics, err := readMetrics(c.Request().Body, format)
+	if err != nil {
+		log.Error(err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	data, err := importData(metrics, mode)
+	if err != nil {
+		log.Error(err.Error())
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	log.Debug("Importing metrics", zap.String("mode", mode), zap.Int("size", len(metrics)))
+
+	// Owners import their metrics with the same mode, all of them must be up
+	local, remote := s.splitByOwner(c, data)
+	if err := s.checkOwners(remote); err != nil {
+		log.Error(err.Error())
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
+	if mode == importReplace {
+		ctx, span := storageSpan(c, "GetAll")
+		local = storage.Diff(local, s.storage.GetAll(ctx))
+		tracing.End(span, nil)
+	}
+	path := updatesPath
+	if mode == importReplace {
+		path = "/api/v1/import?format=json&mode=replace"
+	}
+	if err := s.applyBatch(c, path, local, remote); err != nil {
+		return batchFailed(c, err)
+	}
+
+	if s.config.SyncMode {
+		s.SyncStorage(c.Request().Context())
+	}
+
+	bytesData, err := json.Marshal(importResult{Counters: len(data.Counters), Gauges: len(data.Gauges)})
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Failed to encode JSON")
+	}
+	// Add HashSHA256 to the response header if a hash key is configured
+	if s.config.HashKey != "" {
+		c.Response().Header().Set(myhash.Sha256Header, myhash.ToSHA256AndHMAC(bytesData, s.config.HashKey))
+	}
+	return c.JSONBlob(http.StatusOK, bytesData)
+}
+
+// metricsOf returns the metrics of data sorted by type and name,
+// counters with their values in Delta.
+func metricsOf(data storage.Data) []models.Metrics {
+	metrics := make([]models.Metrics, 0, len(data.Counters)+len(data.Gauges))
+	for _, mname := range common.SortedKeys(data.Counters) {
+		m := models.Metrics{ID: mname, MType: storage.CounterType}
+		m.SetDelta(data.Counters[mname])
+		metrics = append(metrics, m)
+	}
+	for _, mname := range common.SortedKeys(data.Gauges) {
+		m := models.Metrics{ID: mname, MType: storage.GaugeType}
+		m.SetValue(data.Gauges[mname])
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// writeMetrics writes the metrics to w in the format one by one.
+func writeMetrics(w io.Writer, format string, metrics []models.Metrics) error {
+	if format == formatCSV {
+		cw := csv.NewWriter(w)
+		cw.Write(csvHeader)
+		for _, m := range metrics {
+			value := ""
+			if m.Delta != nil {
+				value = strconv.FormatInt(*m.Delta, 10)
+			} else if m.Value != nil {
+				value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+			}
+			cw.Write([]string{m.MType, m.ID, value})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	bw := bufio.NewWriter(w)
+	if format == formatNDJSON {
+		enc := json.NewEncoder(bw)
+		for _, m := range metrics {
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	}
+	// A JSON array with a metric per line
+	bw.WriteString("[")
+	for i, m := range metrics {
+		line, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		bw.WriteString("\n")
+		bw.Write(line)
+	}
+	if len(metrics) > 0 {
+		bw.WriteString("\n")
+	}
+	bw.WriteString("]\n")
+	return bw.Flush()
+}
+
+// readMetrics reads the metrics in the format from r.
+func readMetrics(r io.Reader, format string) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	switch format {
+	case formatJSON:
+		if err := json.NewDecoder(r).Decode(&metrics); err != nil {
+			return nil, err
+		}
+	case formatNDJSON:
+		dec := json.NewDecoder(r)
+		for {
+			var m models.Metrics
+			err := dec.Decode(&m)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("metric %d: %w", len(metrics)+1, err)
+			}
+			metrics = append(metrics, m)
+		}
+	case formatCSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(csvHeader)
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			// The header is optional
+			line, _ := cr.FieldPos(0)
+			if line == 1 && slices.Equal(record, csvHeader) {
+				continue
+			}
+			m, err := parseCSVMetric(record)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics, nil
+}
+
+// parseCSVMetric parses a type,id,value row.
+func parseCSVMetric(record []string) (models.Metrics, error) {
+	m := models.Metrics{MType: record[0], ID: record[1]}
+	switch m.MType {
+	case storage.CounterType:
+		delta, err := myparser.Str2Int64(record[2])
+		if err != nil {
+			return m, err
+		}
+		m.SetDelta(delta)
+	case storage.GaugeType:
+		value, err := myparser.Str2Float64(record[2])
+		if err != nil {
+			return m, err
+		}
+		m.SetValue(value)
+	default:
+		return m, storage.ErrInvalidType
+	}
+	return m, nil
+}
+
+// importData makes the batch of the imported metrics. In the merge mode counters
+// of the same name are summed, as by /updates/. In the replace mode the last value wins.
+func importData(metrics []models.Metrics, mode string) (storage.Data, error) {
+	data := storage.Data{Counters: storage.Counters{}, Gauges: storage.Gauges{}}
+	for _, m := range metrics {
+		switch {
+		case m.ID == "":
+			return data, errors.New("metric id is empty")
+		case m.MType == storage.CounterType && m.Delta != nil && m.Value == nil:
+			if mode == importMerge {
+				data.Counters[m.ID] += *m.Delta
+			} else {
+				data.Counters[m.ID] = *m.Delta
+			}
+		case m.MType == storage.GaugeType && m.Value != nil && m.Delta == nil:
+			data.Gauges[m.ID] = *m.Value
+		case m.MType != storage.CounterType && m.MType != storage.GaugeType:
+			return data, fmt.Errorf("metric %q: %w", m.ID, storage.ErrInvalidType)
+		default:
+			return data, fmt.Errorf("metric %q: counter needs delta, gauge needs value", m.ID)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/config"
+	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMemServer returns a server on the in-memory storage with its routes.
+func newMemServer(t *testing.T, data storage.Data) *Server {
+	st, err := storage.New(storage.MemDriver, storage.Config{})
+	require.NoError(t, err)
+	require.NoError(t, st.Open(context.Background()))
+	require.NoError(t, st.UpdateAll(context.Background(), data))
+	s := NewServer(st, config.ServerConfig{})
+	s.ConfigureRouter()
+	return s
+}
+
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestExportHandler(t *testing.T) {
+	s := newMemServer(t, storage.Data{
+		Counters: storage.Counters{"PollCount": 5},
+		Gauges:   storage.Gauges{"Alloc": 1.5, "Free": 0.25},
+	})
+
+	tests := []struct {
+		format      string
+		contentType string
+		body        string
+	}{
+		{
+			format:      "",
+			contentType: echo.MIMEApplicationJSON,
+			body: `[
+{"id":"PollCount","type":"counter","delta":5},
+{"id":"Alloc","type":"gauge","value":1.5},
+{"id":"Free","type":"gauge","value":0.25}
+]
+`,
+		},
+		{
+			format:      formatNDJSON,
+			contentType: "application/x-ndjson",
+			body: `{"id":"PollCount","type":"counter","delta":5}
+{"id":"Alloc","type":"gauge","value":1.5}
+{"id":"Free","type":"gauge","value":0.25}
+`,
+		},
+		{
+			format:      formatCSV,
+			contentType: "text/csv",
+			body:        "type,id,value\ncounter,PollCount,5\ngauge,Alloc,1.5\ngauge,Free,0.25\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run("format_"+tt.format, func(t *testing.T) {
+			rec := serve(s, http.MethodGet, "/api/v1/export?format="+tt.format, "")
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.contentType, rec.Header().Get(echo.HeaderContentType))
+			assert.Equal(t, tt.body, rec.Body.String())
+
+			// Выгрузка загружается обратно в том же формате
+			target := newMemServer(t, storage.Data{})
+			rec = serve(target, http.MethodPost, "/api/v1/import?format="+tt.format, tt.body)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, `{"counters":1,"gauges":2}`, rec.Body.String())
+			ctx := context.Background()
+			assert.Equal(t, s.storage.GetAll(ctx), target.storage.GetAll(ctx))
+		})
+	}
+
+	rec := serve(s, http.MethodGet, "/api/v1/export?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Пустое хранилище выгружается пустым массивом
+	rec = serve(newMemServer(t, storage.Data{}), http.MethodGet, "/api/v1/export", "")
+	assert.Equal(t, "[]\n", rec.Body.String())
+}
+
+func TestImportHandler(t *testing.T) {
+	ctx := context.Background()
+	s := newMemServer(t, storage.Data{
+		Counters: storage.Counters{"requests": 10, "errors": 1},
+		Gauges:   storage.Gauges{"load": 0.5},
+	})
+	body := "counter,requests,3\ncounter,requests,4\ngauge,load,0.75\n"
+
+	// Слияние прибавляет счетчики, как /updates/
+	rec := serve(s, http.MethodPost, "/api/v1/import?format=csv", body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, storage.Data{
+		Counters: storage.Counters{"requests": 17, "errors": 1},
+		Gauges:   storage.Gauges{"load": 0.75},
+	}, s.storage.GetAll(ctx))
+
+	// Замена выставляет значения, побеждает последнее, остальные метрики не трогаются
+	rec = serve(s, http.MethodPost, "/api/v1/import?format=csv&mode=replace", body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, storage.Data{
+		Counters: storage.Counters{"requests": 4, "errors": 1},
+		Gauges:   storage.Gauges{"load": 0.75},
+	}, s.storage.GetAll(ctx))
+
+	tests := []struct {
+		name   string
+		target string
+		body   string
+	}{
+		{name: "unknown_format", target: "/api/v1/import?format=xml", body: `[]`},
+		{name: "unknown_mode", target: "/api/v1/import?mode=overwrite", body: `[]`},
+		{name: "invalid_json", target: "/api/v1/import", body: `[{"id":"c"`},
+		{name: "invalid_ndjson_line", target: "/api/v1/import?format=ndjson", body: "{\"id\":\"c\",\"type\":\"counter\",\"delta\":1}\n{\n"},
+		{name: "csv_invalid_value", target: "/api/v1/import?format=csv", body: "counter,c,1.5\n"},
+		{name: "csv_wrong_fields", target: "/api/v1/import?format=csv", body: "counter,c\n"},
+		{name: "invalid_type", target: "/api/v1/import?format=csv", body: "histogram,h,1\n"},
+		{name: "counter_with_value", target: "/api/v1/import", body: `[{"id":"c","type":"counter","value":1}]`},
+		{name: "empty_id", target: "/api/v1/import", body: `[{"id":"","type":"gauge","value":1}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := s.storage.GetAll(ctx)
+			rec := serve(s, http.MethodPost, tt.target, tt.body)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+			assert.Equal(t, before, s.storage.GetAll(ctx))
+		})
+	}
+}
+
+func TestImportCluster(t *testing.T) {
+	ctx := context.Background()
+	servers, listeners := startClusterNodes(t, 2)
+
+	var body strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&body, "counter,c%d,%d\n", i, i)
+	}
+	// Повторная замена на любом узле не меняет значений у владельцев
+	for _, l := range listeners {
+		resp, err := http.Post(l.URL+"/api/v1/import?format=csv&mode=replace", "text/csv", strings.NewReader(body.String()))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	total := 0
+	for _, s := range servers {
+		counters := s.storage.GetAll(ctx).Counters
+		for mname, value := range counters {
+			assert.True(t, s.cluster.IsSelf(s.cluster.Owner(mname)), mname)
+			assert.Equal(t, mname, fmt.Sprintf("c%d", value))
+		}
+		total += len(counters)
+	}
+	assert.Equal(t, 20, total)
+}
+
+func TestImportClusterRollback(t *testing.T) {
+	ctx := context.Background()
+	stores := make([]storage.Storage, 3)
+	for i := range stores {
+		st, err := storage.New(storage.MemDriver, storage.Config{})
+		require.NoError(t, err)
+		require.NoError(t, st.Open(ctx))
+		stores[i] = st
+	}
+	stores[2] = failingStorage{stores[2]}
+	servers, listeners := startCluster(t, stores)
+
+	var body strings.Builder
+	for i := 0; i < 30; i++ {
+		fmt.Fprintf(&body, "counter,c%d,%d\n", i, i+1)
+	}
+	// Слияние не применяется частично: повтор не удвоит счетчики
+	resp, err := http.Post(listeners[0].URL+"/api/v1/import?format=csv", "text/csv", strings.NewReader(body.String()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	assert.Empty(t, servers[0].storage.GetAll(ctx).Counters)
+	counters := servers[1].storage.GetAll(ctx).Counters
+	assert.NotEmpty(t, counters)
+	for mname, value := range counters {
+		assert.Zero(t, value, mname)
+	}
+}
@@ -2,19 +2,29 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
-	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/rombintu/goyametricsv2/internal/logger"
 	models "github.com/rombintu/goyametricsv2/internal/models"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
 	"github.com/rombintu/goyametricsv2/lib/myhash"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// storageSpan starts a span around a storage call made by the handler.
+// The returned context carries the span and is cancelled when the client goes away.
+func storageSpan(c echo.Context, op string) (context.Context, trace.Span) {
+	return tracing.Start(c.Request().Context(), "storage."+op)
+}
+
 // MetricsHandler handles HTTP requests to update metrics in the server's storage system.
 // It processes incoming requests to update specific metrics based on the provided parameters
 // and stores the updated values in the server's storage system.
@@ -40,6 +50,7 @@ import (
 //   - Status: 404 Not Found (if the metric name is missing)
 //   - Body: "Missing metric name"
 func (s *Server) MetricsHandler(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
 	// Extract the metric type, name, and value from the request parameters
 	mtype := c.Param("mtype")
 	mname := c.Param("mname")
@@ -50,10 +61,17 @@ func (s *Server) MetricsHandler(c echo.Context) error {
 		// Return a 404 Not Found status with an error message
 		return c.String(http.StatusNotFound, "Missing metric name")
 	}
+	// The metric of another cluster node is updated there
+	if owner, ok := s.remoteOwner(c, mname); ok {
+		return s.proxy(c, owner, nil)
+	}
 	// Attempt to update the metric in the storage system
-	if err := s.storage.Update(mtype, mname, mvalue); err != nil {
+	ctx, span := storageSpan(c, "Update")
+	err := storage.UpdateString(ctx, s.storage, mtype, mname, mvalue)
+	tracing.End(span, err)
+	if err != nil {
 		// Log the error with additional context
-		logger.Log.Error(
+		log.Error(
 			err.Error(),
 			zap.String("type", mtype),
 			zap.String("id/name", mname),
@@ -65,7 +83,7 @@ func (s *Server) MetricsHandler(c echo.Context) error {
 
 	// If sync mode is enabled, perform a synchronous storage update
 	if s.config.SyncMode {
-		s.SyncStorage()
+		s.SyncStorage(c.Request().Context())
 	}
 	// Return a 200 OK status with a success message
 	return c.String(http.StatusOK, "updated")
@@ -92,14 +110,21 @@ func (s *Server) MetricsHandler(c echo.Context) error {
 //   - Status: 404 Not Found (if the metric is not found)
 //   - Body: "not found"
 func (s *Server) MetricGetHandler(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
 	// Extract the metric type and name from the request parameters
 	mtype := c.Param("mtype")
 	mname := c.Param("mname")
+	// The metric of another cluster node is read there
+	if owner, ok := s.remoteOwner(c, mname); ok {
+		return s.proxy(c, owner, nil)
+	}
 	// Attempt to retrieve the metric value from the storage system
-	value, err := s.storage.Get(mtype, mname)
+	ctx, span := storageSpan(c, "Get")
+	value, err := storage.GetString(ctx, s.storage, mtype, mname)
+	tracing.End(span, err)
 	if err != nil {
 		// Log the error with additional context
-		logger.Log.Error(err.Error(), zap.String("type", mtype), zap.String("id/name", mname))
+		log.Error(err.Error(), zap.String("type", mtype), zap.String("id/name", mname))
 		// Return a 404 Not Found status with an error message
 		return c.String(http.StatusNotFound, "not found")
 	}
@@ -121,9 +146,30 @@ func (s *Server) MetricGetHandler(c echo.Context) error {
 // Response:
 //   - Status: 200 OK
 //   - Body: Rendered HTML content displaying all metrics
+//
+// A client accepting application/json gets the metrics as JSON, signed like the other JSON responses:
+//
+//	{"counters": {"PollCount": 5}, "gauges": {"Alloc": 1.5}}
+//
+// In a cluster only the metrics of this node are listed.
 func (s *Server) RootHandler(c echo.Context) error {
+	ctx, span := storageSpan(c, "GetAll")
+	data := s.storage.GetAll(ctx)
+	tracing.End(span, nil)
+
+	if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMEApplicationJSON) {
+		bytesData, err := json.Marshal(data)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to encode JSON")
+		}
+		// Add HashSHA256 to the response header if a hash key is configured
+		if s.config.HashKey != "" {
+			c.Response().Header().Set(myhash.Sha256Header, myhash.ToSHA256AndHMAC(bytesData, s.config.HashKey))
+		}
+		return c.JSONBlob(http.StatusOK, bytesData)
+	}
 	// Render the metrics.html template with all metrics from the storage system
-	return c.Render(http.StatusOK, "metrics.html", s.storage.GetAll())
+	return c.Render(http.StatusOK, "metrics.html", data)
 }
 
 // MetricUpdateHandlerJSON handles HTTP requests to update metrics in the server's storage system using JSON payloads.
@@ -152,18 +198,28 @@ func (s *Server) RootHandler(c echo.Context) error {
 //   - Status: 500 Internal Server Error (if there is an error encoding JSON)
 //   - Body: "Failed to encode JSON"
 func (s *Server) MetricUpdateHandlerJSON(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
 	// Define a variable to hold the decoded metric
 	var metric models.Metrics
 
-	// Decode the JSON payload from the request body into the metric variable
-	if err := json.NewDecoder(c.Request().Body).Decode(&metric); err != nil {
-		logger.Log.Error(err.Error())
+	// Decode the JSON payload from the request body into the metric variable.
+	// The body is kept to proxy it to the owner of the metric.
+	body, err := io.ReadAll(c.Request().Body)
+	if err == nil {
+		err = json.Unmarshal(body, &metric)
+	}
+	if err != nil {
+		log.Error(err.Error())
 		// Return a 400 Bad Request status with the error message
 		return c.String(http.StatusBadRequest, err.Error())
 	}
+	// The metric of another cluster node is updated there
+	if owner, ok := s.remoteOwner(c, metric.ID); ok {
+		return s.proxy(c, owner, body)
+	}
 
 	// Log the decoded metric for debugging purposes
-	logger.Log.Debug(
+	log.Debug(
 		"Try decode metric",
 		zap.String("id", metric.ID),
 		zap.String("mtype", metric.MType),
@@ -171,38 +227,33 @@ func (s *Server) MetricUpdateHandlerJSON(c echo.Context) error {
 		zap.Any("value", metric.Value),
 	)
 
-	// Initialize a variable to hold the parsed metric value
-	var mvalue string
-	// Parse the metric value based on its type
+	// Update the metric with the typed value of its type
 	switch metric.MType {
 	case storage.GaugeType:
 		// Ensure the value is not nil for gauge type
 		if metric.Value == nil {
-			err := errors.New("delta must be not null")
-			logger.Log.Error(err.Error())
-			return c.String(http.StatusBadRequest, err.Error())
+			err = errors.New("value must be not null")
+			break
 		}
-		// Convert the float value to a string
-		mvalue = strconv.FormatFloat(*metric.Value, 'g', -1, 64)
+		ctx, span := storageSpan(c, "UpdateGauge")
+		err = s.storage.UpdateGauge(ctx, metric.ID, *metric.Value)
+		tracing.End(span, err)
 	case storage.CounterType:
 		// Ensure the delta is not nil for counter type
 		if metric.Delta == nil {
-			err := errors.New("delta must be not null")
-			logger.Log.Error(err.Error())
-			return c.String(http.StatusBadRequest, err.Error())
+			err = errors.New("delta must be not null")
+			break
 		}
-		// Convert the int64 delta to a string
-		mvalue = strconv.FormatInt(*metric.Delta, 10)
+		ctx, span := storageSpan(c, "UpdateCounter")
+		err = s.storage.UpdateCounter(ctx, metric.ID, *metric.Delta)
+		tracing.End(span, err)
+	default:
+		err = storage.ErrInvalidType
 	}
-
-	// Log the parsed value for debugging purposes
-	logger.Log.Debug("Parse", zap.String("value", mvalue))
-
-	// Attempt to update the metric in the storage system
-	if err := s.storage.Update(metric.MType, metric.ID, mvalue); err != nil {
-		logger.Log.Error(
-			err.Error(), zap.String("type", metric.MType),
-			zap.String("id", metric.ID), zap.String("value", mvalue),
+	if err != nil {
+		log.Error(
+			err.Error(), zap.String("type", metric.MType), zap.String("id", metric.ID),
+			zap.Any("delta", metric.Delta), zap.Any("value", metric.Value),
 		)
 		// Return a 400 Bad Request status with the error message
 		return c.String(http.StatusBadRequest, err.Error())
@@ -210,7 +261,7 @@ func (s *Server) MetricUpdateHandlerJSON(c echo.Context) error {
 
 	// If sync mode is enabled, perform a synchronous storage update
 	if s.config.SyncMode {
-		s.SyncStorage()
+		s.SyncStorage(c.Request().Context())
 	}
 
 	// If a hash key is configured, add a SHA256 hash to the response header
@@ -272,19 +323,20 @@ func (s *Server) MetricUpdateHandlerJSON(c echo.Context) error {
 //
 // ]
 func (s *Server) MetricUpdatesHandlerJSON(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
 	// Define a variable to hold the decoded metrics
 	var metrics []models.Metrics
 
 	// Decode the JSON payload from the request body into the metric variable
 	if err := json.NewDecoder(c.Request().Body).Decode(&metrics); err != nil {
 		// Log the error
-		logger.Log.Error(err.Error())
+		log.Error(err.Error())
 		// Return a 400 Bad Request status with the error message
 		return c.String(http.StatusBadRequest, err.Error())
 	}
 
 	// Log the decoded metric for debugging purposes
-	logger.Log.Debug(
+	log.Debug(
 		"Try decode metrics", zap.Int("size", len(metrics)),
 	)
 
@@ -309,14 +361,21 @@ func (s *Server) MetricUpdatesHandlerJSON(c echo.Context) error {
 		}
 	}
 
-	if err := s.storage.UpdateAll(data); err != nil {
-		logger.Log.Error(err.Error())
-		return err
+	// Metrics of other cluster nodes are forwarded to them. All owners must be up,
+	// so the batch is not applied partly when one of them is known to be down.
+	// Local metrics are applied after every owner has accepted its part.
+	local, remote := s.splitByOwner(c, data)
+	if err := s.checkOwners(remote); err != nil {
+		log.Error(err.Error())
+		return c.String(http.StatusServiceUnavailable, err.Error())
+	}
+	if err := s.applyBatch(c, updatesPath, local, remote); err != nil {
+		return batchFailed(c, err)
 	}
 
 	// Если 0 то синхронная запись
 	if s.config.SyncMode {
-		s.SyncStorage()
+		s.SyncStorage(c.Request().Context())
 	}
 
 	// add HashSHA256 to Header
@@ -356,29 +415,47 @@ func (s *Server) MetricUpdatesHandlerJSON(c echo.Context) error {
 //	  "delta": 5
 //	}
 func (s *Server) MetricValueHandlerJSON(c echo.Context) error {
+	log := logger.FromContext(c.Request().Context())
 	var metric models.Metrics
-	// Decode the JSON payload from the request body into the metric variable
-	if err := json.NewDecoder(c.Request().Body).Decode(&metric); err != nil {
-		logger.Log.Error(err.Error())
+	// Decode the JSON payload from the request body into the metric variable.
+	// The body is kept to proxy it to the owner of the metric.
+	body, err := io.ReadAll(c.Request().Body)
+	if err == nil {
+		err = json.Unmarshal(body, &metric)
+	}
+	if err != nil {
+		log.Error(err.Error())
 		// Return a 400 Bad Request status with the error message
 		return c.String(http.StatusBadRequest, err.Error())
 	}
-	// Retrieve the metric value from the storage
-	mvalue, err := s.storage.Get(metric.MType, metric.ID)
+	// The metric of another cluster node is read there
+	if owner, ok := s.remoteOwner(c, metric.ID); ok {
+		return s.proxy(c, owner, body)
+	}
+	// Retrieve the value or delta of the metric from the storage
+	switch metric.MType {
+	case storage.GaugeType:
+		ctx, span := storageSpan(c, "GetGauge")
+		var value float64
+		value, err = s.storage.GetGauge(ctx, metric.ID)
+		tracing.End(span, err)
+		metric.SetValue(value)
+	case storage.CounterType:
+		ctx, span := storageSpan(c, "GetCounter")
+		var delta int64
+		delta, err = s.storage.GetCounter(ctx, metric.ID)
+		tracing.End(span, err)
+		metric.SetDelta(delta)
+	default:
+		err = storage.ErrInvalidType
+	}
 	if err != nil {
 		// Log the error with additional details
-		logger.Log.Error(err.Error(), zap.String("type", metric.MType), zap.String("id", metric.ID))
+		log.Error(err.Error(), zap.String("type", metric.MType), zap.String("id", metric.ID))
 		// Return a 404 Not Found status with a custom message
 		return c.String(http.StatusNotFound, "not found")
 	}
 
-	// Set the value or delta of the metric based on the retrieved value
-	if err := metric.SetValueOrDelta(mvalue); err != nil {
-		logger.Log.Error(err.Error(), zap.String("value", mvalue))
-		// Return a 400 Bad Request status with the error message
-		return c.String(http.StatusBadRequest, err.Error())
-	}
-
 	// Add HashSHA256 to the response header if a hash key is configured
 	if s.config.HashKey != "" {
 		bytesData, err := json.Marshal(metric)
@@ -414,7 +491,10 @@ func (s *Server) MetricValueHandlerJSON(c echo.Context) error {
 // <error message>
 func (s *Server) PingDatabase(c echo.Context) error {
 	// Attempt to ping the database
-	if err := s.storage.Ping(); err != nil {
+	ctx, span := storageSpan(c, "Ping")
+	err := s.storage.Ping(ctx)
+	tracing.End(span, err)
+	if err != nil {
 		// Return a 500 Internal Server Error status with the error message
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
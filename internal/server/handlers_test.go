@@ -2,10 +2,11 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -14,6 +15,7 @@ import (
 	"github.com/rombintu/goyametricsv2/internal/mocks"
 	models "github.com/rombintu/goyametricsv2/internal/models"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/lib/myhash"
 	"github.com/rombintu/goyametricsv2/lib/ptrhelper"
 	"github.com/stretchr/testify/assert"
 )
@@ -32,10 +34,10 @@ func TestServer_updateMetrics(t *testing.T) {
 	s := NewServer(m, config.ServerConfig{})
 	s.ConfigureRouter()
 
-	m.EXPECT().Update(counterMetricType, "counter1", "1").Return(nil)
-	m.EXPECT().Update(counterMetricType, "counter1", "5").Return(nil)
-	m.EXPECT().Update(gaugeMetricType, "gauge1", "1.5").Return(nil)
-	m.EXPECT().Update(gaugeMetricType, "gauge1", "2").Return(nil)
+	m.EXPECT().UpdateCounter(gomock.Any(), "counter1", int64(1)).Return(nil)
+	m.EXPECT().UpdateCounter(gomock.Any(), "counter1", int64(5)).Return(nil)
+	m.EXPECT().UpdateGauge(gomock.Any(), "gauge1", 1.5).Return(nil)
+	m.EXPECT().UpdateGauge(gomock.Any(), "gauge1", float64(2)).Return(nil)
 
 	type want struct {
 		code        int
@@ -137,8 +139,8 @@ func TestServer_MetricGetHandler(t *testing.T) {
 	s := NewServer(m, config.ServerConfig{})
 	s.ConfigureRouter()
 
-	m.EXPECT().Get(counterMetricType, "counter1").Return("1", nil).AnyTimes()
-	m.EXPECT().Get(counterMetricType, "unknown").Return("", errors.New("not found"))
+	m.EXPECT().GetCounter(gomock.Any(), "counter1").Return(int64(1), nil).AnyTimes()
+	m.EXPECT().GetCounter(gomock.Any(), "unknown").Return(int64(0), storage.ErrNotFound)
 
 	type want struct {
 		code        int
@@ -222,10 +224,10 @@ func TestServer_MetricUpdateHandlerJSON(t *testing.T) {
 	}
 
 	t.Run("ValidMetric", func(t *testing.T) {
-		m.EXPECT().Update(counterMetricType, validMetric.ID, "10").Return(nil)
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().UpdateCounter(gomock.Any(), validMetric.ID, int64(10)).Return(nil)
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		body, _ := json.Marshal(validMetric)
 		req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBuffer(body))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
@@ -241,9 +243,9 @@ func TestServer_MetricUpdateHandlerJSON(t *testing.T) {
 
 	// Тест на невалидные данные
 	t.Run("InvalidMetric", func(t *testing.T) {
-		m.EXPECT().Update(invalidMetric.MType, invalidMetric.ID, "").Return(errors.New("invalid"))
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		// Неизвестный тип отклоняется до обращения к хранилищу
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		body, _ := json.Marshal(invalidMetric)
 		req := httptest.NewRequest(http.MethodPost, "/update", bytes.NewBuffer(body))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
@@ -294,10 +296,10 @@ func TestServer_MetricUpdatesHandlerJSON(t *testing.T) {
 	}
 
 	t.Run("UpdateMetricsJSON", func(t *testing.T) {
-		m.EXPECT().UpdateAll(data).Return(nil)
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().UpdateAll(gomock.Any(), data).Return(nil)
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		body, _ := json.Marshal(payload)
 		req := httptest.NewRequest(http.MethodPost, "/updates", bytes.NewBuffer(body))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
@@ -330,10 +332,10 @@ func TestServer_MetricValueHandlerJSON(t *testing.T) {
 	}
 
 	t.Run("GetMetricJSON", func(t *testing.T) {
-		m.EXPECT().Get(counterMetricType, payload.ID).Return("10", nil)
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().GetCounter(gomock.Any(), payload.ID).Return(int64(10), nil)
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		body, _ := json.Marshal(payload)
 		req := httptest.NewRequest(http.MethodPost, "/value", bytes.NewBuffer(body))
 		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
@@ -361,9 +363,9 @@ func TestServer_PingDatabase(t *testing.T) {
 	s.ConfigureRouter()
 
 	t.Run("PingDatabase", func(t *testing.T) {
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		req := httptest.NewRequest(http.MethodGet, "/ping", nil)
 		// req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		rec := httptest.NewRecorder()
@@ -376,3 +378,60 @@ func TestServer_PingDatabase(t *testing.T) {
 		assert.Equal(t, http.StatusOK, rec.Code)
 	})
 }
+
+func TestServer_RootHandlerJSON(t *testing.T) {
+	e := echo.New()
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mocks.NewMockStorage(ctrl)
+	s := NewServer(m, config.ServerConfig{HashKey: "key"})
+	data := storage.Data{Counters: storage.Counters{"PollCount": 5}, Gauges: storage.Gauges{"Alloc": 1.5}}
+	m.EXPECT().GetAll(gomock.Any()).Return(data)
+
+	// Клиент, принимающий JSON, получает метрики без шаблона и с подписью
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	assert.NoError(t, s.RootHandler(e.NewContext(req, rec)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"counters":{"PollCount":5},"gauges":{"Alloc":1.5}}`, rec.Body.String())
+	assert.Equal(t, myhash.ToSHA256AndHMAC(rec.Body.Bytes(), "key"), rec.Header().Get(myhash.Sha256Header))
+}
+
+// BenchmarkMetricUpdatesHandlerJSON measures /updates/ throughput of parallel agents
+// against the in-memory driver, while the page and sync worker read snapshots.
+// Run with: go test -race -bench=MetricUpdatesHandlerJSON ./internal/server
+func BenchmarkMetricUpdatesHandlerJSON(b *testing.B) {
+	e := echo.New()
+	st := storage.NewTmpDriver("")
+	st.Open(context.Background())
+	s := NewServer(st, config.ServerConfig{})
+
+	payload := []models.Metrics{{ID: "PollCount", MType: counterMetricType, Delta: ptrhelper.Int64Ptr(1)}}
+	for i := 0; i < 30; i++ {
+		payload = append(payload, models.Metrics{
+			ID:    "Gauge" + strconv.Itoa(i),
+			MType: gaugeMetricType,
+			Value: ptrhelper.Float64Ptr(float64(i)),
+		})
+	}
+	body, _ := json.Marshal(payload)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			if err := s.MetricUpdatesHandlerJSON(e.NewContext(req, rec)); err != nil {
+				b.Fatal(err)
+			}
+			if i++; i%100 == 0 {
+				st.GetAll(context.Background())
+			}
+		}
+	})
+}
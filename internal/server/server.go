@@ -2,20 +2,27 @@
 package server
 
 import (
+	"context"
 	"crypto/rsa"
+	"errors"
 	"net/http"
+	"time"
 
-	"github.com/labstack/echo-contrib/pprof"
 	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/cluster"
 	"github.com/rombintu/goyametricsv2/internal/config"
 	"github.com/rombintu/goyametricsv2/internal/logger"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/rombintu/goyametricsv2/internal/tracing"
 	"github.com/rombintu/goyametricsv2/lib/mycrypt"
 	"github.com/rombintu/goyametricsv2/lib/mygzip"
 	"github.com/rombintu/goyametricsv2/lib/myhash"
 	"go.uber.org/zap"
 )
 
+// shutdownTimeout limits how long in-flight requests are awaited on shutdown.
+const shutdownTimeout = 10 * time.Second
+
 type InternalStorage struct {
 	privateKey *rsa.PrivateKey
 }
@@ -25,7 +32,13 @@ type Server struct {
 	config          config.ServerConfig // Configuration for the server
 	storage         storage.Storage     // Storage interface for managing data
 	router          *echo.Echo          // Echo router for handling HTTP requests
+	adminRouter     *echo.Echo          // Echo router for pprof and admin routes
+	httpServer      *http.Server        // Public listener serving router
+	adminServer     *http.Server        // Admin listener serving adminRouter, nil if disabled
 	internalStorage InternalStorage
+	cluster         *cluster.Cluster // Nodes sharing the metrics, nil if not clustered
+
+	tracingShutdown tracing.ShutdownFunc // Flushes spans on shutdown
 }
 
 // NewServer creates a new instance of the Server with the provided storage and configuration.
@@ -38,31 +51,43 @@ type Server struct {
 // Returns:
 // - A pointer to the newly created Server instance.
 func NewServer(storage storage.Storage, config config.ServerConfig) *Server {
-	return &Server{
-		config:  config,
-		router:  echo.New(),
-		storage: storage,
+	s := &Server{
+		config:      config,
+		router:      echo.New(),
+		adminRouter: echo.New(),
+		storage:     storage,
 	}
+	s.httpServer = &http.Server{Addr: config.Listen, Handler: s.router}
+	if config.AdminListen != "" {
+		s.adminServer = &http.Server{Addr: config.AdminListen, Handler: s.adminRouter}
+	}
+	return s
 }
 
 // Configure sets up various components of the server, including the renderer, middlewares, router, storage, and pprof.
 func (s *Server) Configure() {
 	s.ConfigureRenderer("")
 	s.ConfigureMiddlewares()
+	s.ConfigureTracing()
 	s.ConfigureRouter()
 	s.ConfigureStorage()
+	s.ConfigureCluster()
+	s.ConfigureAdminRouter()
 	s.ConfigurePprof()
 	s.ConfigureCrypto()
 }
 
 // Run starts the server by listening on the configured address and handling incoming requests.
+// The admin listener, if configured, is started alongside.
 // It logs the server's starting URL and handles any errors that occur during the server's operation.
 // If an error occurs, it closes the storage and logs a fatal error.
 func (s *Server) Run() {
+	go s.runAdmin()
+
 	logger.Log.Info("Server is starting on: ", zap.String("url", s.config.Listen))
-	if err := http.ListenAndServe(s.config.Listen, s.router); err != nil {
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		// If an error occurs, close the storage and log a fatal error
-		s.storage.Close()
+		s.storage.Close(context.Background())
 		logger.Log.Fatal("cannot run server", zap.Error(err))
 	}
 }
@@ -70,13 +95,14 @@ func (s *Server) Run() {
 // ConfigureStorage initializes the storage by opening it and optionally restoring data if the restore flag is set.
 // It logs the storage configuration and any errors that occur during the process.
 func (s *Server) ConfigureStorage() {
-	if err := s.storage.Open(); err != nil {
+	ctx := context.Background()
+	if err := s.storage.Open(ctx); err != nil {
 		logger.Log.Fatal("cannot open storage", zap.Error(err))
 	}
 	// If the restore flag is true, restore the storage
 	if s.config.RestoreFlag {
-		if err := s.storage.Restore(); err != nil {
-			logger.Log.Warn("cannot restore storage", zap.String("error", err.Error()))
+		if err := s.restoreStorage(ctx); err != nil {
+			logger.Log.Fatal("cannot restore storage", zap.Error(err))
 		}
 	}
 	logger.Log.Debug("Storage configuration",
@@ -85,46 +111,97 @@ func (s *Server) ConfigureStorage() {
 	)
 }
 
+// restoreStorage restores the storage. It returns the errors the server must not start with:
+// serving the partial state, the next save would overwrite the store and lose the rest,
+// like the store encrypted with another key or the updates of a missing WAL segment.
+// Other errors are logged and the server starts with what was restored.
+func (s *Server) restoreStorage(ctx context.Context) error {
+	err := s.storage.Restore(ctx)
+	if err == nil || errors.Is(err, storage.ErrSnapshotKey) || errors.Is(err, storage.ErrWALGap) {
+		return err
+	}
+	logger.Log.Warn("cannot restore storage", zap.String("error", err.Error()))
+	return nil
+}
+
 // ConfigureRouter sets up the routes for the server's router.
 // It defines the endpoints for handling various HTTP requests.
 func (s *Server) ConfigureRouter() {
 	s.router.GET("/", s.RootHandler)
 	s.router.GET("/value/:mtype/:mname", s.MetricGetHandler)
-	s.router.POST("/update/:mtype/:mname/:mvalue", s.MetricsHandler)
+	s.router.POST("/update/:mtype/:mname/:mvalue", s.MetricsHandler, s.primaryOnly)
 
 	// JSON endpoints
-	s.router.POST("/update/", s.MetricUpdateHandlerJSON)
+	s.router.POST("/update/", s.MetricUpdateHandlerJSON, s.primaryOnly)
 	s.router.POST("/value/", s.MetricValueHandlerJSON)
 
-	s.router.POST("/updates/", s.MetricUpdatesHandlerJSON)
+	s.router.POST("/updates/", s.MetricUpdatesHandlerJSON, s.primaryOnly)
 
 	s.router.GET("/ping", s.PingDatabase)
+
+	// Bulk export and import of all metrics
+	s.router.GET("/api/v1/export", s.ExportHandler)
+	s.router.POST("/api/v1/import", s.ImportHandler, s.primaryOnly)
 }
 
 // ConfigureMiddlewares sets up the middlewares for the server's router.
 // It initializes the logger, adds request logging, gzip compression, and hash checking middlewares.
 func (s *Server) ConfigureMiddlewares() {
-	logger.Initialize(s.config.EnvMode)
+	if err := logger.InitializeWithConfig(s.config.EnvMode, s.loggerConfig()); err != nil {
+		logger.Log.Error("cannot configure logger, using defaults", zap.Error(err))
+		logger.Initialize(s.config.EnvMode)
+	}
+
+	// Request ID goes first, so every log line below carries it
+	s.router.Use(logger.RequestID)
+
+	// Server span, continues the agent's trace from traceparent
+	s.router.Use(tracing.Middleware)
 
 	// iter 21
 	if s.config.SecureMode {
-		s.router.Use(mycrypt.EncryptMiddleware(s.config.PrivateKeyFile))
+		s.router.Use(tracing.Step("decrypt", mycrypt.EncryptMiddleware(s.config.PrivateKeyFile)))
 	}
 
 	s.router.Use(logger.RequestLogger)
 
 	// Gzip middleware for compression
-	s.router.Use(mygzip.GzipMiddleware)
+	s.router.Use(tracing.Step("gzip", mygzip.GzipMiddleware))
 
 	// Hash check middleware for verifying request integrity
-	s.router.Use(myhash.HashCheckMiddleware(s.config.HashKey))
+	s.router.Use(tracing.Step("hash_check", myhash.HashCheckMiddleware(s.config.HashKey)))
 
+	// Span of the route handler itself
+	s.router.Use(tracing.Handler)
 }
 
-// ConfigurePprof registers the pprof handlers with the server's router.
-// This allows for profiling the server's performance.
-func (s *Server) ConfigurePprof() {
-	pprof.Register(s.router)
+// ConfigureTracing sets up the span exporter. Spans of middlewares, handlers
+// and storage calls are created anyway and exported only if an exporter is set.
+func (s *Server) ConfigureTracing() {
+	shutdown, err := tracing.Initialize(context.Background(), "metrics-server", tracing.Config{
+		Exporter: s.config.TraceExporter,
+		Endpoint: s.config.TraceEndpoint,
+		File:     s.config.TraceFile,
+	})
+	if err != nil {
+		logger.Log.Error("cannot configure tracing", zap.Error(err))
+		return
+	}
+	s.tracingShutdown = shutdown
+}
+
+// loggerConfig converts the server configuration into the logger settings.
+func (s *Server) loggerConfig() logger.Config {
+	return logger.Config{
+		Level:            s.config.LogLevel,
+		Encoding:         s.config.LogEncoding,
+		File:             s.config.LogFile,
+		MaxSize:          int(s.config.LogMaxSize),
+		MaxAge:           int(s.config.LogMaxAge),
+		MaxBackups:       int(s.config.LogMaxBackups),
+		SampleInitial:    int(s.config.LogSampleInitial),
+		SampleThereafter: int(s.config.LogSampleThereafter),
+	}
 }
 
 func (s *Server) ConfigureCrypto() {
@@ -151,26 +228,51 @@ func (s *Server) ConfigureCrypto() {
 	}
 }
 
-// syncStorage synchronizes the storage by saving any pending changes.
+// SyncStorage synchronizes the storage by saving any pending changes.
 // It logs any errors that occur during the save process.
-func (s *Server) SyncStorage() {
-	if err := s.storage.Ping(); err != nil {
+func (s *Server) SyncStorage(ctx context.Context) {
+	if err := s.storage.Ping(ctx); err != nil {
 		return
 	}
-	if err := s.storage.Save(); err != nil {
+	if err := s.storage.Save(ctx); err != nil {
 		logger.Log.Error("cannot save storage", zap.Error(err))
 	}
 	logger.Log.Debug("Storage synchronized", zap.String("path", s.config.StoragePath))
 }
 
 // Shutdown gracefully shuts down the server.
-// It logs the shutdown process, synchronizes the storage, and closes the storage.
+// It logs the shutdown process, stops both listeners, synchronizes the storage, and closes the storage.
 func (s *Server) Shutdown() {
 	logger.Log.Info("Server is shutting down...")
-	s.SyncStorage()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range []*http.Server{s.httpServer, s.adminServer} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Log.Error("cannot shutdown listener", zap.String("addr", srv.Addr), zap.Error(err))
+		}
+	}
+	if s.cluster != nil {
+		s.cluster.Stop()
+	}
+
+	// The listeners may have used up the shutdown timeout, the storage gets its own
+	storageCtx, storageCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer storageCancel()
+	s.SyncStorage(storageCtx)
 
 	// Close storage pools on shutdown
-	if err := s.storage.Close(); err != nil {
+	if err := s.storage.Close(storageCtx); err != nil {
 		logger.Log.Error("cannot close storage", zap.Error(err))
 	}
+
+	// Flush pending spans
+	if s.tracingShutdown != nil {
+		if err := s.tracingShutdown(context.Background()); err != nil {
+			logger.Log.Error("cannot shutdown tracing", zap.Error(err))
+		}
+	}
 }
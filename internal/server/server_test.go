@@ -1,12 +1,33 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/labstack/echo/v4"
+	"github.com/rombintu/goyametricsv2/internal/cluster"
 	"github.com/rombintu/goyametricsv2/internal/config"
+	"github.com/rombintu/goyametricsv2/internal/logger"
 	"github.com/rombintu/goyametricsv2/internal/mocks"
+	models "github.com/rombintu/goyametricsv2/internal/models"
+	"github.com/rombintu/goyametricsv2/internal/replication"
 	"github.com/rombintu/goyametricsv2/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
 )
 
 func TestNewServer(t *testing.T) {
@@ -39,9 +60,9 @@ func TestSyncStorage(t *testing.T) {
 	m := mocks.NewMockStorage(ctrl)
 	t.Run("check_sync_storage", func(t *testing.T) {
 
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		// Создаем экземпляр Server с моками
 		server := NewServer(
 			m,
@@ -50,7 +71,7 @@ func TestSyncStorage(t *testing.T) {
 		defer server.Shutdown()
 
 		// Вызываем метод syncStorage
-		server.SyncStorage()
+		server.SyncStorage(context.Background())
 	})
 }
 
@@ -60,10 +81,10 @@ func TestConfigureStorage(t *testing.T) {
 
 	m := mocks.NewMockStorage(ctrl)
 	t.Run("Simple_configure_storage", func(t *testing.T) {
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Open().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Open(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		server := NewServer(
 			m,
 			config.ServerConfig{},
@@ -73,15 +94,57 @@ func TestConfigureStorage(t *testing.T) {
 	})
 }
 
+func TestRestoreStorageWALGap(t *testing.T) {
+	ctx := context.Background()
+	storepath := filepath.Join(t.TempDir(), "store.json")
+	open := func() storage.Storage {
+		st, err := storage.New(storage.FileDriver, storage.Config{
+			Path:    storepath,
+			Options: []storage.Option{storage.WithWAL(0)},
+		})
+		require.NoError(t, err)
+		require.NoError(t, st.Open(ctx))
+		return st
+	}
+
+	st := open()
+	require.NoError(t, st.UpdateCounter(ctx, "c", 1))
+	require.NoError(t, st.Save(ctx))
+	require.NoError(t, st.UpdateCounter(ctx, "c", 2))
+	require.NoError(t, st.Close(ctx))
+	saved, err := os.ReadFile(storepath)
+	require.NoError(t, err)
+
+	// Сегмент журнала после снапшота потерян
+	segments, err := filepath.Glob(storepath + ".wal.*")
+	require.NoError(t, err)
+	sort.Strings(segments)
+	require.NotEmpty(t, segments)
+	require.NoError(t, os.Remove(segments[0]))
+
+	// Сервер не стартует с частью данных, а сохранение не перезаписывает хранилище
+	server := NewServer(open(), config.ServerConfig{RestoreFlag: true, StoragePath: storepath})
+	assert.ErrorIs(t, server.restoreStorage(ctx), storage.ErrWALGap)
+	server.SyncStorage(ctx)
+	server.Shutdown()
+
+	content, err := os.ReadFile(storepath)
+	require.NoError(t, err)
+	assert.Equal(t, saved, content)
+	segments, err = filepath.Glob(storepath + ".wal.*")
+	require.NoError(t, err)
+	assert.NotEmpty(t, segments)
+}
+
 func TestConfigureMiddlewares(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
 
 	m := mocks.NewMockStorage(ctrl)
 	t.Run("Simple_configure_middlewares", func(t *testing.T) {
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		// Создаем экземпляр Server с моками
 		server := NewServer(
 			m,
@@ -100,9 +163,9 @@ func TestConfigurePprof(t *testing.T) {
 
 	m := mocks.NewMockStorage(ctrl)
 	t.Run("Simple_configure_pprof", func(t *testing.T) {
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		// Создаем экземпляр Server с моками
 		server := NewServer(
 			m,
@@ -121,9 +184,9 @@ func TestConfigureCrypto(t *testing.T) {
 
 	m := mocks.NewMockStorage(ctrl)
 	t.Run("Simple_configure_crypto", func(t *testing.T) {
-		m.EXPECT().Ping().Return(nil).AnyTimes()
-		m.EXPECT().Save().Return(nil).AnyTimes()
-		m.EXPECT().Close().Return(nil).AnyTimes()
+		m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+		m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
 		// Создаем экземпляр Server с моками
 		server := NewServer(
 			m,
@@ -135,3 +198,340 @@ func TestConfigureCrypto(t *testing.T) {
 		server.ConfigureCrypto()
 	})
 }
+
+func TestAdminRouter(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mocks.NewMockStorage(ctrl)
+	server := NewServer(m, config.ServerConfig{
+		EnvMode:     logger.ProdMode,
+		LogLevel:    "warn",
+		AdminListen: "localhost:0",
+		AdminToken:  "secret",
+	})
+	server.ConfigureMiddlewares()
+	server.ConfigureRouter()
+	server.ConfigureAdminRouter()
+	server.ConfigurePprof()
+
+	tests := []struct {
+		name   string
+		router http.Handler
+		method string
+		target string
+		body   string
+		token  string
+		code   int
+	}{
+		{name: "pprof_not_public", router: server.router, method: http.MethodGet, target: "/debug/pprof/", code: http.StatusNotFound},
+		{name: "loglevel_not_public", router: server.router, method: http.MethodGet, target: "/admin/loglevel", code: http.StatusNotFound},
+		{name: "admin_without_token", router: server.adminRouter, method: http.MethodGet, target: "/admin/loglevel", code: http.StatusBadRequest},
+		{name: "admin_wrong_token", router: server.adminRouter, method: http.MethodGet, target: "/debug/pprof/", token: "wrong", code: http.StatusUnauthorized},
+		{name: "pprof_with_token", router: server.adminRouter, method: http.MethodGet, target: "/debug/pprof/", token: "secret", code: http.StatusOK},
+		{name: "get_loglevel", router: server.adminRouter, method: http.MethodGet, target: "/admin/loglevel", token: "secret", code: http.StatusOK},
+		{name: "put_loglevel", router: server.adminRouter, method: http.MethodPut, target: "/admin/loglevel", body: `{"level":"error"}`, token: "secret", code: http.StatusOK},
+		{name: "storage_cache_disabled", router: server.adminRouter, method: http.MethodGet, target: "/admin/storage/cache", token: "secret", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			tt.router.ServeHTTP(rec, req)
+			assert.Equal(t, tt.code, rec.Code)
+		})
+	}
+	assert.Equal(t, zapcore.ErrorLevel, logger.Log.Level())
+}
+
+func TestStorageCacheHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mocks.NewMockStorage(ctrl)
+	st := storage.WithWriteBehind(m, storage.WriteBehind{FlushInterval: time.Hour})
+	require.NoError(t, st.UpdateCounter(context.Background(), "c", 1))
+	server := NewServer(st, config.ServerConfig{})
+	server.ConfigureAdminRouter()
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/storage/cache", nil)
+	rec := httptest.NewRecorder()
+	server.adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var stats storage.WriteBehindStats
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	assert.Equal(t, 1, stats.Pending)
+}
+
+func TestStorageSnapshotHandler(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mocks.NewMockStorage(ctrl)
+	server := NewServer(m, config.ServerConfig{})
+	server.ConfigureAdminRouter()
+
+	m.EXPECT().Ping(gomock.Any()).Return(nil).Times(2)
+	m.EXPECT().Save(gomock.Any()).Return(nil)
+	req := httptest.NewRequest(http.MethodPost, "/admin/storage/snapshot", nil)
+	rec := httptest.NewRecorder()
+	server.adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Ошибка сохранения возвращается клиенту
+	m.EXPECT().Save(gomock.Any()).Return(errors.New("disk is full"))
+	req = httptest.NewRequest(http.MethodPost, "/admin/storage/snapshot", nil)
+	rec = httptest.NewRecorder()
+	server.adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "disk is full", rec.Body.String())
+}
+
+func TestReplicationFollower(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// Обновления фолловеру отклоняются до хранилища
+	m := mocks.NewMockStorage(ctrl)
+	node := replication.NewNode(m, replication.Config{Role: replication.FollowerRole})
+	server := NewServer(node, config.ServerConfig{})
+	server.ConfigureRouter()
+	server.ConfigureAdminRouter()
+
+	req := httptest.NewRequest(http.MethodPost, "/update/counter/c/1", nil)
+	rec := httptest.NewRecorder()
+	server.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/replication", nil)
+	rec = httptest.NewRecorder()
+	server.adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status replication.Status
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, replication.FollowerRole, status.Role)
+}
+
+func TestRunAndShutdown(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	m := mocks.NewMockStorage(ctrl)
+	m.EXPECT().Ping(gomock.Any()).Return(nil).AnyTimes()
+	m.EXPECT().Save(gomock.Any()).Return(nil).AnyTimes()
+	m.EXPECT().Close(gomock.Any()).Return(nil).AnyTimes()
+	server := NewServer(m, config.ServerConfig{Listen: "localhost:0", AdminListen: "localhost:0"})
+
+	done := make(chan struct{})
+	go func() {
+		server.Run()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Both listeners are stopped by Shutdown
+	server.Shutdown()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("server is not stopped by Shutdown")
+	}
+}
+
+// startClusterNodes starts servers on the in-memory storage joined into one cluster.
+func startClusterNodes(t *testing.T, n int) ([]*Server, []*httptest.Server) {
+	stores := make([]storage.Storage, n)
+	for i := range stores {
+		st, err := storage.New(storage.MemDriver, storage.Config{})
+		require.NoError(t, err)
+		require.NoError(t, st.Open(context.Background()))
+		stores[i] = st
+	}
+	return startCluster(t, stores)
+}
+
+// startCluster starts servers on the storages joined into one cluster.
+func startCluster(t *testing.T, stores []storage.Storage) ([]*Server, []*httptest.Server) {
+	return startClusterWith(t, stores, config.ServerConfig{})
+}
+
+// startClusterWith starts servers with conf on the storages joined into one cluster.
+func startClusterWith(t *testing.T, stores []storage.Storage, conf config.ServerConfig) ([]*Server, []*httptest.Server) {
+	n := len(stores)
+	listeners := make([]*httptest.Server, n)
+	nodes := make([]string, n)
+	for i := range listeners {
+		listeners[i] = httptest.NewUnstartedServer(nil)
+		nodes[i] = listeners[i].Listener.Addr().String()
+	}
+	servers := make([]*Server, n)
+	for i := range servers {
+		conf.Listen, conf.ClusterNodes = nodes[i], strings.Join(nodes, ",")
+		servers[i] = NewServer(stores[i], conf)
+		servers[i].ConfigureRouter()
+		servers[i].ConfigureCluster()
+		servers[i].ConfigureAdminRouter()
+		t.Cleanup(servers[i].cluster.Stop)
+
+		listeners[i].Config.Handler = servers[i].router
+		listeners[i].Start()
+		t.Cleanup(listeners[i].Close)
+	}
+	return servers, listeners
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	servers, listeners := startClusterNodes(t, 2)
+
+	// Любой узел принимает пачку и отдает чужие метрики их владельцу
+	var body strings.Builder
+	body.WriteString("[")
+	for i := 0; i < 20; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"id":"c%d","type":"counter","delta":%d}`, i, i)
+	}
+	body.WriteString("]")
+	resp, err := http.Post(listeners[0].URL+"/updates/", echo.MIMEApplicationJSON, strings.NewReader(body.String()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, s := range servers {
+		counters := s.storage.GetAll(ctx).Counters
+		assert.NotEmpty(t, counters)
+		for mname := range counters {
+			assert.True(t, s.cluster.IsSelf(s.cluster.Owner(mname)), mname)
+		}
+	}
+
+	// Чтение через любой узел проксируется владельцу
+	for i := 0; i < 20; i++ {
+		for _, l := range listeners {
+			resp, err := http.Get(fmt.Sprintf("%s/value/counter/c%d", l.URL, i))
+			require.NoError(t, err)
+			value, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, strconv.Itoa(i), string(value))
+		}
+	}
+	resp, err = http.Post(listeners[1].URL+"/value/", echo.MIMEApplicationJSON, strings.NewReader(`{"id":"c3","type":"counter"}`))
+	require.NoError(t, err)
+	var metric models.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metric))
+	resp.Body.Close()
+	require.NotNil(t, metric.Delta)
+	assert.Equal(t, int64(3), *metric.Delta)
+
+	// Пока владелец недоступен, пачка с его метриками отклоняется целиком
+	listeners[1].Close()
+	servers[0].cluster.CheckHealth(ctx)
+	before := servers[0].storage.GetAll(ctx)
+	resp, err = http.Post(listeners[0].URL+"/updates/", echo.MIMEApplicationJSON, strings.NewReader(body.String()))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, before, servers[0].storage.GetAll(ctx))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/cluster", nil)
+	rec := httptest.NewRecorder()
+	servers[0].adminRouter.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"healthy":false`)
+}
+
+func TestClusterSpoofedForward(t *testing.T) {
+	ctx := context.Background()
+	stores := make([]storage.Storage, 2)
+	for i := range stores {
+		st, err := storage.New(storage.MemDriver, storage.Config{})
+		require.NoError(t, err)
+		require.NoError(t, st.Open(ctx))
+		stores[i] = st
+	}
+	servers, listeners := startClusterWith(t, stores, config.ServerConfig{AdminToken: "secret"})
+
+	// Метрика второго узла, отправленная первому с поддельным заголовком пересылки
+	mname := ""
+	for i := 0; mname == ""; i++ {
+		if owner := servers[0].cluster.Owner(fmt.Sprintf("g%d", i)); !servers[0].cluster.IsSelf(owner) {
+			mname = fmt.Sprintf("g%d", i)
+		}
+	}
+	for _, target := range []string{"/update/", "/updates/"} {
+		body := fmt.Sprintf(`{"id":%q,"type":"gauge","value":1}`, mname)
+		if target == "/updates/" {
+			body = "[" + body + "]"
+		}
+		req, err := http.NewRequest(http.MethodPost, listeners[0].URL+target, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(cluster.ForwardedHeader, listeners[1].Listener.Addr().String())
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, target)
+	}
+
+	// Заголовок без подписи узла отброшен: метрика записана владельцем
+	assert.Empty(t, servers[0].storage.GetAll(ctx).Gauges)
+	assert.Equal(t, storage.Gauges{mname: 1}, servers[1].storage.GetAll(ctx).Gauges)
+}
+
+// failingStorage rejects all batch updates.
+type failingStorage struct {
+	storage.Storage
+}
+
+func (failingStorage) UpdateAll(context.Context, storage.Data) error {
+	return errors.New("disk is full")
+}
+
+func TestClusterRollback(t *testing.T) {
+	ctx := context.Background()
+	stores := make([]storage.Storage, 3)
+	for i := range stores {
+		st, err := storage.New(storage.MemDriver, storage.Config{})
+		require.NoError(t, err)
+		require.NoError(t, st.Open(ctx))
+		stores[i] = st
+	}
+	stores[2] = failingStorage{stores[2]}
+	servers, listeners := startCluster(t, stores)
+
+	var body strings.Builder
+	body.WriteString("[")
+	for i := 0; i < 30; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"id":"c%d","type":"counter","delta":%d}`, i, i+1)
+	}
+	body.WriteString("]")
+
+	// Владелец отклонил свою часть: локальная часть не применяется,
+	// принятые другим узлом счетчики откатываются, повтор пачки безопасен
+	resp, err := http.Post(listeners[0].URL+"/updates/", echo.MIMEApplicationJSON, strings.NewReader(body.String()))
+	require.NoError(t, err)
+	var result batchError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Contains(t, result.Message, "answered 500")
+	assert.Empty(t, result.Applied)
+
+	assert.Empty(t, servers[0].storage.GetAll(ctx).Counters)
+	counters := servers[1].storage.GetAll(ctx).Counters
+	assert.NotEmpty(t, counters)
+	for mname, value := range counters {
+		assert.Zero(t, value, mname)
+	}
+}
@@ -0,0 +1,37 @@
+// Package storage Diff
+package storage
+
+// Diff returns the batch that makes to hold the metrics of from when applied with UpdateAll:
+// the deltas that bring its counters to the values of from and the gauges that differ.
+// Metrics only in to are not touched, a storage cannot delete them. An empty batch means
+// to already holds all metrics of from.
+func Diff(from, to Data) Data {
+	diff := Data{Counters: Counters{}, Gauges: Gauges{}}
+	for mname, value := range from.Counters {
+		if current, ok := to.Counters[mname]; !ok || current != value {
+			diff.Counters[mname] = value - current
+		}
+	}
+	for mname, value := range from.Gauges {
+		if current, ok := to.Gauges[mname]; !ok || current != value {
+			diff.Gauges[mname] = value
+		}
+	}
+	return diff
+}
+
+// Extra returns the number of metrics of to that are not in from.
+func Extra(from, to Data) int {
+	extra := 0
+	for mname := range to.Counters {
+		if _, ok := from.Counters[mname]; !ok {
+			extra++
+		}
+	}
+	for mname := range to.Gauges {
+		if _, ok := from.Gauges[mname]; !ok {
+			extra++
+		}
+	}
+	return extra
+}
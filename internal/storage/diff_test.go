@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	from := Data{
+		Counters: Counters{"same": 1, "changed": 10, "new": 3, "zero": 0},
+		Gauges:   Gauges{"same": 1.5, "changed": 2, "new": 0},
+	}
+	to := Data{
+		Counters: Counters{"same": 1, "changed": 4, "extra": 7},
+		Gauges:   Gauges{"same": 1.5, "changed": 1},
+	}
+	diff := Diff(from, to)
+	assert.Equal(t, Data{
+		Counters: Counters{"changed": 6, "new": 3, "zero": 0},
+		Gauges:   Gauges{"changed": 2, "new": 0},
+	}, diff)
+	assert.Equal(t, 1, Extra(from, to))
+
+	// После применения разницы повторная ничего не пишет
+	ctx := context.Background()
+	st := NewTmpDriver(memPath)
+	require.NoError(t, st.UpdateAll(ctx, to))
+	require.NoError(t, st.UpdateAll(ctx, diff))
+	assert.Equal(t, Data{Counters: Counters{}, Gauges: Gauges{}}, Diff(from, st.GetAll(ctx)))
+}
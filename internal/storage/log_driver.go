@@ -0,0 +1,482 @@
+// Package storage logDriver
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// LogDriver is an embedded log-structured storage in a local directory.
+const LogDriver = "log"
+
+// Defaults of LogParams.
+const (
+	defaultLogSegmentSize     = 4 << 20
+	defaultLogCompactInterval = 60
+)
+
+// logSegmentExt is the extension of segment files: 000000000001.seg
+const logSegmentExt = ".seg"
+
+// Kinds of log records.
+const (
+	logRecordCounter byte = 1
+	logRecordGauge   byte = 2
+)
+
+// logHeaderSize is the size of a record before the name:
+// crc32 (4), kind (1), name length (2), value (8).
+const logHeaderSize = 4 + 1 + 2 + 8
+
+// ErrLogClosed is returned by a logDriver used before Open or after Close.
+var ErrLogClosed = errors.New("log storage is closed")
+
+// ErrLogNameTooLong is returned for a metric name that does not fit a log record.
+var ErrLogNameTooLong = errors.New("metric name is too long for the log storage")
+
+// LogParams is the config block of the log driver.
+type LogParams struct {
+	// SegmentSize is the size in bytes after which the next segment is started.
+	SegmentSize int64 `json:"segment_size"`
+	// CompactInterval is the period in seconds of the compaction check. 0 - no compaction.
+	CompactInterval int64 `json:"compact_interval"`
+}
+
+// logDriver keeps metrics in append-only segment files in a directory and
+// the latest value of every metric in an in-memory index.
+// Every record holds the full value: counters are written after the delta is added,
+// so the last record of a metric is its value and older ones are garbage.
+// Compaction rewrites sealed segments into one with a record per metric.
+type logDriver struct {
+	dir             string
+	segmentSize     int64
+	compactInterval time.Duration
+
+	mu       sync.RWMutex // Guards the index and the active segment
+	counters Counters
+	gauges   Gauges
+	file     *os.File // Active segment, nil if closed
+	seq      uint64   // Number of the active segment
+	size     int64    // Bytes in the active segment
+	records  int      // Records in all segments, live and garbage
+
+	compactMu sync.Mutex // Serializes compactions
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func init() {
+	Register(LogDriver, func(conf Config) (Storage, error) {
+		if conf.Path == memPath {
+			return nil, errors.New("log driver needs a storage directory")
+		}
+		params := LogParams{
+			SegmentSize:     defaultLogSegmentSize,
+			CompactInterval: defaultLogCompactInterval,
+		}
+		if err := conf.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		if params.SegmentSize <= 0 {
+			return nil, fmt.Errorf("invalid log segment size %d", params.SegmentSize)
+		}
+		return NewLogDriver(conf.Path, params), nil
+	})
+}
+
+func NewLogDriver(dir string, params LogParams) *logDriver {
+	return &logDriver{
+		dir:             dir,
+		segmentSize:     params.SegmentSize,
+		compactInterval: time.Duration(params.CompactInterval) * time.Second,
+	}
+}
+
+// Open recovers the index from the segments and starts a new active segment after them.
+// The log is the store itself, so there is nothing else to restore.
+func (d *logDriver) Open(_ context.Context) error {
+	if err := os.MkdirAll(d.dir, 0770); err != nil {
+		return err
+	}
+	if err := d.removeTemp(); err != nil {
+		return err
+	}
+	seqs, err := d.segments()
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counters, d.gauges, d.records = make(Counters), make(Gauges), 0
+	for _, seq := range seqs {
+		n, err := d.replay(seq)
+		d.records += n
+		if err != nil {
+			return fmt.Errorf("log segment %d: %w", seq, err)
+		}
+	}
+	logger.Log.Info("log storage recovered",
+		zap.Int("segments", len(seqs)), zap.Int("records", d.records),
+		zap.Int("metrics", len(d.counters)+len(d.gauges)))
+
+	d.seq = 1
+	if len(seqs) > 0 {
+		d.seq = seqs[len(seqs)-1] + 1
+	}
+	if err := d.openSegment(); err != nil {
+		return err
+	}
+
+	if d.compactInterval > 0 {
+		d.stop = make(chan struct{})
+		d.done = make(chan struct{})
+		go d.compactLoop()
+	}
+	return nil
+}
+
+// Close stops the compaction, syncs and closes the active segment.
+func (d *logDriver) Close(_ context.Context) error {
+	if d.stop != nil {
+		close(d.stop)
+		<-d.done
+		d.stop = nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return nil
+	}
+	err := errors.Join(d.file.Sync(), d.file.Close())
+	d.file = nil
+	return err
+}
+
+func (d *logDriver) Ping(_ context.Context) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.file == nil {
+		return ErrLogClosed
+	}
+	return nil
+}
+
+// Save fsyncs the records appended since the last call.
+func (d *logDriver) Save(_ context.Context) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.file == nil {
+		return ErrLogClosed
+	}
+	return d.file.Sync()
+}
+
+// Restore is a no-op: the index is recovered by Open.
+func (d *logDriver) Restore(_ context.Context) error {
+	return nil
+}
+
+func (d *logDriver) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	return d.UpdateAll(ctx, Data{Counters: Counters{mname: delta}})
+}
+
+func (d *logDriver) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	return d.UpdateAll(ctx, Data{Gauges: Gauges{mname: value}})
+}
+
+// UpdateAll appends the new values of the batch with a single write and applies them.
+// A batch that could not be written is not applied.
+func (d *logDriver) UpdateAll(_ context.Context, data Data) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return ErrLogClosed
+	}
+
+	var buf []byte
+	counters := make(Counters, len(data.Counters))
+	for name, delta := range data.Counters {
+		if len(name) > math.MaxUint16 {
+			return ErrLogNameTooLong
+		}
+		counters[name] = d.counters[name] + delta
+		buf = appendLogRecord(buf, logRecordCounter, name, uint64(counters[name]))
+	}
+	for name, value := range data.Gauges {
+		if len(name) > math.MaxUint16 {
+			return ErrLogNameTooLong
+		}
+		buf = appendLogRecord(buf, logRecordGauge, name, math.Float64bits(value))
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if d.size > 0 && d.size+int64(len(buf)) > d.segmentSize {
+		if err := d.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := d.file.Write(buf); err != nil {
+		// Cut the partial write, so later records do not follow garbage
+		return errors.Join(err, d.file.Truncate(d.size))
+	}
+	d.size += int64(len(buf))
+
+	for name, value := range counters {
+		d.counters[name] = value
+	}
+	for name, value := range data.Gauges {
+		d.gauges[name] = value
+	}
+	d.records += len(counters) + len(data.Gauges)
+	return nil
+}
+
+func (d *logDriver) GetCounter(_ context.Context, mname string) (int64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, ok := d.counters[mname]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return value, nil
+}
+
+func (d *logDriver) GetGauge(_ context.Context, mname string) (float64, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, ok := d.gauges[mname]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return value, nil
+}
+
+// GetAll returns a copy of the index. The caller owns the returned maps.
+func (d *logDriver) GetAll(_ context.Context) Data {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	data := Data{
+		Counters: make(Counters, len(d.counters)),
+		Gauges:   make(Gauges, len(d.gauges)),
+	}
+	for name, value := range d.counters {
+		data.Counters[name] = value
+	}
+	for name, value := range d.gauges {
+		data.Gauges[name] = value
+	}
+	return data
+}
+
+// appendLogRecord appends a record to buf. The checksum covers everything after it.
+func appendLogRecord(buf []byte, kind byte, name string, value uint64) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0, kind)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(name)))
+	buf = binary.LittleEndian.AppendUint64(buf, value)
+	buf = append(buf, name...)
+	binary.LittleEndian.PutUint32(buf[start:], crc32.ChecksumIEEE(buf[start+4:]))
+	return buf
+}
+
+// segmentPath returns the file of segment seq.
+func (d *logDriver) segmentPath(seq uint64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%012d%s", seq, logSegmentExt))
+}
+
+// segments returns numbers of existing segments in ascending order.
+func (d *logDriver) segments() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(d.dir, "*"+logSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, m := range matches {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(m), logSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// removeTemp removes segments of a compaction interrupted by a crash.
+func (d *logDriver) removeTemp() error {
+	matches, err := filepath.Glob(filepath.Join(d.dir, "*"+logSegmentExt+".tmp-*"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, m := range matches {
+		if err := os.Remove(m); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// replay applies records of segment seq to the index. Records after a torn
+// or corrupt one are dropped: the segment is cut there, so new records
+// are not appended after garbage.
+func (d *logDriver) replay(seq uint64) (int, error) {
+	path := d.segmentPath(seq)
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n, valid := 0, int64(0)
+	r := bufio.NewReader(file)
+	header := make([]byte, logHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			break
+		}
+		name := make([]byte, binary.LittleEndian.Uint16(header[5:7]))
+		if _, err := io.ReadFull(r, name); err != nil {
+			break
+		}
+		crc := crc32.ChecksumIEEE(header[4:])
+		crc = crc32.Update(crc, crc32.IEEETable, name)
+		if crc != binary.LittleEndian.Uint32(header[:4]) {
+			break
+		}
+
+		value := binary.LittleEndian.Uint64(header[7:])
+		switch header[4] {
+		case logRecordCounter:
+			d.counters[string(name)] = int64(value)
+		case logRecordGauge:
+			d.gauges[string(name)] = math.Float64frombits(value)
+		default:
+			return n, fmt.Errorf("unknown record kind %d at offset %d", header[4], valid)
+		}
+		valid += int64(logHeaderSize + len(name))
+		n++
+	}
+
+	// The process crashed in the middle of the append
+	logger.Log.Warn("cut torn log record", zap.String("file", path), zap.Int64("offset", valid))
+	return n, os.Truncate(path, valid)
+}
+
+func (d *logDriver) openSegment() error {
+	file, err := os.OpenFile(d.segmentPath(d.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	d.file = file
+	d.size = 0
+	return nil
+}
+
+// rotate seals the active segment and starts the next one. Callers hold mu.
+func (d *logDriver) rotate() error {
+	if err := errors.Join(d.file.Sync(), d.file.Close()); err != nil {
+		return err
+	}
+	d.seq++
+	return d.openSegment()
+}
+
+// compactLoop checks every compactInterval whether garbage outweighs live records.
+func (d *logDriver) compactLoop() {
+	defer close(d.done)
+	ticker := time.NewTicker(d.compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.mu.RLock()
+			live := len(d.counters) + len(d.gauges)
+			garbage := d.records - live
+			d.mu.RUnlock()
+			if garbage <= live {
+				continue
+			}
+			if err := d.compact(); err != nil {
+				logger.Log.Error("cannot compact log storage", zap.Error(err))
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// compact seals the active segment and replaces it and all segments before it
+// with one segment holding the current value of every metric.
+// The compacted segment takes the number of the sealed one, so a crash
+// before older segments are removed leaves them replayed first and overridden.
+func (d *logDriver) compact() error {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+
+	// Updates go to the next segment while the snapshot is written
+	d.mu.Lock()
+	if d.file == nil {
+		d.mu.Unlock()
+		return ErrLogClosed
+	}
+	if err := d.rotate(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	sealed, before := d.seq-1, d.records
+	var buf []byte
+	for name, value := range d.counters {
+		buf = appendLogRecord(buf, logRecordCounter, name, uint64(value))
+	}
+	for name, value := range d.gauges {
+		buf = appendLogRecord(buf, logRecordGauge, name, math.Float64bits(value))
+	}
+	live := len(d.counters) + len(d.gauges)
+	d.mu.Unlock()
+
+	if err := writeFileAtomic(d.segmentPath(sealed), buf, 0); err != nil {
+		return err
+	}
+	seqs, err := d.segments()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, seq := range seqs {
+		if seq >= sealed {
+			break
+		}
+		if err := os.Remove(d.segmentPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	d.mu.Lock()
+	d.records = d.records - before + live
+	d.mu.Unlock()
+	logger.Log.Info("log storage compacted", zap.Int("dropped", before-live), zap.Uint64("segment", sealed))
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openLogDriver opens a log driver without the background compaction.
+func openLogDriver(t *testing.T, dir string, segmentSize int64) *logDriver {
+	d := NewLogDriver(dir, LogParams{SegmentSize: segmentSize})
+	require.NoError(t, d.Open(context.Background()))
+	return d
+}
+
+func Test_logDriver_Recover(t *testing.T) {
+	ctx := context.Background()
+	dir := path.Join(t.TempDir(), "log")
+
+	d := openLogDriver(t, dir, defaultLogSegmentSize)
+	require.NoError(t, d.UpdateCounter(ctx, "c", 2))
+	require.NoError(t, d.UpdateAll(ctx, Data{Counters: Counters{"c": 3}, Gauges: Gauges{"g": 1.5}}))
+	require.NoError(t, d.UpdateGauge(ctx, "g", -7.25))
+	require.NoError(t, d.file.Close()) // Crash: no Save, no Close
+
+	d = openLogDriver(t, dir, defaultLogSegmentSize)
+	assert.Equal(t, Data{Counters: Counters{"c": 5}, Gauges: Gauges{"g": -7.25}}, d.GetAll(ctx))
+	assert.Equal(t, 4, d.records)
+
+	// Счетчик продолжает расти от восстановленного значения
+	require.NoError(t, d.UpdateCounter(ctx, "c", 1))
+	value, err := d.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), value)
+	_, err = d.GetGauge(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	require.NoError(t, d.Close(ctx))
+
+	assert.ErrorIs(t, d.UpdateCounter(ctx, "c", 1), ErrLogClosed)
+	assert.ErrorIs(t, d.Ping(ctx), ErrLogClosed)
+}
+
+func Test_logDriver_TornRecord(t *testing.T) {
+	ctx := context.Background()
+	dir := path.Join(t.TempDir(), "log")
+
+	d := openLogDriver(t, dir, defaultLogSegmentSize)
+	require.NoError(t, d.UpdateCounter(ctx, "c", 4))
+	require.NoError(t, d.Close(ctx))
+
+	// Запись оборвана на середине
+	torn := appendLogRecord(nil, logRecordCounter, "c", 10)
+	file, err := os.OpenFile(d.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0660)
+	require.NoError(t, err)
+	_, err = file.Write(torn[:len(torn)-1])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	d = openLogDriver(t, dir, defaultLogSegmentSize)
+	assert.Equal(t, int64(4), d.GetAll(ctx).Counters["c"])
+	info, err := os.Stat(d.segmentPath(1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(torn)), info.Size())
+	require.NoError(t, d.Close(ctx))
+}
+
+func Test_logDriver_Compact(t *testing.T) {
+	ctx := context.Background()
+	dir := path.Join(t.TempDir(), "log")
+
+	// Маленькие сегменты: каждое обновление в своем файле
+	d := openLogDriver(t, dir, 1)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, d.UpdateAll(ctx, Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": float64(i)}}))
+	}
+	segments, err := d.segments()
+	require.NoError(t, err)
+	assert.Len(t, segments, 10)
+
+	require.NoError(t, d.compact())
+	require.NoError(t, d.UpdateCounter(ctx, "c", 5))
+	segments, err = d.segments()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{10, 11}, segments)
+	assert.Equal(t, 3, d.records)
+	require.NoError(t, d.Close(ctx))
+
+	d = openLogDriver(t, dir, 1)
+	assert.Equal(t, Data{Counters: Counters{"c": 15}, Gauges: Gauges{"g": 9}}, d.GetAll(ctx))
+	require.NoError(t, d.Close(ctx))
+}
+
+func Test_logDriver_CompactCrash(t *testing.T) {
+	ctx := context.Background()
+	dir := path.Join(t.TempDir(), "log")
+
+	d := openLogDriver(t, dir, 1)
+	require.NoError(t, d.UpdateCounter(ctx, "c", 1))
+	require.NoError(t, d.UpdateCounter(ctx, "c", 2))
+	require.NoError(t, d.Close(ctx))
+
+	// Сжатый сегмент записан, старые еще не удалены, а временный файл остался
+	compacted := appendLogRecord(nil, logRecordCounter, "c", 3)
+	require.NoError(t, os.WriteFile(d.segmentPath(2), compacted, 0660))
+	require.NoError(t, os.WriteFile(d.segmentPath(3)+".tmp-1", []byte("garbage"), 0660))
+
+	d = openLogDriver(t, dir, 1)
+	assert.Equal(t, int64(3), d.GetAll(ctx).Counters["c"])
+	_, err := os.Stat(d.segmentPath(3) + ".tmp-1")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, d.Close(ctx))
+}
@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCredsURL = "host=localhost user=admin password=admin dbname=metrics sslmode=disable"
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, len(migrations), 2)
+	for i, m := range migrations {
+		assert.Equal(t, int64(i+1), m.Version, "versions must be sequential")
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+	assert.Equal(t, "create_metrics", migrations[0].Name)
+}
+
+func Test_load(t *testing.T) {
+	file := &fstest.MapFile{Data: []byte("SELECT 1;")}
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		versions []int64
+		wantErr  bool
+	}{
+		{
+			name: "ordered_by_version",
+			fsys: fstest.MapFS{
+				"sql/0010_later.up.sql":   file,
+				"sql/0010_later.down.sql": file,
+				"sql/0002_first.up.sql":   file,
+				"sql/0002_first.down.sql": file,
+			},
+			versions: []int64{2, 10},
+		},
+		{
+			name:    "missing_down",
+			fsys:    fstest.MapFS{"sql/0001_init.up.sql": file},
+			wantErr: true,
+		},
+		{
+			name: "two_names",
+			fsys: fstest.MapFS{
+				"sql/0001_init.up.sql":    file,
+				"sql/0001_other.down.sql": file,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid_name",
+			fsys:    fstest.MapFS{"sql/init.sql": file},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := load(tt.fsys, "sql")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var versions []int64
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			assert.Equal(t, tt.versions, versions)
+		})
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, testCredsURL)
+	if err != nil {
+		t.Skipf("Skipping test due to database connection error: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	// Отдельная схема, чтобы не трогать рабочие таблицы
+	for _, sql := range []string{
+		`DROP SCHEMA IF EXISTS migrator_test CASCADE`,
+		`CREATE SCHEMA migrator_test`,
+		`SET search_path TO migrator_test`,
+	} {
+		_, err := conn.Exec(ctx, sql)
+		require.NoError(t, err)
+	}
+	defer conn.Exec(ctx, `DROP SCHEMA migrator_test CASCADE`)
+
+	m, err := New(conn)
+	require.NoError(t, err)
+
+	applied, err := m.Up(ctx, 1)
+	require.NoError(t, err)
+	assert.Len(t, applied, 1)
+
+	applied, err = m.Up(ctx, 0)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(m.migrations)-1)
+
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range statuses {
+		assert.NotNil(t, s.AppliedAt, s.Name)
+	}
+
+	// Ноль не означает "все": откат всех миграций только явный
+	_, err = m.Down(ctx, 0)
+	assert.Error(t, err)
+	_, err = m.Down(ctx, -2)
+	assert.Error(t, err)
+
+	reverted, err := m.Down(ctx, All)
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(m.migrations))
+	assert.Equal(t, m.migrations[len(m.migrations)-1].Version, reverted[0].Version)
+
+	// Повторный прогон после отката
+	_, err = m.Up(ctx, 0)
+	require.NoError(t, err)
+}
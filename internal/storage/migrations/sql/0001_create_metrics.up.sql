@@ -0,0 +1,7 @@
+-- The first schema: values as TEXT, keyed by mname.
+CREATE TABLE IF NOT EXISTS metrics (
+	id SERIAL PRIMARY KEY,
+	mtype TEXT NOT NULL,
+	mname TEXT UNIQUE NOT NULL,
+	mvalue TEXT NOT NULL
+);
@@ -0,0 +1,18 @@
+-- Back to TEXT values keyed by mname. The old key cannot hold a counter
+-- and a gauge with the same name: such gauges are dropped.
+ALTER TABLE metrics DROP CONSTRAINT metrics_typed_value, DROP CONSTRAINT metrics_pkey;
+
+DELETE FROM metrics g
+WHERE g.mtype = 'gauge'
+	AND EXISTS (SELECT 1 FROM metrics c WHERE c.mtype = 'counter' AND c.mname = g.mname);
+
+ALTER TABLE metrics ADD COLUMN mvalue TEXT;
+UPDATE metrics SET mvalue = COALESCE(delta::text, value::text);
+
+ALTER TABLE metrics
+	ALTER COLUMN mvalue SET NOT NULL,
+	DROP COLUMN delta,
+	DROP COLUMN value,
+	DROP COLUMN updated_at,
+	ADD COLUMN id SERIAL PRIMARY KEY,
+	ADD CONSTRAINT metrics_mname_key UNIQUE (mname);
@@ -0,0 +1,31 @@
+-- Typed columns and the (mtype, mname) key, so a counter and a gauge
+-- with the same name no longer overwrite each other.
+-- Deployments created before migrations may already have the typed table.
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'metrics' AND column_name = 'mvalue'
+	) THEN
+		RETURN;
+	END IF;
+
+	ALTER TABLE metrics
+		ADD COLUMN delta BIGINT,
+		ADD COLUMN value DOUBLE PRECISION,
+		ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+	DELETE FROM metrics WHERE mtype NOT IN ('counter', 'gauge');
+	UPDATE metrics SET delta = mvalue::bigint WHERE mtype = 'counter';
+	UPDATE metrics SET value = mvalue::double precision WHERE mtype = 'gauge';
+
+	ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_mname_key;
+	ALTER TABLE metrics DROP COLUMN id CASCADE, DROP COLUMN mvalue;
+	ALTER TABLE metrics
+		ADD PRIMARY KEY (mtype, mname),
+		ADD CONSTRAINT metrics_typed_value CHECK (
+			(mtype = 'counter' AND delta IS NOT NULL AND value IS NULL) OR
+			(mtype = 'gauge' AND value IS NOT NULL AND delta IS NULL)
+		);
+END
+$$;
@@ -0,0 +1,87 @@
+// Package storage change notifications
+package storage
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// maxNotifyPayload keeps a change below the 8000 bytes limit of a Postgres NOTIFY payload.
+// A larger change is announced as a reload.
+const maxNotifyPayload = 7900
+
+// Change is an update of the backend made by another server sharing it.
+type Change struct {
+	// Origin identifies the server that made the change.
+	Origin string `json:"o"`
+	// Data holds counter deltas and gauge values of the change.
+	Data Data `json:"d"`
+	// Reload means changes may have been missed: all metrics are to be read again.
+	Reload bool `json:"r,omitempty"`
+}
+
+// Notifier is a storage that reports changes made by other servers sharing its backend,
+// so per-process caches in front of it do not go stale.
+type Notifier interface {
+	// OnChange registers fn to be called with every change of other servers.
+	// fn is called from one goroutine and must not block for long.
+	OnChange(fn func(Change))
+}
+
+// NotifierOf returns the notifier behind s, false if there is none.
+// Wrappers are looked through with their Unwrap method.
+func NotifierOf(s Storage) (Notifier, bool) {
+	for s != nil {
+		if n, ok := s.(Notifier); ok {
+			return n, true
+		}
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = u.Unwrap()
+	}
+	return nil, false
+}
+
+// encodeChange returns the payload of the change made by origin,
+// a reload if the change is too large for one notification.
+func encodeChange(origin string, data Data) (string, error) {
+	payload, err := json.Marshal(Change{Origin: origin, Data: data})
+	if err != nil {
+		return "", err
+	}
+	if len(payload) > maxNotifyPayload {
+		payload, err = json.Marshal(Change{Origin: origin, Reload: true})
+	}
+	return string(payload), err
+}
+
+// decodeChange parses a payload of encodeChange.
+func decodeChange(payload string) (Change, error) {
+	var change Change
+	err := json.Unmarshal([]byte(payload), &change)
+	return change, err
+}
+
+// changeSubscribers is the list of OnChange callbacks of a notifier.
+type changeSubscribers struct {
+	mu  sync.RWMutex
+	fns []func(Change)
+}
+
+// OnChange registers fn.
+func (s *changeSubscribers) OnChange(fn func(Change)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fns = append(s.fns, fn)
+}
+
+// publish calls every registered callback with the change.
+func (s *changeSubscribers) publish(change Change) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, fn := range s.fns {
+		fn(change)
+	}
+}
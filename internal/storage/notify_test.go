@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeChange(t *testing.T) {
+	data := Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": 1.5}}
+	payload, err := encodeChange("a", data)
+	require.NoError(t, err)
+	change, err := decodeChange(payload)
+	require.NoError(t, err)
+	assert.Equal(t, Change{Origin: "a", Data: data}, change)
+
+	// Не влезающее в NOTIFY изменение превращается в перезагрузку
+	large := Data{Counters: Counters{}}
+	for i := 0; i < 1000; i++ {
+		large.Counters[fmt.Sprintf("counter%d", i)] = int64(i)
+	}
+	payload, err = encodeChange("a", large)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(payload), maxNotifyPayload)
+	change, err = decodeChange(payload)
+	require.NoError(t, err)
+	assert.Equal(t, Change{Origin: "a", Reload: true}, change)
+}
+
+func TestNotifierOf(t *testing.T) {
+	_, ok := NotifierOf(NewTmpDriver(memPath))
+	assert.False(t, ok)
+
+	pgx := NewPgxDriver("", PgxParams{Notify: true})
+	n, ok := NotifierOf(WithTimeouts(pgx, Timeouts{Read: 1, Write: 1}))
+	assert.True(t, ok)
+	assert.Same(t, pgx, n)
+}
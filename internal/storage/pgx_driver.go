@@ -3,144 +3,355 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
-	"strconv"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rombintu/goyametricsv2/internal/logger"
+	"github.com/rombintu/goyametricsv2/internal/storage/migrations"
+	"github.com/rombintu/goyametricsv2/lib/common"
 	"go.uber.org/zap"
 )
 
 const (
 	pgxName = "postgres"
+
+	// defaultNotifyChannel is the default channel of change notifications.
+	defaultNotifyChannel = "metrics_changes"
 )
 
-type pgxDriver struct {
-	name  string
-	dbURL string
-	conn  *pgxpool.Pool
+// PgxParams is the config block of the pgx driver.
+type PgxParams struct {
+	// Notify announces every upsert with NOTIFY and listens to the announcements
+	// of other servers, so caches in front of the storage follow their updates.
+	Notify bool `json:"notify"`
+	// Channel of the notifications, the servers of one database use the same.
+	Channel string `json:"channel"`
 }
 
-type AnyMetrics map[string]string
+type pgxDriver struct {
+	name   string
+	dbURL  string
+	params PgxParams
+	pool   Pool
+	conn   *pgxpool.Pool
+	reads  *pgxpool.Pool // The replica if configured, conn otherwise
+	ready  atomic.Bool   // The database was reached and the schema is up to date
+
+	origin      string // Identifies the notifications of this server
+	subscribers changeSubscribers
+
+	stopBackground context.CancelFunc // Stops reconnects and listening
+	background     sync.WaitGroup
+}
 
 // Декораторы, чтобы логировать SQL
 func (d *pgxDriver) exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
-	logger.Log.Debug(sql, zap.Any("args", args))
+	logger.FromContext(ctx).Debug(sql, zap.Any("args", args))
 	return d.conn.Exec(ctx, sql, args...)
 }
 
+// Запросы на чтение идут в реплику, если она задана
 func (d *pgxDriver) queryRows(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
-	logger.Log.Debug(sql, zap.Any("args", args))
-	return d.conn.Query(ctx, sql, args...)
+	logger.FromContext(ctx).Debug(sql, zap.Any("args", args))
+	return d.reads.Query(ctx, sql, args...)
 }
 
 func (d *pgxDriver) queryRow(ctx context.Context, sql string, args ...any) pgx.Row {
-	logger.Log.Debug(sql, zap.Any("args", args))
-	return d.conn.QueryRow(ctx, sql, args...)
+	logger.FromContext(ctx).Debug(sql, zap.Any("args", args))
+	return d.reads.QueryRow(ctx, sql, args...)
+}
+
+func init() {
+	Register(PgxDriver, func(conf Config) (Storage, error) {
+		if conf.URL == "" {
+			return nil, errors.New("pgx driver needs a database URL")
+		}
+		params := PgxParams{Channel: defaultNotifyChannel}
+		if err := conf.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		d := NewPgxDriver(conf.URL, params, conf.Options...)
+		if _, err := queryExecMode(d.pool.StatementCache); err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
 }
 
-func NewPgxDriver(dbURL string) *pgxDriver {
+// NewPgxDriver creates the driver. Of the options it uses WithPool.
+func NewPgxDriver(dbURL string, params PgxParams, opts ...Option) *pgxDriver {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if params.Channel == "" {
+		params.Channel = defaultNotifyChannel
+	}
 	return &pgxDriver{
-		name:  pgxName,
-		dbURL: dbURL,
+		name:   pgxName,
+		dbURL:  dbURL,
+		params: params,
+		pool:   options.Pool,
+		origin: newOrigin(),
 	}
 }
 
-func (d *pgxDriver) Open() error {
-	pool, err := pgxpool.New(context.Background(), d.dbURL)
+// queryExecModes are the statement cache modes by their names in the pgx DSN parameter default_query_exec_mode.
+var queryExecModes = map[string]pgx.QueryExecMode{
+	"cache_statement": pgx.QueryExecModeCacheStatement,
+	"cache_describe":  pgx.QueryExecModeCacheDescribe,
+	"describe_exec":   pgx.QueryExecModeDescribeExec,
+	"exec":            pgx.QueryExecModeExec,
+	"simple_protocol": pgx.QueryExecModeSimpleProtocol,
+}
+
+// queryExecMode parses a statement cache mode, empty is the pgx default.
+func queryExecMode(name string) (pgx.QueryExecMode, error) {
+	if name == "" {
+		return pgx.QueryExecModeCacheStatement, nil
+	}
+	mode, ok := queryExecModes[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown statement cache mode %q", name)
+	}
+	return mode, nil
+}
+
+// poolConfig parses the DSN and applies the pool settings to it.
+func (d *pgxDriver) poolConfig(dbURL string) (*pgxpool.Config, error) {
+	conf, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		return nil, err
+	}
+	if d.pool.MaxConns > 0 {
+		conf.MaxConns = int32(d.pool.MaxConns)
+	}
+	if d.pool.MinConns > 0 {
+		conf.MinConns = int32(d.pool.MinConns)
+	}
+	if d.pool.MaxConnLifetime > 0 {
+		conf.MaxConnLifetime = d.pool.MaxConnLifetime
+	}
+	if d.pool.HealthCheckPeriod > 0 {
+		conf.HealthCheckPeriod = d.pool.HealthCheckPeriod
+	}
+	// An empty mode keeps default_query_exec_mode of the DSN
+	if d.pool.StatementCache != "" {
+		if conf.ConnConfig.DefaultQueryExecMode, err = queryExecMode(d.pool.StatementCache); err != nil {
+			return nil, err
+		}
+	}
+	if d.pool.ApplicationName != "" {
+		conf.ConnConfig.RuntimeParams["application_name"] = d.pool.ApplicationName
+	}
+	return conf, nil
+}
+
+// newOrigin returns a random identifier of the server in notifications.
+func newOrigin() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Open connects to the database and brings the schema up to date. If the database
+// is unreachable, the driver opens degraded: requests fail with ErrDatabaseUnavailable
+// and Ping reports it, while the driver reconnects in the background.
+func (d *pgxDriver) Open(ctx context.Context) error {
+	conf, err := d.poolConfig(d.dbURL)
+	if err != nil {
+		return err
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, conf)
 	if err != nil {
 		return err
 	}
-	d.conn = pool
+	d.conn, d.reads = pool, pool
+	if d.pool.ReplicaURL != "" {
+		if err = d.openReplica(ctx); err != nil {
+			pool.Close()
+			return err
+		}
+	}
 
-	var errConn error
-	var ok bool
-	for i := 1; i <= 5; i += 2 {
-		if errConn = d.Ping(); errConn == nil {
-			ok = true
-			break
+	bgCtx, cancel := context.WithCancel(context.Background())
+	if err = d.connect(ctx); err != nil {
+		if !isRetriable(err) {
+			cancel()
+			d.closePools()
+			return err
 		}
-		logger.Log.Debug("Try reconnect to database", zap.Int("sleep seconds", i))
-		time.Sleep(time.Duration(i) * time.Second)
+		logger.Log.Warn("Database is unavailable, starting degraded", zap.Error(err))
+		d.background.Add(1)
+		go d.reconnectLoop(bgCtx)
 	}
-	if !ok {
-		return errConn
+	d.stopBackground = cancel
+
+	if d.params.Notify {
+		d.background.Add(1)
+		go d.listenLoop(bgCtx)
 	}
+	return nil
+}
 
-	err = d.createTables()
+// openReplica creates the pool of the read-only replica. It connects lazily, like the primary pool.
+func (d *pgxDriver) openReplica(ctx context.Context) error {
+	conf, err := d.poolConfig(d.pool.ReplicaURL)
 	if err != nil {
+		return fmt.Errorf("invalid replica DSN: %w", err)
+	}
+	d.reads, err = pgxpool.NewWithConfig(ctx, conf)
+	return err
+}
+
+// closePools closes the primary and the replica pools.
+func (d *pgxDriver) closePools() {
+	if d.reads != d.conn {
+		d.reads.Close()
+	}
+	d.conn.Close()
+}
+
+// connect checks the connection and migrates the schema. The driver serves requests after it.
+func (d *pgxDriver) connect(ctx context.Context) error {
+	if err := d.conn.Ping(ctx); err != nil {
+		return err
+	}
+	if err := d.createTables(ctx); err != nil {
 		return err
 	}
+	d.ready.Store(true)
 	return nil
 }
 
-func (d *pgxDriver) Close() error {
-	d.conn.Close()
+func (d *pgxDriver) Close(_ context.Context) error {
+	if d.stopBackground != nil {
+		d.stopBackground()
+		d.background.Wait()
+		d.stopBackground = nil
+	}
+	d.closePools()
 	return nil
 }
 
-func (d *pgxDriver) Ping() error {
-	return d.conn.Ping(context.Background())
+// Ping checks the primary and, if configured, the replica serving reads.
+func (d *pgxDriver) Ping(ctx context.Context) error {
+	if !d.ready.Load() {
+		return ErrDatabaseUnavailable
+	}
+	if err := d.conn.Ping(ctx); err != nil {
+		return err
+	}
+	if d.reads != d.conn {
+		if err := d.reads.Ping(ctx); err != nil {
+			return fmt.Errorf("replica: %w", err)
+		}
+	}
+	return nil
 }
 
-func (d *pgxDriver) Save() error {
+func (d *pgxDriver) Save(_ context.Context) error {
 	return nil
 }
 
-func (d *pgxDriver) Restore() error {
+func (d *pgxDriver) Restore(_ context.Context) error {
 	return nil
 }
 
-func (d *pgxDriver) Update(mtype, mname, mval string) error {
-	var sqlScript string
-	switch mtype {
-	case CounterType:
-		sqlScript = `
-		INSERT INTO metrics (mtype, mname, mvalue) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (mname) DO 
-		UPDATE SET mvalue = (EXCLUDED.mvalue::bigint + metrics.mvalue::bigint)::text
-		`
-	case GaugeType:
-		sqlScript = `
-		INSERT INTO metrics (mtype, mname, mvalue) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (mname) DO 
-		UPDATE SET mvalue = EXCLUDED.mvalue
-		`
-	}
-	_, err := d.exec(context.Background(), sqlScript, mtype, mname, mval)
-	return err
+// Upserts of the typed columns. Counters accumulate deltas, gauges keep the last value.
+const (
+	upsertCounterSQL = `
+	INSERT INTO metrics (mtype, mname, delta)
+	VALUES ('counter', $1, $2)
+	ON CONFLICT (mtype, mname) DO
+	UPDATE SET delta = metrics.delta + EXCLUDED.delta, updated_at = now()
+	`
+	upsertGaugeSQL = `
+	INSERT INTO metrics (mtype, mname, value)
+	VALUES ('gauge', $1, $2)
+	ON CONFLICT (mtype, mname) DO
+	UPDATE SET value = EXCLUDED.value, updated_at = now()
+	`
+)
+
+func (d *pgxDriver) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	// The notification goes in the transaction of the upsert
+	if d.params.Notify {
+		return d.UpdateAll(ctx, Data{Counters: Counters{mname: delta}})
+	}
+	return d.withRetry(ctx, func() error {
+		_, err := d.exec(ctx, upsertCounterSQL, mname, delta)
+		return err
+	})
 }
 
-func (d *pgxDriver) Get(mtype, mname string) (string, error) {
-	if mtype == "" || mname == "" {
-		return "", errors.New("invalid metric type")
+func (d *pgxDriver) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	if d.params.Notify {
+		return d.UpdateAll(ctx, Data{Gauges: Gauges{mname: value}})
 	}
-	row := d.queryRow(context.Background(), `
-	SELECT mvalue FROM metrics WHERE mtype=$1 AND mname=$2
-	`, mtype, mname)
-	var mval sql.NullString
-	err := row.Scan(&mval)
-	if err != nil {
-		return "", err
+	return d.withRetry(ctx, func() error {
+		_, err := d.exec(ctx, upsertGaugeSQL, mname, value)
+		return err
+	})
+}
+
+func (d *pgxDriver) GetCounter(ctx context.Context, mname string) (int64, error) {
+	var delta sql.NullInt64
+	if err := d.getColumn(ctx, "delta", CounterType, mname, &delta); err != nil {
+		return 0, err
+	}
+	if !delta.Valid {
+		return 0, ErrNotFound
+	}
+	return delta.Int64, nil
+}
+
+func (d *pgxDriver) GetGauge(ctx context.Context, mname string) (float64, error) {
+	var value sql.NullFloat64
+	if err := d.getColumn(ctx, "value", GaugeType, mname, &value); err != nil {
+		return 0, err
+	}
+	if !value.Valid {
+		return 0, ErrNotFound
+	}
+	return value.Float64, nil
+}
+
+// getColumn scans the typed column of one metric. column is a constant of the caller.
+func (d *pgxDriver) getColumn(ctx context.Context, column, mtype, mname string, dest any) error {
+	if !d.ready.Load() {
+		return ErrDatabaseUnavailable
 	}
-	if mval.Valid {
-		return mval.String, nil
+	row := d.queryRow(ctx, `SELECT `+column+` FROM metrics WHERE mtype=$1 AND mname=$2`, mtype, mname)
+	err := row.Scan(dest)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
 	}
-	return "", errors.New("not found")
+	return err
 }
 
 // TODO: нужны тесты, не хватает времени
-func (d *pgxDriver) GetAll() Data {
+func (d *pgxDriver) GetAll(ctx context.Context) Data {
 	var data Data
-	rows, err := d.queryRows(context.Background(), `SELECT mtype, mname, mvalue FROM metrics`)
+	log := logger.FromContext(ctx)
+	if !d.ready.Load() {
+		log.Error(ErrDatabaseUnavailable.Error())
+		return data
+	}
+	rows, err := d.queryRows(ctx, `SELECT mtype, mname, delta, value FROM metrics`)
 	if err != nil {
-		logger.Log.Error(err.Error())
+		log.Error(err.Error())
 		return data
 	}
 	defer rows.Close()
@@ -148,30 +359,23 @@ func (d *pgxDriver) GetAll() Data {
 	counters := make(map[string]int64)
 	gauges := make(map[string]float64)
 	for rows.Next() {
-		var mtype, mname, mvalue string
-		if err = rows.Scan(&mtype, &mname, &mvalue); err != nil {
-			logger.Log.Error(err.Error())
+		var mtype, mname string
+		var delta sql.NullInt64
+		var value sql.NullFloat64
+		if err = rows.Scan(&mtype, &mname, &delta, &value); err != nil {
+			log.Error(err.Error())
 			return data
 		}
-		switch mtype {
-		case CounterType:
-			var value int64
-			if value, err = strconv.ParseInt(mvalue, 10, 64); err != nil {
-				logger.Log.Error(err.Error())
-				continue
-			}
-			counters[mname] = value
-		case GaugeType:
-			var value float64
-			if value, err = strconv.ParseFloat(mvalue, 64); err != nil {
-				logger.Log.Error(err.Error())
-				continue
-			}
-			gauges[mname] = value
+		switch {
+		case mtype == CounterType && delta.Valid:
+			counters[mname] = delta.Int64
+		case mtype == GaugeType && value.Valid:
+			gauges[mname] = value.Float64
 		}
 	}
 	err = rows.Err()
 	if err != nil {
+		log.Error(err.Error())
 		return data
 	}
 	data.Counters = counters
@@ -179,66 +383,187 @@ func (d *pgxDriver) GetAll() Data {
 	return data
 }
 
-func (d *pgxDriver) UpdateAll(data Data) error {
-	ctx := context.Background()
-	counters := counters2Any(data.Counters)
-	gauges := gauges2Any(data.Gauges)
-	if err := d.updateAllAny(ctx, counters, CounterType); err != nil {
+// copyThreshold is the batch size from which UpdateAll switches from pgx.Batch to COPY.
+// Below it a pipelined batch of upserts is cheaper than creating a staging table.
+const copyThreshold = 500
+
+// mergeStageSQL upserts the staged rows. For a counter row EXCLUDED.value is NULL,
+// for a gauge row metrics.delta is NULL, so one statement serves both types.
+// Rows are merged in key order: concurrent batches lock rows in the same order and do not deadlock.
+const mergeStageSQL = `
+	INSERT INTO metrics (mtype, mname, delta, value)
+	SELECT mtype, mname, delta, value FROM metrics_stage ORDER BY mtype, mname
+	ON CONFLICT (mtype, mname) DO
+	UPDATE SET delta = metrics.delta + EXCLUDED.delta, value = EXCLUDED.value, updated_at = now()
+	`
+
+// UpdateAll upserts all metrics of the batch in one transaction with a single round trip
+// for small batches (pgx.Batch) or a COPY into a staging table and one merge for large ones.
+// The transaction is repeated on transient errors, see isRetriable.
+func (d *pgxDriver) UpdateAll(ctx context.Context, data Data) error {
+	return d.withRetry(ctx, func() error {
+		return d.updateAll(ctx, data)
+	})
+}
+
+func (d *pgxDriver) updateAll(ctx context.Context, data Data) error {
+	tx, err := d.conn.Begin(ctx)
+	if err != nil {
 		return err
 	}
-	if err := d.updateAllAny(ctx, gauges, GaugeType); err != nil {
+	defer tx.Rollback(ctx)
+
+	if len(data.Counters)+len(data.Gauges) >= copyThreshold {
+		err = d.updateAllCopy(ctx, tx, data)
+	} else {
+		err = d.updateAllBatch(ctx, tx, data)
+	}
+	if err != nil {
 		return err
 	}
-	return nil
+	if d.params.Notify {
+		if err = d.notify(ctx, tx, data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
 }
 
-func (d *pgxDriver) updateAllAny(ctx context.Context, m AnyMetrics, mtype string) error {
-	tx, err := d.conn.Begin(ctx)
+// notify announces the batch to the other servers. Postgres delivers it on commit.
+func (d *pgxDriver) notify(ctx context.Context, tx pgx.Tx, data Data) error {
+	payload, err := encodeChange(d.origin, data)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `SELECT pg_notify($1, $2)`, d.params.Channel, payload)
+	return err
+}
+
+// OnChange registers fn to be called with the updates of other servers. See Notifier.
+// Without the notify param fn is never called.
+func (d *pgxDriver) OnChange(fn func(Change)) {
+	d.subscribers.OnChange(fn)
+}
 
-	var sqlScript string
-	switch mtype {
-	case CounterType:
-		sqlScript = `
-		INSERT INTO metrics (mtype, mname, mvalue) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (mname) DO 
-		UPDATE SET mvalue = (EXCLUDED.mvalue::bigint + metrics.mvalue::bigint)::text
-		`
-	case GaugeType:
-		sqlScript = `
-		INSERT INTO metrics (mtype, mname, mvalue) 
-		VALUES ($1, $2, $3) 
-		ON CONFLICT (mname) DO 
-		UPDATE SET mvalue = EXCLUDED.mvalue
-		`
-	default:
-		return errors.New("invalid metric type")
-	}
-
-	// Реализация накопления повторных ошибок
-	var errs []error
-	for mname, mvalue := range m {
-		_, err := tx.Exec(ctx, sqlScript, mtype, mname, mvalue)
+// listenLoop listens to the notifications of other servers until ctx is cancelled.
+// A dropped connection is reconnected with backoff, then a reload is published:
+// notifications sent while the connection was down are lost.
+func (d *pgxDriver) listenLoop(ctx context.Context) {
+	defer d.background.Done()
+	backoff := reconnectMinBackoff
+	for reconnect := false; ; reconnect = true {
+		connected, err := d.listen(ctx, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = reconnectMinBackoff
+		}
+		logger.Log.Warn("Listening to notifications failed, reconnecting",
+			zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+	}
+}
+
+// listen connects, listens to the channel and publishes notifications until the connection fails.
+// It reports whether the connection was established.
+func (d *pgxDriver) listen(ctx context.Context, reconnect bool) (bool, error) {
+	conf, err := d.poolConfig(d.dbURL)
+	if err != nil {
+		return false, err
+	}
+	conn, err := pgx.ConnectConfig(ctx, conf.ConnConfig)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err = conn.Exec(ctx, `LISTEN `+pgx.Identifier{d.params.Channel}.Sanitize()); err != nil {
+		return false, err
+	}
+	logger.Log.Debug("Listening to notifications", zap.String("channel", d.params.Channel))
+	// A degraded driver has no data to reload yet, reconnectLoop reloads when it has
+	if reconnect && d.ready.Load() {
+		d.subscribers.publish(Change{Reload: true})
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return true, err
+		}
+		change, err := decodeChange(n.Payload)
 		if err != nil {
-			errs = append(errs, err)
+			logger.Log.Error("invalid notification", zap.String("payload", n.Payload), zap.Error(err))
+			continue
+		}
+		if change.Origin == d.origin {
+			continue
 		}
+		d.subscribers.publish(change)
+	}
+}
+
+// updateAllBatch sends upserts of all metrics as one pipelined pgx.Batch.
+// Metrics go in order of names, so concurrent batches lock rows in the same order.
+func (d *pgxDriver) updateAllBatch(ctx context.Context, tx pgx.Tx, data Data) error {
+	batch := &pgx.Batch{}
+	for _, mname := range common.SortedKeys(data.Counters) {
+		batch.Queue(upsertCounterSQL, mname, data.Counters[mname])
+	}
+	for _, mname := range common.SortedKeys(data.Gauges) {
+		batch.Queue(upsertGaugeSQL, mname, data.Gauges[mname])
 	}
-	errs = append(errs, tx.Commit(ctx))
-	return errors.Join(errs...)
+	logger.FromContext(ctx).Debug("batch upsert", zap.Int("queries", batch.Len()))
+	return tx.SendBatch(ctx, batch).Close()
 }
 
-func (d *pgxDriver) createTables() error {
-	_, err := d.exec(context.Background(), `
-	CREATE TABLE IF NOT EXISTS metrics (
-    	id SERIAL PRIMARY KEY,
-    	mtype TEXT NOT NULL,
-    	mname TEXT UNIQUE NOT NULL,
-    	mvalue TEXT NOT NULL
-	)
-	`)
+// updateAllCopy copies all metrics into a temporary staging table and merges it into metrics.
+func (d *pgxDriver) updateAllCopy(ctx context.Context, tx pgx.Tx, data Data) error {
+	if _, err := tx.Exec(ctx, `
+	CREATE TEMP TABLE metrics_stage (
+		mtype TEXT NOT NULL,
+		mname TEXT NOT NULL,
+		delta BIGINT,
+		value DOUBLE PRECISION
+	) ON COMMIT DROP
+	`); err != nil {
+		return err
+	}
+
+	rows := make([][]any, 0, len(data.Counters)+len(data.Gauges))
+	for mname, delta := range data.Counters {
+		rows = append(rows, []any{CounterType, mname, delta, nil})
+	}
+	for mname, value := range data.Gauges {
+		rows = append(rows, []any{GaugeType, mname, nil, value})
+	}
+	logger.FromContext(ctx).Debug("copy upsert", zap.Int("rows", len(rows)))
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"metrics_stage"},
+		[]string{"mtype", "mname", "delta", "value"}, pgx.CopyFromRows(rows)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, mergeStageSQL)
+	return err
+}
+
+// createTables brings the schema to the newest embedded migration.
+func (d *pgxDriver) createTables(ctx context.Context) error {
+	conn, err := d.conn.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	migrator, err := migrations.New(conn.Conn())
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx, 0)
 	return err
 }
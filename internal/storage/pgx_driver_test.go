@@ -3,12 +3,32 @@ package storage
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/rombintu/goyametricsv2/internal/storage/migrations"
 )
 
 const testCredsURL = "host=localhost user=admin password=admin dbname=metrics sslmode=disable"
 
+// openReady opens the driver and fails if the database is unreachable:
+// Open itself succeeds then and leaves the driver reconnecting in the background.
+func openReady(db *pgxDriver) error {
+	ctx := context.Background()
+	if err := db.Open(ctx); err != nil {
+		return err
+	}
+	if err := db.Ping(ctx); err != nil {
+		db.Close(ctx)
+		return err
+	}
+	return nil
+}
+
 func Test_pgxDriver_Ping(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -21,12 +41,12 @@ func Test_pgxDriver_Ping(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			if err := db.Ping(); (err != nil) != tt.wantErr {
+			defer db.Close(context.Background())
+			if err := db.Ping(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Ping() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -45,8 +65,8 @@ func Test_pgxDriver_Open(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := db.Open(context.Background()); err != nil {
 				var netErr net.Error
 				if errors.As(err, &netErr) && netErr.Timeout() {
 					t.Skipf("Skipping test due to network timeout error: %v", err)
@@ -56,7 +76,7 @@ func Test_pgxDriver_Open(t *testing.T) {
 			} else if (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Open() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			defer db.Close()
+			defer db.Close(context.Background())
 		})
 	}
 }
@@ -73,11 +93,11 @@ func Test_pgxDriver_Close(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			if err := db.Close(); (err != nil) != tt.wantErr {
+			if err := db.Close(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Close() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -96,12 +116,12 @@ func Test_pgxDriver_Save(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			if err := db.Save(); (err != nil) != tt.wantErr {
+			defer db.Close(context.Background())
+			if err := db.Save(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Save() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -120,12 +140,12 @@ func Test_pgxDriver_Restore(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			if err := db.Restore(); (err != nil) != tt.wantErr {
+			defer db.Close(context.Background())
+			if err := db.Restore(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Restore() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -144,15 +164,15 @@ func Test_pgxDriver_GetAll(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			if got := db.GetAll(); len(got.Counters) == 0 {
+			defer db.Close(context.Background())
+			if got := db.GetAll(context.Background()); len(got.Counters) == 0 {
 				t.Errorf("pgxDriver.GetAll() = %v, want %v", got, tt.want)
 			}
-			if got := db.GetAll(); len(got.Gauges) == 0 {
+			if got := db.GetAll(context.Background()); len(got.Gauges) == 0 {
 				t.Errorf("pgxDriver.GetAll() = %v, want %v", got, tt.want)
 			}
 		})
@@ -171,12 +191,12 @@ func Test_pgxDriver_createTables(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			if err := db.createTables(); (err != nil) != tt.wantErr {
+			defer db.Close(context.Background())
+			if err := db.createTables(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.createTables() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -200,7 +220,7 @@ func TestNewPgxDriver(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := NewPgxDriver(tt.args.dbURL)
+			got := NewPgxDriver(tt.args.dbURL, PgxParams{})
 			if got.name != pgxName {
 				t.Error("error create new driver pgx")
 			}
@@ -228,12 +248,12 @@ func Test_pgxDriver_Get(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			defer db.Close()
-			_, err := db.Get(tt.args.mtype, tt.args.mname)
+			defer db.Close(context.Background())
+			_, err := GetString(context.Background(), db, tt.args.mtype, tt.args.mname)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Get() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -241,36 +261,76 @@ func Test_pgxDriver_Get(t *testing.T) {
 	}
 }
 
-func Test_pgxDriver_updateAllAny(t *testing.T) {
-	mtrs := make(AnyMetrics)
-	mtrs["c1"] = "1"
-	type args struct {
-		ctx   context.Context
-		m     AnyMetrics
-		mtype string
+func Test_pgxDriver_SameNameDifferentTypes(t *testing.T) {
+	db := NewPgxDriver(testCredsURL, PgxParams{})
+	if err := openReady(db); err != nil {
+		t.Skipf("Skipping test due to database connection error: %v", err)
 	}
-	tests := []struct {
-		name    string
-		args    args
-		wantErr bool
-	}{
-		{
-			name:    "update_all_any",
-			args:    args{ctx: context.TODO(), m: mtrs, mtype: CounterType},
-			wantErr: false,
-		},
+	defer db.Close(context.Background())
+
+	// Счетчик и gauge с одним именем не перезаписывают друг друга
+	if err := db.UpdateAll(context.Background(), Data{Counters: Counters{"same": 1}, Gauges: Gauges{"same": 0.5}}); err != nil {
+		t.Fatalf("pgxDriver.UpdateAll() error = %v", err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
-				t.Skipf("Skipping test due to database connection error: %v", err)
-			}
-			defer db.Close()
-			if err := db.updateAllAny(tt.args.ctx, tt.args.m, tt.args.mtype); (err != nil) != tt.wantErr {
-				t.Errorf("pgxDriver.updateAllAny() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
+	if err := db.UpdateGauge(context.Background(), "same", 1.5); err != nil {
+		t.Fatalf("pgxDriver.UpdateGauge() error = %v", err)
+	}
+	if got, err := db.GetGauge(context.Background(), "same"); err != nil || got != 1.5 {
+		t.Errorf("pgxDriver.GetGauge() = %v, %v, want 1.5", got, err)
+	}
+	if _, err := db.GetCounter(context.Background(), "same"); err != nil {
+		t.Errorf("pgxDriver.GetCounter() error = %v", err)
+	}
+	if err := UpdateString(context.Background(), db, CounterType, "same", "1.5"); err == nil {
+		t.Error("pgxDriver.Update() expected error for a fractional counter")
+	}
+}
+
+func Test_pgxDriver_migrateLegacyTable(t *testing.T) {
+	db := NewPgxDriver(testCredsURL, PgxParams{})
+	if err := openReady(db); err != nil {
+		t.Skipf("Skipping test due to database connection error: %v", err)
+	}
+	defer db.Close(context.Background())
+
+	// Старая схема в отдельной схеме БД, чтобы не трогать рабочую таблицу
+	ctx := context.Background()
+	conn, err := db.conn.Acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Release()
+	for _, sql := range []string{
+		`DROP SCHEMA IF EXISTS migrate_test CASCADE`,
+		`CREATE SCHEMA migrate_test`,
+		`SET search_path TO migrate_test`,
+		`CREATE TABLE metrics (id SERIAL PRIMARY KEY, mtype TEXT NOT NULL, mname TEXT UNIQUE NOT NULL, mvalue TEXT NOT NULL)`,
+		`INSERT INTO metrics (mtype, mname, mvalue) VALUES ('counter', 'c', '42'), ('gauge', 'g', '1.25')`,
+	} {
+		if _, err := conn.Exec(ctx, sql); err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+	}
+	defer conn.Exec(ctx, `DROP SCHEMA migrate_test CASCADE; SET search_path TO DEFAULT`)
+
+	migrator, err := migrations.New(conn.Conn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrator.Up(ctx, 0); err != nil {
+		t.Fatalf("Migrator.Up() error = %v", err)
+	}
+
+	var delta int64
+	var value float64
+	if err := conn.QueryRow(ctx, `SELECT delta FROM metrics WHERE mtype='counter' AND mname='c'`).Scan(&delta); err != nil || delta != 42 {
+		t.Errorf("migrated counter = %v, %v, want 42", delta, err)
+	}
+	if err := conn.QueryRow(ctx, `SELECT value FROM metrics WHERE mtype='gauge' AND mname='g'`).Scan(&value); err != nil || value != 1.25 {
+		t.Errorf("migrated gauge = %v, %v, want 1.25", value, err)
+	}
+	if _, err := conn.Exec(ctx, `INSERT INTO metrics (mtype, mname, value) VALUES ('gauge', 'c', 1)`); err != nil {
+		t.Errorf("gauge with the name of a counter: %v", err)
 	}
 }
 
@@ -298,11 +358,11 @@ func Test_pgxDriver_UpdateAll(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			if err := db.UpdateAll(tt.args.data); (err != nil) != tt.wantErr {
+			if err := db.UpdateAll(context.Background(), tt.args.data); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.UpdateAll() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -331,13 +391,196 @@ func Test_pgxDriver_Update(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := NewPgxDriver(testCredsURL)
-			if err := db.Open(); err != nil {
+			db := NewPgxDriver(testCredsURL, PgxParams{})
+			if err := openReady(db); err != nil {
 				t.Skipf("Skipping test due to database connection error: %v", err)
 			}
-			if err := db.Update(tt.args.mtype, tt.args.mname, tt.args.mval); (err != nil) != tt.wantErr {
+			if err := UpdateString(context.Background(), db, tt.args.mtype, tt.args.mname, tt.args.mval); (err != nil) != tt.wantErr {
 				t.Errorf("pgxDriver.Update() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func Test_pgxDriver_UpdateAllCopy(t *testing.T) {
+	db := NewPgxDriver(testCredsURL, PgxParams{})
+	if err := openReady(db); err != nil {
+		t.Skipf("Skipping test due to database connection error: %v", err)
+	}
+	defer db.Close(context.Background())
+
+	// Пакет больше порога идет через COPY
+	data := pgxBenchData(copyThreshold)
+	before := db.GetAll(context.Background())
+	if err := db.UpdateAll(context.Background(), data); err != nil {
+		t.Fatalf("pgxDriver.UpdateAll() error = %v", err)
+	}
+	after := db.GetAll(context.Background())
+	for mname, delta := range data.Counters {
+		if after.Counters[mname] != before.Counters[mname]+delta {
+			t.Fatalf("counter %s = %d, want %d", mname, after.Counters[mname], before.Counters[mname]+delta)
+		}
+	}
+	for mname, value := range data.Gauges {
+		if after.Gauges[mname] != value {
+			t.Fatalf("gauge %s = %v, want %v", mname, after.Gauges[mname], value)
+		}
+	}
+}
+
+func Test_pgxDriver_Notify(t *testing.T) {
+	ctx := context.Background()
+	first := NewPgxDriver(testCredsURL, PgxParams{Notify: true})
+	if err := openReady(first); err != nil {
+		t.Skipf("Skipping test due to database connection error: %v", err)
+	}
+	defer first.Close(ctx)
+	second := NewPgxDriver(testCredsURL, PgxParams{Notify: true})
+	changes := make(chan Change, 1)
+	second.OnChange(func(change Change) {
+		select {
+		case changes <- change:
+		default:
+		}
+	})
+	if err := second.Open(ctx); err != nil {
+		t.Fatalf("pgxDriver.Open() error = %v", err)
+	}
+	defer second.Close(ctx)
+
+	// Второй сервер узнает об обновлениях первого, но не о своих
+	if err := second.UpdateCounter(ctx, "NotifyCounter", 1); err != nil {
+		t.Fatalf("pgxDriver.UpdateCounter() error = %v", err)
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := first.UpdateGauge(ctx, "NotifyGauge", 1); err != nil {
+			t.Fatalf("pgxDriver.UpdateGauge() error = %v", err)
+		}
+		select {
+		case change := <-changes:
+			want := Change{Origin: first.origin, Data: Data{Gauges: Gauges{"NotifyGauge": 1}}}
+			if !reflect.DeepEqual(change, want) {
+				t.Fatalf("change = %+v, want %+v", change, want)
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+			// LISTEN may not be issued yet
+		case <-deadline:
+			t.Fatal("no notification of the other server")
+		}
+	}
+}
+
+// pgxBenchData returns a batch of n metrics, half counters and half gauges.
+func pgxBenchData(n int) Data {
+	data := Data{Counters: make(Counters), Gauges: make(Gauges)}
+	for i := 0; i < n/2; i++ {
+		data.Counters[fmt.Sprintf("BenchCounter%d", i)] = 1
+		data.Gauges[fmt.Sprintf("BenchGauge%d", i)] = float64(i)
+	}
+	return data
+}
+
+// updateAllPerRow is the previous implementation: one Exec per metric.
+// It is kept as the baseline for BenchmarkPgxUpdateAll.
+func (d *pgxDriver) updateAllPerRow(ctx context.Context, tx pgx.Tx, data Data) error {
+	for mname, delta := range data.Counters {
+		if _, err := tx.Exec(ctx, upsertCounterSQL, mname, delta); err != nil {
+			return err
+		}
+	}
+	for mname, value := range data.Gauges {
+		if _, err := tx.Exec(ctx, upsertGaugeSQL, mname, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BenchmarkPgxUpdateAll compares write strategies on a local Postgres:
+// a typical agent report (30 metrics) and a large import-like batch.
+// Run with: go test -run=^$ -bench=PgxUpdateAll ./internal/storage
+func BenchmarkPgxUpdateAll(b *testing.B) {
+	db := NewPgxDriver(testCredsURL, PgxParams{})
+	if err := openReady(db); err != nil {
+		b.Skipf("Skipping benchmark due to database connection error: %v", err)
+	}
+	defer db.Close(context.Background())
+
+	strategies := []struct {
+		name   string
+		update func(context.Context, pgx.Tx, Data) error
+	}{
+		{name: "per_row", update: db.updateAllPerRow},
+		{name: "batch", update: db.updateAllBatch},
+		{name: "copy", update: db.updateAllCopy},
+	}
+	for _, size := range []int{30, 2000} {
+		data := pgxBenchData(size)
+		for _, s := range strategies {
+			b.Run(fmt.Sprintf("%s/%d", s.name, size), func(b *testing.B) {
+				ctx := context.Background()
+				for i := 0; i < b.N; i++ {
+					tx, err := db.conn.Begin(ctx)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := s.update(ctx, tx, data); err != nil {
+						tx.Rollback(ctx)
+						b.Fatal(err)
+					}
+					if err := tx.Commit(ctx); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "metrics/s")
+			})
+		}
+	}
+}
+
+func Test_pgxDriver_poolConfig(t *testing.T) {
+	db := NewPgxDriver(testCredsURL, PgxParams{}, WithPool(Pool{
+		MaxConns:          8,
+		MinConns:          2,
+		MaxConnLifetime:   time.Minute,
+		HealthCheckPeriod: 10 * time.Second,
+		StatementCache:    "simple_protocol",
+		ApplicationName:   "metrics-server",
+	}))
+	conf, err := db.poolConfig(testCredsURL)
+	if err != nil {
+		t.Fatalf("pgxDriver.poolConfig() error = %v", err)
+	}
+	if conf.MaxConns != 8 || conf.MinConns != 2 || conf.MaxConnLifetime != time.Minute || conf.HealthCheckPeriod != 10*time.Second {
+		t.Errorf("pool settings are not applied: %+v", conf)
+	}
+	if conf.ConnConfig.DefaultQueryExecMode != pgx.QueryExecModeSimpleProtocol {
+		t.Errorf("exec mode = %v, want simple_protocol", conf.ConnConfig.DefaultQueryExecMode)
+	}
+	if got := conf.ConnConfig.RuntimeParams["application_name"]; got != "metrics-server" {
+		t.Errorf("application_name = %q", got)
+	}
+
+	// Неизвестный режим кэша запросов отклоняется при создании драйвера
+	_, err = New(PgxDriver, Config{URL: testCredsURL, Options: []Option{WithPool(Pool{StatementCache: "cache_all"})}})
+	if err == nil {
+		t.Error("New() accepted unknown statement cache mode")
+	}
+}
+
+func Test_pgxDriver_Replica(t *testing.T) {
+	ctx := context.Background()
+	db := NewPgxDriver(testCredsURL, PgxParams{}, WithPool(Pool{ReplicaURL: "host=127.0.0.1 port=1 user=admin dbname=metrics sslmode=disable connect_timeout=1"}))
+	if err := db.Open(ctx); err != nil {
+		t.Fatalf("pgxDriver.Open() error = %v", err)
+	}
+	defer db.Close(ctx)
+	if db.reads == db.conn {
+		t.Fatal("reads do not go to the replica")
+	}
+	if db.Ping(ctx) == nil {
+		t.Error("Ping() succeeded with an unreachable replica")
+	}
+}
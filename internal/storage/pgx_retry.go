@@ -0,0 +1,105 @@
+// Package storage pgxDriver retries
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// ErrDatabaseUnavailable is returned while the pgx driver has not reached the database yet.
+var ErrDatabaseUnavailable = errors.New("database is unavailable, reconnecting")
+
+const (
+	// Retries of a failed write
+	retryAttempts   = 4
+	retryMinBackoff = 50 * time.Millisecond
+
+	// Backoff of reconnects of a degraded driver and of the listening connection
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// SQLSTATE codes of transient errors: the statement was not applied and may succeed if repeated.
+const (
+	sqlStateConnectionClass      = "08" // connection_exception and its subclasses
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+	sqlStateTooManyConnections   = "53300"
+	sqlStateAdminShutdown        = "57P01"
+	sqlStateCrashShutdown        = "57P02"
+	sqlStateCannotConnectNow     = "57P03"
+)
+
+// isRetriable reports whether err is transient and the failed write was surely not applied,
+// so repeating it does not add a counter delta twice. A connection lost after the query
+// was sent is not retriable: the server may have committed it.
+func isRetriable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case sqlStateSerializationFailure, sqlStateDeadlockDetected, sqlStateTooManyConnections,
+			sqlStateAdminShutdown, sqlStateCrashShutdown, sqlStateCannotConnectNow:
+			return true
+		}
+		return strings.HasPrefix(pgErr.Code, sqlStateConnectionClass)
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &connectErr) || pgconn.SafeToRetry(err)
+}
+
+// withRetry runs the write fn and repeats it with backoff while it fails with a retriable error.
+// The last error is returned when the attempts are exhausted or ctx is done.
+func (d *pgxDriver) withRetry(ctx context.Context, fn func() error) error {
+	if !d.ready.Load() {
+		return ErrDatabaseUnavailable
+	}
+	backoff := retryMinBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || !isRetriable(err) {
+			return err
+		}
+		logger.FromContext(ctx).Warn("Retrying database write",
+			zap.Int("attempt", attempt), zap.Duration("backoff", backoff), zap.Error(err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// reconnectLoop connects a driver opened without the database until it succeeds or ctx is done.
+// Caches in front of the driver are told to reload: they were loaded while it had no data.
+func (d *pgxDriver) reconnectLoop(ctx context.Context) {
+	defer d.background.Done()
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		err := d.connect(ctx)
+		if err == nil {
+			logger.Log.Info("Database is available")
+			d.subscribers.publish(Change{Reload: true})
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		backoff = min(backoff*2, reconnectMaxBackoff)
+		logger.Log.Warn("Database is unavailable", zap.Duration("backoff", backoff), zap.Error(err))
+	}
+}
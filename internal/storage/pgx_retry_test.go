@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetriable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "serialization_failure", err: &pgconn.PgError{Code: sqlStateSerializationFailure}, want: true},
+		{name: "deadlock", err: fmt.Errorf("upsert: %w", &pgconn.PgError{Code: sqlStateDeadlockDetected}), want: true},
+		{name: "connection_failure", err: &pgconn.PgError{Code: "08006"}, want: true},
+		{name: "admin_shutdown", err: &pgconn.PgError{Code: sqlStateAdminShutdown}, want: true},
+		{name: "unique_violation", err: &pgconn.PgError{Code: "23505"}, want: false},
+		{name: "dial_failure", err: &pgconn.ConnectError{Config: &pgconn.Config{}}, want: true},
+		{name: "connection_lost_after_send", err: io.ErrUnexpectedEOF, want: false},
+		{name: "deadline", err: context.DeadlineExceeded, want: false},
+		{name: "not_found", err: ErrNotFound, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRetriable(tt.err))
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	ctx := context.Background()
+	d := NewPgxDriver("", PgxParams{})
+	assert.ErrorIs(t, d.withRetry(ctx, func() error { return nil }), ErrDatabaseUnavailable)
+	d.ready.Store(true)
+
+	// Транзиентная ошибка повторяется, пока попытки не кончатся
+	calls := 0
+	deadlock := &pgconn.PgError{Code: sqlStateDeadlockDetected}
+	err := d.withRetry(ctx, func() error {
+		calls++
+		return deadlock
+	})
+	assert.ErrorIs(t, err, deadlock)
+	assert.Equal(t, retryAttempts, calls)
+
+	calls = 0
+	err = d.withRetry(ctx, func() error {
+		calls++
+		if calls < 2 {
+			return deadlock
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// Остальные ошибки возвращаются сразу
+	calls = 0
+	err = d.withRetry(ctx, func() error {
+		calls++
+		return errors.New("syntax error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestPgxDegraded(t *testing.T) {
+	ctx := context.Background()
+	// Никто не слушает порт: сервер стартует без базы и переподключается в фоне
+	d := NewPgxDriver("host=127.0.0.1 port=1 user=admin dbname=metrics sslmode=disable connect_timeout=1", PgxParams{Notify: true})
+	require.NoError(t, d.Open(ctx))
+	defer d.Close(ctx)
+
+	assert.ErrorIs(t, d.Ping(ctx), ErrDatabaseUnavailable)
+	assert.ErrorIs(t, d.UpdateCounter(ctx, "c", 1), ErrDatabaseUnavailable)
+	_, err := d.GetCounter(ctx, "c")
+	assert.ErrorIs(t, err, ErrDatabaseUnavailable)
+	assert.Equal(t, Data{}, d.GetAll(ctx))
+
+	// Неверный DSN не лечится переподключением
+	assert.Error(t, NewPgxDriver("postgres://%zz", PgxParams{}).Open(ctx))
+}
@@ -0,0 +1,175 @@
+// Package storage redisDriver
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// RedisDriver is a storage in Redis shared by any number of stateless servers.
+const RedisDriver = "redis"
+
+// defaultRedisPrefix is the default prefix of the Redis keys.
+const defaultRedisPrefix = "metrics"
+
+// RedisParams is the config block of the redis driver.
+type RedisParams struct {
+	// Prefix of the keys, so several stores can share one Redis database.
+	Prefix string `json:"prefix"`
+}
+
+// redisDriver keeps counters and gauges in two Redis hashes: prefix:counters and prefix:gauges.
+// Counters grow with HINCRBY, so concurrent servers never lose a delta.
+type redisDriver struct {
+	url         string
+	countersKey string
+	gaugesKey   string
+	client      *redis.Client
+}
+
+func init() {
+	Register(RedisDriver, func(conf Config) (Storage, error) {
+		if conf.URL == "" {
+			return nil, errors.New("redis driver needs a redis URL")
+		}
+		params := RedisParams{Prefix: defaultRedisPrefix}
+		if err := conf.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		return NewRedisDriver(conf.URL, params), nil
+	})
+}
+
+func NewRedisDriver(url string, params RedisParams) *redisDriver {
+	return &redisDriver{
+		url:         url,
+		countersKey: params.Prefix + ":counters",
+		gaugesKey:   params.Prefix + ":gauges",
+	}
+}
+
+// Open connects to the redis://[user:password@]host:port/db URL and checks the connection.
+func (d *redisDriver) Open(ctx context.Context) error {
+	opts, err := redis.ParseURL(d.url)
+	if err != nil {
+		return err
+	}
+	d.client = redis.NewClient(opts)
+	if err := d.Ping(ctx); err != nil {
+		err = errors.Join(err, d.client.Close())
+		d.client = nil
+		return err
+	}
+	return nil
+}
+
+func (d *redisDriver) Close(_ context.Context) error {
+	if d.client == nil {
+		return nil
+	}
+	return d.client.Close()
+}
+
+func (d *redisDriver) Ping(ctx context.Context) error {
+	return d.client.Ping(ctx).Err()
+}
+
+func (d *redisDriver) Save(_ context.Context) error {
+	return nil
+}
+
+func (d *redisDriver) Restore(_ context.Context) error {
+	return nil
+}
+
+func (d *redisDriver) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	return d.client.HIncrBy(ctx, d.countersKey, mname, delta).Err()
+}
+
+func (d *redisDriver) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	return d.client.HSet(ctx, d.gaugesKey, mname, formatGauge(value)).Err()
+}
+
+// UpdateAll sends all updates of the batch as one MULTI/EXEC pipeline:
+// a single round trip, and other servers see the whole batch or nothing.
+func (d *redisDriver) UpdateAll(ctx context.Context, data Data) error {
+	if len(data.Counters)+len(data.Gauges) == 0 {
+		return nil
+	}
+	_, err := d.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for mname, delta := range data.Counters {
+			pipe.HIncrBy(ctx, d.countersKey, mname, delta)
+		}
+		if len(data.Gauges) > 0 {
+			values := make(map[string]any, len(data.Gauges))
+			for mname, value := range data.Gauges {
+				values[mname] = formatGauge(value)
+			}
+			pipe.HSet(ctx, d.gaugesKey, values)
+		}
+		return nil
+	})
+	return err
+}
+
+func (d *redisDriver) GetCounter(ctx context.Context, mname string) (int64, error) {
+	delta, err := d.client.HGet(ctx, d.countersKey, mname).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotFound
+	}
+	return delta, err
+}
+
+func (d *redisDriver) GetGauge(ctx context.Context, mname string) (float64, error) {
+	value, err := d.client.HGet(ctx, d.gaugesKey, mname).Float64()
+	if errors.Is(err, redis.Nil) {
+		return 0, ErrNotFound
+	}
+	return value, err
+}
+
+// GetAll reads both hashes in one pipeline. Values that do not parse are skipped.
+func (d *redisDriver) GetAll(ctx context.Context) Data {
+	var data Data
+	log := logger.FromContext(ctx)
+	var counters, gauges *redis.MapStringStringCmd
+	_, err := d.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		counters = pipe.HGetAll(ctx, d.countersKey)
+		gauges = pipe.HGetAll(ctx, d.gaugesKey)
+		return nil
+	})
+	if err != nil {
+		log.Error(err.Error())
+		return data
+	}
+
+	data.Counters = make(Counters, len(counters.Val()))
+	for mname, s := range counters.Val() {
+		delta, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			log.Error("invalid counter in redis", zap.String("name", mname), zap.Error(err))
+			continue
+		}
+		data.Counters[mname] = delta
+	}
+	data.Gauges = make(Gauges, len(gauges.Val()))
+	for mname, s := range gauges.Val() {
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.Error("invalid gauge in redis", zap.String("name", mname), zap.Error(err))
+			continue
+		}
+		data.Gauges[mname] = value
+	}
+	return data
+}
+
+// formatGauge formats the gauge in the shortest form that parses back to the same float.
+func formatGauge(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openRedisDriver opens a redis driver on an in-process Redis.
+func openRedisDriver(t *testing.T, mr *miniredis.Miniredis) *redisDriver {
+	d := NewRedisDriver("redis://"+mr.Addr()+"/0", RedisParams{Prefix: "test"})
+	require.NoError(t, d.Open(context.Background()))
+	t.Cleanup(func() { d.Close(context.Background()) })
+	return d
+}
+
+func Test_redisDriver(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	d := openRedisDriver(t, mr)
+
+	require.NoError(t, d.UpdateCounter(ctx, "c", 2))
+	require.NoError(t, d.UpdateGauge(ctx, "g", 0.1))
+	require.NoError(t, d.UpdateAll(ctx, Data{
+		Counters: Counters{"c": 3, "c2": -1},
+		Gauges:   Gauges{"g": 1e-9, "g2": 42},
+	}))
+	require.NoError(t, d.UpdateAll(ctx, Data{}))
+
+	delta, err := d.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), delta)
+	value, err := d.GetGauge(ctx, "g")
+	require.NoError(t, err)
+	assert.Equal(t, 1e-9, value)
+
+	_, err = d.GetCounter(ctx, "unknown")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = d.GetGauge(ctx, "c")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.Equal(t, Data{
+		Counters: Counters{"c": 5, "c2": -1},
+		Gauges:   Gauges{"g": 1e-9, "g2": 42},
+	}, d.GetAll(ctx))
+	assert.Equal(t, "5", mr.HGet("test:counters", "c"))
+	assert.Equal(t, "42", mr.HGet("test:gauges", "g2"))
+}
+
+func Test_redisDriver_SharedState(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+
+	// Два сервера без состояния видят одни и те же метрики
+	first, second := openRedisDriver(t, mr), openRedisDriver(t, mr)
+	require.NoError(t, first.UpdateCounter(ctx, "c", 1))
+	require.NoError(t, second.UpdateCounter(ctx, "c", 1))
+	delta, err := first.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), delta)
+}
+
+func Test_redisDriver_Unavailable(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	d := openRedisDriver(t, mr)
+	url := "redis://" + mr.Addr()
+
+	mr.Close()
+	assert.Error(t, d.Ping(ctx))
+	assert.Error(t, d.UpdateAll(ctx, Data{Counters: Counters{"c": 1}}))
+	assert.Equal(t, Data{}, d.GetAll(ctx))
+
+	assert.Error(t, NewRedisDriver(url, RedisParams{}).Open(ctx))
+	assert.Error(t, NewRedisDriver("postgres://localhost", RedisParams{}).Open(ctx))
+}
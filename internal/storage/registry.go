@@ -0,0 +1,88 @@
+// Package storage driver registry
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownDriver is returned by New for a driver name nobody registered.
+var ErrUnknownDriver = errors.New("unknown storage driver")
+
+// Config is what a driver factory gets to create the driver.
+type Config struct {
+	// Path is the store file of file-based drivers.
+	Path string
+	// URL is the address of database drivers.
+	URL string
+	// Params is the driver's own JSON config block, empty if there is none.
+	Params json.RawMessage
+	// Options are the settings shared by drivers, e.g. WithWAL or WithBackups.
+	Options []Option
+}
+
+// DecodeParams decodes the driver's config block into v. Unknown fields are
+// an error, so a typo in the block is not silently ignored. Without a block v is left as is.
+func (c Config) DecodeParams(v any) error {
+	if len(bytes.TrimSpace(c.Params)) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(c.Params))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid storage params: %w", err)
+	}
+	return nil
+}
+
+// Factory creates a driver from its config. The driver is opened later by Storage.Open.
+type Factory func(conf Config) (Storage, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Factory)
+)
+
+// Register makes a driver available by name. Drivers in other packages call it from init,
+// the server then selects them by name like the built-in ones.
+// It panics if the name is taken or the factory is nil, like database/sql.Register.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil for driver " + name)
+	}
+	if _, dup := drivers[name]; dup {
+		panic("storage: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the sorted names of the registered drivers.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the storage of the registered driver name.
+// An unknown name is an error, never a fallback to another driver.
+func New(name string, conf Config) (Storage, error) {
+	driversMu.RLock()
+	factory, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, registered: %s", ErrUnknownDriver, name, strings.Join(Drivers(), ", "))
+	}
+	return factory(conf)
+}
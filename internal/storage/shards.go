@@ -0,0 +1,186 @@
+// Package storage shardedMap
+package storage
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// shardsCount is the number of parts of a shardedMap with their own insert lock.
+// Power of two, so the shard index is a cheap mask.
+const shardsCount = 32
+
+// number is a metric value kept in a shardedMap.
+type number interface {
+	int64 | float64
+}
+
+// codec stores values of type V in atomic 64-bit cells.
+type codec[V number] struct {
+	enc func(V) uint64
+	dec func(uint64) V
+	add func(*atomic.Uint64, V)
+}
+
+// counterCodec keeps int64 as two's complement, so Add is a single atomic add.
+var counterCodec = codec[int64]{
+	enc: func(v int64) uint64 { return uint64(v) },
+	dec: func(u uint64) int64 { return int64(u) },
+	add: func(c *atomic.Uint64, delta int64) { c.Add(uint64(delta)) },
+}
+
+// gaugeCodec keeps float64 as IEEE 754 bits.
+var gaugeCodec = codec[float64]{
+	enc: math.Float64bits,
+	dec: math.Float64frombits,
+	add: func(c *atomic.Uint64, delta float64) {
+		for {
+			old := c.Load()
+			if c.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+				return
+			}
+		}
+	},
+}
+
+// shard is a part of a shardedMap. Its map is copy-on-write: readers load it
+// atomically without locks, the mutex only serializes adding new keys.
+// Values are atomic cells, so updates of existing keys need no lock at all.
+type shard struct {
+	mu sync.Mutex
+	m  atomic.Pointer[map[string]*atomic.Uint64]
+}
+
+func newShard() *shard {
+	s := &shard{}
+	s.store(make(map[string]*atomic.Uint64))
+	return s
+}
+
+func (s *shard) load() map[string]*atomic.Uint64 {
+	return *s.m.Load()
+}
+
+func (s *shard) store(m map[string]*atomic.Uint64) {
+	s.m.Store(&m)
+}
+
+// cell returns the cell of key, adding a zero cell if needed.
+func (s *shard) cell(key string) *atomic.Uint64 {
+	if c, ok := s.load()[key]; ok {
+		return c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.load()
+	if c, ok := old[key]; ok {
+		return c
+	}
+	m := make(map[string]*atomic.Uint64, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	c := &atomic.Uint64{}
+	m[key] = c
+	s.store(m)
+	return c
+}
+
+// shardedMap is a concurrency-safe map split into shards by key hash.
+// Metric names are a small, rarely growing set, so copying a shard on insert
+// is cheap, while reads and updates of existing metrics are lock-free.
+type shardedMap[V number] struct {
+	shards [shardsCount]*shard
+	codec  codec[V]
+}
+
+func newShardedMap[V number](c codec[V]) *shardedMap[V] {
+	sm := &shardedMap[V]{codec: c}
+	for i := range sm.shards {
+		sm.shards[i] = newShard()
+	}
+	return sm
+}
+
+func newCounters() *shardedMap[int64] {
+	return newShardedMap(counterCodec)
+}
+
+func newGauges() *shardedMap[float64] {
+	return newShardedMap(gaugeCodec)
+}
+
+// shardIndex returns the shard of key (FNV-1a hash).
+func shardIndex(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h & (shardsCount - 1)
+}
+
+// Get returns the value of key and whether it exists.
+func (sm *shardedMap[V]) Get(key string) (V, bool) {
+	c, ok := sm.shards[shardIndex(key)].load()[key]
+	if !ok {
+		return 0, false
+	}
+	return sm.codec.dec(c.Load()), true
+}
+
+// Set overwrites the value of key.
+func (sm *shardedMap[V]) Set(key string, value V) {
+	sm.shards[shardIndex(key)].cell(key).Store(sm.codec.enc(value))
+}
+
+// Add adds delta to the value of key. A missing key starts from zero.
+func (sm *shardedMap[V]) Add(key string, delta V) {
+	sm.codec.add(sm.shards[shardIndex(key)].cell(key), delta)
+}
+
+// SetAll overwrites all values from src.
+func (sm *shardedMap[V]) SetAll(src map[string]V) {
+	for k, v := range src {
+		sm.Set(k, v)
+	}
+}
+
+// AddAll adds all deltas from src.
+func (sm *shardedMap[V]) AddAll(src map[string]V) {
+	for k, v := range src {
+		sm.Add(k, v)
+	}
+}
+
+// Snapshot returns a copy of all values. Later updates do not change it.
+func (sm *shardedMap[V]) Snapshot() map[string]V {
+	out := make(map[string]V)
+	for _, s := range sm.shards {
+		for k, c := range s.load() {
+			out[k] = sm.codec.dec(c.Load())
+		}
+	}
+	return out
+}
+
+// Reset replaces all values with src. A nil src clears the map.
+func (sm *shardedMap[V]) Reset(src map[string]V) {
+	for _, s := range sm.shards {
+		s.mu.Lock()
+		s.store(make(map[string]*atomic.Uint64))
+		s.mu.Unlock()
+	}
+	sm.SetAll(src)
+}
+
+// Len returns the number of keys.
+func (sm *shardedMap[V]) Len() int {
+	n := 0
+	for _, s := range sm.shards {
+		n += len(s.load())
+	}
+	return n
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_shardedMap(t *testing.T) {
+	sm := newCounters()
+
+	sm.Set("a", 1)
+	sm.Add("a", 2)
+	sm.Add("b", 5)
+	sm.AddAll(map[string]int64{"a": 10, "c": 1})
+
+	v, ok := sm.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(13), v)
+	_, ok = sm.Get("unknown")
+	assert.False(t, ok)
+	assert.Equal(t, 3, sm.Len())
+
+	// Snapshot не меняется при последующих обновлениях
+	snap := sm.Snapshot()
+	sm.Add("a", 100)
+	assert.Equal(t, map[string]int64{"a": 13, "b": 5, "c": 1}, snap)
+
+	sm.Reset(map[string]int64{"x": 1})
+	assert.Equal(t, map[string]int64{"x": 1}, sm.Snapshot())
+	sm.Reset(nil)
+	assert.Equal(t, 0, sm.Len())
+}
+
+func Test_tmpDriver_Concurrent(t *testing.T) {
+	d := NewTmpDriver(path.Join(t.TempDir(), "store.json"))
+	const workers, iterations = 16, 200
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				d.UpdateAll(context.Background(), Data{
+					Counters: Counters{"PollCount": 1},
+					Gauges:   Gauges{fmt.Sprintf("g%d", w): float64(i)},
+				})
+				d.UpdateCounter(context.Background(), "single", 1)
+				// Читатели и синхронизация работают одновременно с писателями
+				all := d.GetAll(context.Background())
+				all.Counters["PollCount"] = -1
+				if i%50 == 0 {
+					assert.NoError(t, d.Save(context.Background()))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	all := d.GetAll(context.Background())
+	assert.Equal(t, int64(workers*iterations), all.Counters["PollCount"])
+	assert.Equal(t, int64(workers*iterations), all.Counters["single"])
+	assert.Len(t, all.Gauges, workers)
+}
+
+// batch is a typical agent report: runtime gauges plus PollCount.
+func benchBatch() Data {
+	data := Data{Counters: Counters{"PollCount": 1}, Gauges: make(Gauges)}
+	for i := 0; i < 30; i++ {
+		data.Gauges[fmt.Sprintf("Gauge%d", i)] = float64(i)
+	}
+	return data
+}
+
+// singleLockDriver is the previous layout made race-free with one global lock.
+// It is kept as the baseline for BenchmarkUpdateAll.
+type singleLockDriver struct {
+	mu   sync.RWMutex
+	data Data
+}
+
+func (d *singleLockDriver) UpdateAll(_ context.Context, data Data) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for k, v := range data.Counters {
+		d.data.Counters[k] += v
+	}
+	for k, v := range data.Gauges {
+		d.data.Gauges[k] = v
+	}
+	return nil
+}
+
+func (d *singleLockDriver) GetAll(_ context.Context) Data {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	out := Data{Counters: make(Counters), Gauges: make(Gauges)}
+	for k, v := range d.data.Counters {
+		out.Counters[k] = v
+	}
+	for k, v := range d.data.Gauges {
+		out.Gauges[k] = v
+	}
+	return out
+}
+
+// BenchmarkUpdateAll compares /updates/-like batches from parallel agents,
+// with a reader taking snapshots now and then.
+// Run with: go test -race -bench=UpdateAll ./internal/storage
+func BenchmarkUpdateAll(b *testing.B) {
+	drivers := map[string]interface {
+		UpdateAll(context.Context, Data) error
+		GetAll(context.Context) Data
+	}{
+		"single_lock": &singleLockDriver{data: Data{Counters: make(Counters), Gauges: make(Gauges)}},
+		"sharded":     NewTmpDriver(memPath),
+	}
+	for _, name := range []string{"single_lock", "sharded"} {
+		d := drivers[name]
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				batch := benchBatch()
+				i := 0
+				for pb.Next() {
+					d.UpdateAll(context.Background(), batch)
+					if i++; i%100 == 0 {
+						d.GetAll(context.Background())
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	d := NewTmpDriver(memPath)
+	d.UpdateAll(context.Background(), benchBatch())
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d.GetGauge(context.Background(), "Gauge1")
+		}
+	})
+}
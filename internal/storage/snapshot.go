@@ -0,0 +1,370 @@
+// Package storage snapshot
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rombintu/goyametricsv2/lib/mycrypt"
+)
+
+// Versions of the store file format.
+const (
+	// snapshotLegacy is plain JSON Data without a header.
+	snapshotLegacy = 0
+	// snapshotChecked is a header line with a checksum and an indented JSON body.
+	snapshotChecked = 1
+	// snapshotEnvelope adds optional compression and encryption of a compact JSON payload.
+	snapshotEnvelope = 2
+
+	snapshotVersion = snapshotEnvelope
+)
+
+// Compression algorithms of the store file.
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// encryptionAESGCM is the only supported encryption of the store file.
+const encryptionAESGCM = "aes-256-gcm"
+
+// ErrSnapshotKey is returned when an encrypted store file cannot be opened with the configured key.
+var ErrSnapshotKey = errors.New("cannot decrypt snapshot: missing or wrong key")
+
+// snapshot is the content of the store file: all metrics and the last WAL segment
+// included in them.
+type snapshot struct {
+	Data
+	WALSeq uint64 `json:"wal_seq,omitempty"`
+}
+
+// snapshotHeader is the first line of the store file. The checksum covers
+// the payload after the line as it is stored: compressed and encrypted.
+// Files without the header are plain Data written by old versions.
+type snapshotHeader struct {
+	Version     int    `json:"version"`
+	SHA256      string `json:"sha256"`
+	Compression string `json:"compression,omitempty"`
+	Encryption  string `json:"encryption,omitempty"`
+	Salt        []byte `json:"salt,omitempty"` // Salt of the key of an encrypted file
+}
+
+// aad returns the header without the checksum. AES-GCM authenticates it
+// with the payload, so the header of an encrypted file cannot be swapped.
+func (h snapshotHeader) aad() ([]byte, error) {
+	h.SHA256 = ""
+	return json.Marshal(h)
+}
+
+// snapshotCodec writes store files with the configured compression and encryption
+// and reads files of any version, so old files are migrated on the next save.
+// The WAL seals its records with the same keys.
+type snapshotCodec struct {
+	compression string
+	secret      []byte      // nil - no encryption
+	salt        []byte      // Salt of the key of written files and records
+	aead        cipher.AEAD // Key of salt
+
+	mu   sync.Mutex
+	keys map[string]cipher.AEAD // Keys of other salts met in read files
+}
+
+// newSnapshotCodec checks the compression and derives the AES-GCM key
+// from the secret with a new random salt. An empty secret disables encryption.
+func newSnapshotCodec(compression string, secret []byte) (*snapshotCodec, error) {
+	sc := &snapshotCodec{compression: compression}
+	switch compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return sc, fmt.Errorf("unknown snapshot compression %q", compression)
+	}
+	if len(secret) == 0 {
+		return sc, nil
+	}
+	salt, err := mycrypt.NewSalt()
+	if err != nil {
+		return sc, err
+	}
+	aead, err := newAEAD(secret, salt)
+	if err != nil {
+		return sc, err
+	}
+	sc.secret, sc.salt, sc.aead = secret, salt, aead
+	sc.keys = map[string]cipher.AEAD{string(salt): aead}
+	return sc, nil
+}
+
+func newAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := mycrypt.SymmetricKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadOf returns the key of the salt, deriving it once per salt.
+func (sc *snapshotCodec) aeadOf(salt []byte) (cipher.AEAD, error) {
+	if sc.secret == nil || len(salt) == 0 {
+		return nil, ErrSnapshotKey
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if aead, ok := sc.keys[string(salt)]; ok {
+		return aead, nil
+	}
+	aead, err := newAEAD(sc.secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	sc.keys[string(salt)] = aead
+	return aead, nil
+}
+
+// seal encrypts plain with the key of the codec's salt: a random nonce and the ciphertext.
+func (sc *snapshotCodec) seal(plain, aad []byte) ([]byte, error) {
+	nonce := make([]byte, sc.aead.NonceSize(), sc.aead.NonceSize()+len(plain)+sc.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return sc.aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+// unseal decrypts the output of seal with the key of the salt.
+// A missing or wrong key gives ErrSnapshotKey.
+func (sc *snapshotCodec) unseal(salt, sealed, aad []byte) ([]byte, error) {
+	aead, err := sc.aeadOf(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrSnapshotKey
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrSnapshotKey
+	}
+	return plain, nil
+}
+
+// encode returns the store file content: the header line and the payload.
+func (sc *snapshotCodec) encode(snap snapshot) ([]byte, error) {
+	payload, err := json.Marshal(snap)
+	if err != nil {
+		return nil, err
+	}
+	header := snapshotHeader{Version: snapshotVersion, Compression: sc.compression}
+	if payload, err = compress(sc.compression, payload); err != nil {
+		return nil, err
+	}
+	if sc.aead != nil {
+		header.Encryption = encryptionAESGCM
+		header.Salt = sc.salt
+		aad, err := header.aad()
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = sc.seal(payload, aad); err != nil {
+			return nil, err
+		}
+	}
+
+	sum := sha256.Sum256(payload)
+	header.SHA256 = hex.EncodeToString(sum[:])
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(line)+1+len(payload))
+	out = append(out, line...)
+	out = append(out, '\n')
+	return append(out, payload...), nil
+}
+
+// decode parses the store file content of any version and verifies its checksum.
+// It also returns the version of the file.
+func (sc *snapshotCodec) decode(content []byte) (snapshot, int, error) {
+	var snap snapshot
+	if len(bytes.TrimSpace(content)) == 0 {
+		return snap, snapshotLegacy, errors.New("file is empty")
+	}
+
+	var header snapshotHeader
+	line, payload, ok := bytes.Cut(content, []byte("\n"))
+	if !ok || json.Unmarshal(line, &header) != nil || header.Version == snapshotLegacy {
+		err := json.Unmarshal(content, &snap)
+		return snap, snapshotLegacy, err
+	}
+	if header.Version > snapshotVersion {
+		return snap, header.Version, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != header.SHA256 {
+		return snap, header.Version, errors.New("snapshot checksum mismatch")
+	}
+
+	if header.Version == snapshotEnvelope {
+		var err error
+		if payload, err = sc.open(header, payload); err != nil {
+			return snap, header.Version, err
+		}
+		if payload, err = decompress(header.Compression, payload); err != nil {
+			return snap, header.Version, err
+		}
+	}
+	err := json.Unmarshal(payload, &snap)
+	return snap, header.Version, err
+}
+
+// open decrypts the payload if the file is encrypted.
+func (sc *snapshotCodec) open(header snapshotHeader, payload []byte) ([]byte, error) {
+	switch header.Encryption {
+	case "":
+		return payload, nil
+	case encryptionAESGCM:
+	default:
+		return nil, fmt.Errorf("unknown snapshot encryption %q", header.Encryption)
+	}
+	aad, err := header.aad()
+	if err != nil {
+		return nil, err
+	}
+	return sc.unseal(header.Salt, payload, aad)
+}
+
+func compress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer zw.Close()
+		return zw.EncodeAll(data, nil), nil
+	case CompressionNone:
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+}
+
+func decompress(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return zr.DecodeAll(data, nil)
+	case CompressionNone:
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown snapshot compression %q", compression)
+}
+
+// backupPath returns the n-th backup of the store file: store.json.1 is the newest.
+func backupPath(storepath string, n int) string {
+	return storepath + "." + strconv.Itoa(n)
+}
+
+// writeFileAtomic replaces path with content so that a crash leaves either
+// the old or the new file: the content is written to a temp file in the same
+// directory, fsynced and renamed over path. The replaced file becomes backup 1,
+// older backups shift up to the given number.
+func writeFileAtomic(path string, content []byte, backups int) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op after the rename
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0660); err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		if err := rotateBackups(path, backups); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// rotateBackups shifts store.json.N-1 to store.json.N, ..., store.json to store.json.1.
+func rotateBackups(path string, backups int) error {
+	for n := backups - 1; n >= 0; n-- {
+		from := path
+		if n > 0 {
+			from = backupPath(path, n)
+		}
+		if err := os.Rename(from, backupPath(path, n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir makes renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_snapshotCodec(t *testing.T) {
+	key := []byte("passphrase")
+	otherKey := []byte("other passphrase")
+	snap := snapshot{Data: Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": 2}}, WALSeq: 3}
+
+	tests := []struct {
+		name        string
+		compression string
+		key         []byte
+	}{
+		{name: "plain"},
+		{name: "gzip", compression: CompressionGzip},
+		{name: "zstd", compression: CompressionZstd},
+		{name: "encrypted", key: key},
+		{name: "zstd_encrypted", compression: CompressionZstd, key: key},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := newSnapshotCodec(tt.compression, tt.key)
+			require.NoError(t, err)
+			content, err := sc.encode(snap)
+			require.NoError(t, err)
+			if tt.key != nil {
+				assert.NotContains(t, string(content), "counters")
+			}
+
+			got, version, err := sc.decode(content)
+			require.NoError(t, err)
+			assert.Equal(t, snapshotVersion, version)
+			assert.Equal(t, snap, got)
+
+			// Другой codec читает файл по его заголовку, без ключа не расшифровывает
+			reader, err := newSnapshotCodec(CompressionNone, nil)
+			require.NoError(t, err)
+			_, _, err = reader.decode(content)
+			if tt.key != nil {
+				assert.ErrorIs(t, err, ErrSnapshotKey)
+				wrong, err := newSnapshotCodec(CompressionNone, otherKey)
+				require.NoError(t, err)
+				_, _, err = wrong.decode(content)
+				assert.ErrorIs(t, err, ErrSnapshotKey)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	_, err := newSnapshotCodec("lz4", nil)
+	assert.Error(t, err)
+}
+
+func Test_snapshotCodec_header(t *testing.T) {
+	sc, err := newSnapshotCodec(CompressionNone, []byte("passphrase"))
+	require.NoError(t, err)
+	content, err := sc.encode(snapshot{Data: Data{Counters: Counters{"c": 1}}})
+	require.NoError(t, err)
+
+	// Заголовок защищен шифром: подмена сжатия с верной контрольной суммой отклоняется
+	line, payload, _ := strings.Cut(string(content), "\n")
+	var header snapshotHeader
+	require.NoError(t, json.Unmarshal([]byte(line), &header))
+	header.Compression = CompressionGzip
+	swapped, err := json.Marshal(header)
+	require.NoError(t, err)
+	_, _, err = sc.decode(append(append(swapped, '\n'), payload...))
+	assert.ErrorIs(t, err, ErrSnapshotKey)
+
+	// Другой процесс с тем же секретом выводит ключ по соли из заголовка
+	reader, err := newSnapshotCodec(CompressionNone, []byte("passphrase"))
+	require.NoError(t, err)
+	assert.NotEqual(t, sc.salt, reader.salt)
+	got, _, err := reader.decode(content)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), got.Counters["c"])
+}
+
+func Test_snapshotCodec_decode(t *testing.T) {
+	sc, err := newSnapshotCodec(CompressionGzip, nil)
+	require.NoError(t, err)
+	valid, err := sc.encode(snapshot{Data: Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": 2}}, WALSeq: 3})
+	require.NoError(t, err)
+
+	corrupt := append([]byte{}, valid...)
+	corrupt[len(corrupt)-3] ^= 0xff
+
+	// Файл версии 1: заголовок с контрольной суммой и JSON с отступами
+	checkedBody := "{\n\t\"counters\": {\"c\": 2},\n\t\"gauges\": {},\n\t\"wal_seq\": 4\n}"
+	checkedSum := sha256.Sum256([]byte(checkedBody))
+	checked := `{"version":1,"sha256":"` + hex.EncodeToString(checkedSum[:]) + "\"}\n" + checkedBody
+
+	tests := []struct {
+		name        string
+		content     string
+		want        snapshot
+		wantVersion int
+		wantErr     bool
+	}{
+		{
+			name:        "envelope",
+			content:     string(valid),
+			want:        snapshot{Data: Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": 2}}, WALSeq: 3},
+			wantVersion: snapshotEnvelope,
+		},
+		{
+			name:        "checked",
+			content:     checked,
+			want:        snapshot{Data: Data{Counters: Counters{"c": 2}, Gauges: Gauges{}}, WALSeq: 4},
+			wantVersion: snapshotChecked,
+		},
+		{
+			// Файл предыдущих версий без заголовка
+			name:        "legacy_indented",
+			content:     "{\n\t\"counters\": {\"c\": 5},\n\t\"gauges\": {}\n}",
+			want:        snapshot{Data: Data{Counters: Counters{"c": 5}, Gauges: Gauges{}}},
+			wantVersion: snapshotLegacy,
+		},
+		{
+			name:        "legacy_compact",
+			content:     `{"counters":{"c":5},"gauges":null}`,
+			want:        snapshot{Data: Data{Counters: Counters{"c": 5}}},
+			wantVersion: snapshotLegacy,
+		},
+		{name: "corrupt", content: string(corrupt), wantErr: true},
+		{name: "truncated", content: string(valid[:len(valid)-10]), wantErr: true},
+		{name: "empty", content: "", wantErr: true},
+		{name: "future_version", content: "{\"version\":99,\"sha256\":\"\"}\n{}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, version, err := sc.decode([]byte(tt.content))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantVersion, version)
+		})
+	}
+}
+
+func Test_writeFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	file := path.Join(dir, "store.json")
+
+	for _, content := range []string{"1", "2", "3", "4"} {
+		require.NoError(t, writeFileAtomic(file, []byte(content), 2))
+	}
+
+	for p, want := range map[string]string{file: "4", backupPath(file, 1): "3", backupPath(file, 2): "2"} {
+		got, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(got), p)
+	}
+	// Старше двух копий и временных файлов не остается
+	matches, err := filepath.Glob(path.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Len(t, matches, 3)
+}
+
+func Test_tmpDriver_RestoreFromBackup(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+
+	d := NewTmpDriver(storepath, WithBackups(2), WithWAL(0))
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 1))
+	require.NoError(t, d.Save(context.Background()))
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 2))
+	require.NoError(t, d.Save(context.Background()))
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 4))
+	require.NoError(t, d.Close(context.Background()))
+
+	// Падение на середине записи основного файла
+	content, err := os.ReadFile(storepath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(storepath, content[:len(content)-10], 0660))
+
+	// Резервная копия плюс журнал после нее дают все обновления
+	d = NewTmpDriver(storepath, WithBackups(2), WithWAL(0))
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, int64(7), d.GetAll(context.Background()).Counters["c"])
+	require.NoError(t, d.Close(context.Background()))
+
+	// Без журнала и копий: пустое хранилище
+	require.NoError(t, os.WriteFile(storepath, []byte("garbage"), 0660))
+	d = NewTmpDriver(storepath)
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, 0, len(d.GetAll(context.Background()).Counters))
+}
+
+func Test_tmpDriver_RestoreFromOldestBackup(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+	open := func() *tmpDriver {
+		d := NewTmpDriver(storepath, WithBackups(2), WithWAL(0))
+		require.NoError(t, d.Open(context.Background()))
+		return d
+	}
+
+	d := open()
+	require.NoError(t, d.Restore(context.Background()))
+	for _, delta := range []int64{1, 2, 4, 8} {
+		require.NoError(t, d.UpdateCounter(context.Background(), "c", delta))
+		require.NoError(t, d.Save(context.Background()))
+	}
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 16))
+	require.NoError(t, d.Close(context.Background()))
+
+	// Основной файл и новая копия повреждены: старшая копия плюс журнал дают все обновления
+	for _, p := range []string{storepath, backupPath(storepath, 1)} {
+		require.NoError(t, os.WriteFile(p, []byte("garbage"), 0660))
+	}
+	d = open()
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, int64(31), d.GetAll(context.Background()).Counters["c"])
+	require.NoError(t, d.Close(context.Background()))
+
+	// Журнал после копии удален: восстановление не теряет обновления молча
+	segments, err := d.wal.segments()
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(d.wal.segmentPath(segments[0])))
+	d = open()
+	assert.ErrorIs(t, d.Restore(context.Background()), ErrWALGap)
+	assert.ErrorIs(t, d.Save(context.Background()), ErrWALGap)
+	require.NoError(t, d.Close(context.Background()))
+}
+
+func Test_tmpDriver_MigrateEncrypted(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+	key := []byte("passphrase")
+
+	// Файл в старом формате json.MarshalIndent
+	legacy := "{\n\t\"counters\": {\"c\": 5},\n\t\"gauges\": {\"g\": 1}\n}"
+	require.NoError(t, os.WriteFile(storepath, []byte(legacy), 0660))
+
+	d := NewTmpDriver(storepath, WithCompression(CompressionZstd), WithEncryption(key))
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, Data{Counters: Counters{"c": 5}, Gauges: Gauges{"g": 1}}, d.GetAll(context.Background()))
+	require.NoError(t, d.Save(context.Background()))
+
+	content, err := os.ReadFile(storepath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"encryption":"aes-256-gcm"`)
+
+	// Без ключа зашифрованный файл не считается пустым хранилищем
+	d = NewTmpDriver(storepath)
+	assert.ErrorIs(t, d.Restore(context.Background()), ErrSnapshotKey)
+
+	d = NewTmpDriver(storepath, WithEncryption(key))
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, int64(5), d.GetAll(context.Background()).Counters["c"])
+
+	assert.Error(t, NewTmpDriver(storepath, WithCompression("lz4")).Open(context.Background()))
+}
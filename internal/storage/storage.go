@@ -1,13 +1,18 @@
 // Package storage Storage
 package storage
 
+import (
+	"context"
+	"time"
+)
+
 // Constants defining the types of metrics supported by the system.
 const (
 	GaugeType   = "gauge"   // Represents a gauge metric type.
 	CounterType = "counter" // Represents a counter metric type.
 )
 
-// Constants defining the types of storage drivers supported by the system.
+// Names of the built-in storage drivers. Other drivers are added with Register.
 const (
 	// MemDriver is a simple in-memory storage.
 	MemDriver = "mem"
@@ -22,54 +27,115 @@ const (
 // memPath is the default path for in-memory storage.
 const memPath string = ""
 
+// Options are optional settings of storage drivers. Drivers ignore options they do not support.
+type Options struct {
+	// WAL enables the write-ahead log of the file driver.
+	WAL bool
+	// WALSyncInterval is the period of fsync of the log. 0 - fsync on every append.
+	WALSyncInterval time.Duration
+	// Backups is the number of previous store files kept by the file driver.
+	Backups int
+	// Compression of the file driver's store file: CompressionNone, CompressionGzip or CompressionZstd.
+	Compression string
+	// EncryptionSecret is the passphrase or key material of the file driver's encryption:
+	// the store file and WAL records are sealed with AES-GCM keys derived from it. Empty - no encryption.
+	EncryptionSecret []byte
+	// Pool configures the connections of the pgx driver.
+	Pool Pool
+}
+
+// Pool configures the connection pool of the pgx driver. Zero values keep the pgx defaults.
+type Pool struct {
+	MaxConns          int
+	MinConns          int
+	MaxConnLifetime   time.Duration
+	HealthCheckPeriod time.Duration
+	// StatementCache is the query exec mode: cache_statement, cache_describe,
+	// describe_exec, exec or simple_protocol (e.g. behind PgBouncer in transaction mode).
+	StatementCache string
+	// ApplicationName is shown in pg_stat_activity.
+	ApplicationName string
+	// ReplicaURL is a read-only replica serving GetCounter, GetGauge and GetAll.
+	// Its reads may lag behind the updates. Empty - reads go to the primary.
+	ReplicaURL string
+}
+
+// Option changes Options.
+type Option func(*Options)
+
+// WithWAL makes the file driver append every accepted update to a write-ahead log
+// fsynced every syncInterval (0 - on every append).
+func WithWAL(syncInterval time.Duration) Option {
+	return func(o *Options) {
+		o.WAL = true
+		o.WALSyncInterval = syncInterval
+	}
+}
+
+// WithBackups makes the file driver keep n previous store files
+// to restore from if the newest one is corrupt.
+func WithBackups(n int) Option {
+	return func(o *Options) {
+		o.Backups = n
+	}
+}
+
+// WithCompression makes the file driver compress the store file.
+func WithCompression(compression string) Option {
+	return func(o *Options) {
+		o.Compression = compression
+	}
+}
+
+// WithEncryption makes the file driver encrypt the store file and the WAL
+// with keys derived from the secret and a random salt.
+func WithEncryption(secret []byte) Option {
+	return func(o *Options) {
+		o.EncryptionSecret = secret
+	}
+}
+
+// WithPool configures the connection pool of the pgx driver.
+func WithPool(pool Pool) Option {
+	return func(o *Options) {
+		o.Pool = pool
+	}
+}
+
 // Storage is an interface that defines the methods required for a storage implementation.
+// Every method takes a context: drivers stop waiting for the backend when it is done,
+// e.g. when the client disconnects or an operation timeout expires.
 type Storage interface {
-	// Update updates a metric of the specified type and name with the given value.
-	Update(mtype, mname, mval string) error
+	// UpdateCounter adds delta to the counter mname.
+	UpdateCounter(ctx context.Context, mname string, delta int64) error
+
+	// UpdateGauge sets the gauge mname to value.
+	UpdateGauge(ctx context.Context, mname string, value float64) error
+
+	// GetCounter retrieves the counter mname, ErrNotFound if there is none.
+	GetCounter(ctx context.Context, mname string) (int64, error)
 
-	// Get retrieves the value of a metric of the specified type and name.
-	Get(mtype, mname string) (string, error)
+	// GetGauge retrieves the gauge mname, ErrNotFound if there is none.
+	GetGauge(ctx context.Context, mname string) (float64, error)
 
 	// UpdateAll updates all metrics in the provided Data struct.
-	UpdateAll(Data) error
+	UpdateAll(ctx context.Context, data Data) error
 
 	// GetAll retrieves all metrics stored in the storage.
-	GetAll() Data
+	GetAll(ctx context.Context) Data
 
 	// Save persists the current state of the storage to a persistent medium.
-	Save() error
+	Save(ctx context.Context) error
 
 	// Restore loads the state of the storage from a persistent medium.
-	Restore() error
+	Restore(ctx context.Context) error
 
 	// Open initializes the storage, typically by opening connections or files.
-	Open() error
+	Open(ctx context.Context) error
 
 	// Close gracefully shuts down the storage, typically by closing connections or files.
-	Close() error
+	Close(ctx context.Context) error
 
 	// Ping checks the health of the storage, typically by testing connections.
-	Ping() error
-}
-
-// NewStorage creates a new instance of the Storage interface based on the provided storage type and path.
-// It initializes the appropriate storage driver based on the storageType parameter.
-//
-// Parameters:
-// - storageType: The type of storage driver to use (e.g., "mem", "file", "pgx").
-// - storepath: The path or connection string for the storage (e.g., file path, database URL).
-//
-// Returns:
-// - An instance of the Storage interface.
-func NewStorage(storageType string, storepath string) Storage {
-	var storage Storage
-	switch storageType {
-	case PgxDriver:
-		storage = NewPgxDriver(storepath)
-	case FileDriver:
-		storage = NewTmpDriver(storepath)
-	default:
-		storage = NewTmpDriver(memPath)
-	}
-	return storage
+	Ping(ctx context.Context) error
 }
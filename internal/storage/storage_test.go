@@ -2,48 +2,76 @@
 package storage
 
 import (
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
-func TestNewStorage(t *testing.T) {
-	type args struct {
-		storageType string
-		storepath   string
-	}
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
 	tests := []struct {
-		name string
-		args args
-		want Storage
+		name    string
+		driver  string
+		conf    Config
+		want    Storage
+		wantErr bool
 	}{
-		{
-			name: "new_storage_mem",
-			args: args{
-				storageType: "mem",
-				storepath:   "",
-			},
-			want: &tmpDriver{},
-		},
-		{
-			name: "new_storage_pgx",
-			args: args{
-				storageType: "pgx",
-				storepath:   "",
-			},
-			want: &pgxDriver{},
-		},
+		{name: "new_storage_mem", driver: MemDriver, want: &tmpDriver{}},
+		{name: "new_storage_file", driver: FileDriver, conf: Config{Path: filepath.Join(dir, "test.json")}, want: &tmpDriver{}},
+		{name: "new_storage_log", driver: LogDriver, conf: Config{Path: filepath.Join(dir, "test_log")}, want: &logDriver{}},
+		{name: "new_storage_pgx", driver: PgxDriver, conf: Config{URL: "postgres://localhost"}, want: &pgxDriver{}},
+		{name: "new_storage_redis", driver: RedisDriver, conf: Config{URL: "redis://localhost:6379/0"}, want: &redisDriver{}},
+		{name: "file_without_path", driver: FileDriver, wantErr: true},
+		{name: "pgx_without_url", driver: PgxDriver, wantErr: true},
+		{name: "redis_without_url", driver: RedisDriver, wantErr: true},
+		// Неизвестный драйвер - ошибка, а не хранилище в памяти
+		{name: "unknown", driver: "mongo", wantErr: true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := NewStorage(tt.args.storageType, tt.args.storepath)
-			switch got.(type) {
-			case *pgxDriver:
-				t.Log("pgxdriver init")
-			case *tmpDriver:
-				t.Log("tmpdriver init")
-			default:
-				t.Error("driver unknown")
+			got, err := New(tt.driver, tt.conf)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
 			}
-
+			require.NoError(t, err)
+			assert.IsType(t, tt.want, got)
 		})
 	}
+
+	_, err := New("mongo", Config{})
+	assert.ErrorIs(t, err, ErrUnknownDriver)
+	assert.ErrorContains(t, err, "file, log, mem, pgx, redis")
+}
+
+func TestRegister(t *testing.T) {
+	type params struct {
+		Size int `json:"size"`
+	}
+	var got params
+	Register("test_params", func(conf Config) (Storage, error) {
+		if err := conf.DecodeParams(&got); err != nil {
+			return nil, err
+		}
+		return NewTmpDriver(memPath), nil
+	})
+	defer func() {
+		driversMu.Lock()
+		delete(drivers, "test_params")
+		driversMu.Unlock()
+	}()
+
+	assert.Contains(t, Drivers(), "test_params")
+	_, err := New("test_params", Config{Params: []byte(`{"size": 3}`)})
+	require.NoError(t, err)
+	assert.Equal(t, 3, got.Size)
+
+	// Опечатка в параметрах не игнорируется
+	_, err = New("test_params", Config{Params: []byte(`{"sise": 3}`)})
+	assert.Error(t, err)
+
+	assert.Panics(t, func() { Register(MemDriver, func(Config) (Storage, error) { return nil, nil }) })
+	assert.Panics(t, func() { Register("nil_factory", nil) })
 }
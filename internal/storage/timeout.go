@@ -0,0 +1,89 @@
+// Package storage timeoutStorage
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts limit storage operations. A zero timeout leaves the caller's context as is.
+type Timeouts struct {
+	Read  time.Duration // GetCounter, GetGauge, GetAll, Ping
+	Write time.Duration // UpdateCounter, UpdateGauge, UpdateAll, Save
+}
+
+// timeoutStorage bounds every call of the wrapped storage with its operation timeout,
+// so a hung backend releases the handler instead of blocking it forever.
+// Open, Restore and Close run at startup and shutdown and keep the caller's context.
+type timeoutStorage struct {
+	Storage
+	timeouts Timeouts
+}
+
+// WithTimeouts wraps the storage with per-operation timeouts.
+func WithTimeouts(s Storage, timeouts Timeouts) Storage {
+	if timeouts.Read <= 0 && timeouts.Write <= 0 {
+		return s
+	}
+	return &timeoutStorage{Storage: s, timeouts: timeouts}
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+func (s *timeoutStorage) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.UpdateCounter(ctx, mname, delta)
+}
+
+func (s *timeoutStorage) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.UpdateGauge(ctx, mname, value)
+}
+
+func (s *timeoutStorage) GetCounter(ctx context.Context, mname string) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.GetCounter(ctx, mname)
+}
+
+func (s *timeoutStorage) GetGauge(ctx context.Context, mname string) (float64, error) {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.GetGauge(ctx, mname)
+}
+
+func (s *timeoutStorage) UpdateAll(ctx context.Context, data Data) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.UpdateAll(ctx, data)
+}
+
+func (s *timeoutStorage) GetAll(ctx context.Context) Data {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.GetAll(ctx)
+}
+
+func (s *timeoutStorage) Save(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Write)
+	defer cancel()
+	return s.Storage.Save(ctx)
+}
+
+func (s *timeoutStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.timeouts.Read)
+	defer cancel()
+	return s.Storage.Ping(ctx)
+}
+
+// Unwrap returns the wrapped storage.
+func (s *timeoutStorage) Unwrap() Storage {
+	return s.Storage
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hangingStorage blocks every call until the context is done, like a stuck database.
+type hangingStorage struct {
+	Storage
+}
+
+func (s *hangingStorage) GetCounter(ctx context.Context, _ string) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *hangingStorage) UpdateAll(ctx context.Context, _ Data) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestWithTimeouts(t *testing.T) {
+	st := WithTimeouts(&hangingStorage{}, Timeouts{Read: 10 * time.Millisecond, Write: 20 * time.Millisecond})
+
+	start := time.Now()
+	_, err := st.GetCounter(context.Background(), "c")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	err = st.UpdateAll(context.Background(), Data{})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Отмена запроса клиентом прерывает операцию раньше таймаута
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = WithTimeouts(&hangingStorage{}, Timeouts{Read: time.Hour}).GetCounter(ctx, "c")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// Без таймаутов хранилище не оборачивается
+	d := NewTmpDriver(memPath)
+	assert.Same(t, Storage(d), WithTimeouts(d, Timeouts{}))
+}
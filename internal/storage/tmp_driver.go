@@ -2,15 +2,13 @@
 package storage
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"io"
+	"fmt"
 	"os"
-
-	"strconv"
+	"sync"
 
 	"github.com/rombintu/goyametricsv2/internal/logger"
-	"github.com/rombintu/goyametricsv2/lib/myparser"
 	"go.uber.org/zap"
 )
 
@@ -22,176 +20,287 @@ type Data struct {
 	Gauges   Gauges   `json:"gauges"`
 }
 
+// tmpDriver keeps metrics in memory and optionally saves them to a JSON file.
+// Counters and gauges live in sharded maps, so concurrent handlers and
+// the sync worker can use the driver without a global lock.
+// With the WAL every accepted update is logged before it is applied,
+// so the file snapshot may be rare without losing data on a crash.
 type tmpDriver struct {
-	data      *Data
+	counters  *shardedMap[int64]
+	gauges    *shardedMap[float64]
 	storepath string
+	backups   int // Number of previous store files kept as store.json.1, store.json.2...
+	codec     *snapshotCodec
+	codecErr  error // Invalid compression or secret, returned by Open
+
+	saveMu     sync.Mutex // Serializes writes of the store file
+	restoreErr error      // The last restore failed: saving the partial state would lose the rest
+
+	wal   *wal         // nil if the WAL is disabled
+	walMu sync.RWMutex // Updates hold it shared, Save exclusive to cut the log at the snapshot
+	// WAL segments of the store file and its backups, newest first. The log is kept
+	// after the oldest of them, so a fallback to any backup loses nothing.
+	snapSeqs []uint64
+}
+
+func init() {
+	Register(MemDriver, func(Config) (Storage, error) {
+		return NewTmpDriver(memPath), nil
+	})
+	Register(FileDriver, func(conf Config) (Storage, error) {
+		if conf.Path == memPath {
+			return nil, errors.New("file driver needs a store path")
+		}
+		return NewTmpDriver(conf.Path, conf.Options...), nil
+	})
 }
 
-func NewTmpDriver(storepath string) *tmpDriver {
-	return &tmpDriver{
-		data:      &Data{},
+func NewTmpDriver(storepath string, opts ...Option) *tmpDriver {
+	var options Options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	d := &tmpDriver{
+		counters:  newCounters(),
+		gauges:    newGauges(),
 		storepath: storepath,
+		backups:   options.Backups,
+	}
+	d.codec, d.codecErr = newSnapshotCodec(options.Compression, options.EncryptionSecret)
+	if options.WAL && storepath != memPath {
+		d.wal = newWAL(storepath, options.WALSyncInterval, d.codec)
 	}
+	return d
 }
 
-func (d *tmpDriver) Open() error {
-	counters := make(Counters)
-	gauges := make(Gauges)
-	d.data = &Data{
-		Counters: counters,
-		Gauges:   gauges,
+func (d *tmpDriver) Open(_ context.Context) error {
+	if d.codecErr != nil {
+		return d.codecErr
+	}
+	d.counters.Reset(nil)
+	d.gauges.Reset(nil)
+	if d.wal != nil {
+		return d.wal.Open()
 	}
 	return nil
 }
 
-func (d *tmpDriver) Close() error {
-	d.data = &Data{}
+func (d *tmpDriver) Close(_ context.Context) error {
+	d.counters.Reset(nil)
+	d.gauges.Reset(nil)
+	if d.wal != nil {
+		return d.wal.Close()
+	}
 	return nil
 }
 
-func (d *tmpDriver) Ping() error {
+func (d *tmpDriver) Ping(_ context.Context) error {
 	return nil
 }
 
-func (d *tmpDriver) Update(mtype, mname, mvalue string) (err error) {
-	switch mtype {
-	case GaugeType:
-		value, err := myparser.Str2Float64(mvalue)
-		if err != nil {
-			return err
-		}
-		d.updateGauge(mname, value)
-	case CounterType:
-		value, err := myparser.Str2Int64(mvalue)
-		if err != nil {
-			return err
-		}
-		d.updateCounter(mname, value)
-	default:
-		return errors.New("invalid metric type")
-	}
-	return nil
+func (d *tmpDriver) UpdateCounter(_ context.Context, mname string, delta int64) error {
+	return d.commit(Data{Counters: Counters{mname: delta}})
 }
 
-func (d *tmpDriver) Get(mtype, mname string) (string, error) {
-	switch mtype {
-	case GaugeType:
-		value, ok := d.getGauge(mname)
-		if !ok {
-			return "", errors.New("not found")
-		}
-		return strconv.FormatFloat(value, 'f', -1, 64), nil
-	case CounterType:
-		value, ok := d.getCounter(mname)
-		if !ok {
-			return "", errors.New("not found")
-		}
-		return strconv.FormatInt(value, 10), nil
-	}
-	return "", errors.New("invalid metric type")
+func (d *tmpDriver) UpdateGauge(_ context.Context, mname string, value float64) error {
+	return d.commit(Data{Gauges: Gauges{mname: value}})
 }
 
-func (d *tmpDriver) getCounter(key string) (int64, bool) {
-	value, ok := d.data.Counters[key]
+func (d *tmpDriver) GetCounter(_ context.Context, mname string) (int64, error) {
+	value, ok := d.getCounter(mname)
 	if !ok {
-		return 0, false
+		return 0, ErrNotFound
 	}
-	return value, true
+	return value, nil
 }
 
-func (d *tmpDriver) getGauge(key string) (float64, bool) {
-	value, ok := d.data.Gauges[key]
+func (d *tmpDriver) GetGauge(_ context.Context, mname string) (float64, error) {
+	value, ok := d.getGauge(mname)
 	if !ok {
-		return 0, false
+		return 0, ErrNotFound
 	}
-	return value, true
+	return value, nil
+}
+
+func (d *tmpDriver) getCounter(key string) (int64, bool) {
+	return d.counters.Get(key)
+}
+
+func (d *tmpDriver) getGauge(key string) (float64, bool) {
+	return d.gauges.Get(key)
 }
 
 func (d *tmpDriver) updateGauge(key string, value float64) {
-	d.data.Gauges[key] = value
+	d.gauges.Set(key, value)
 }
 
 func (d *tmpDriver) updateCounter(key string, value int64) {
-	oldValue, exist := d.getCounter(key)
-	if !exist {
-		d.data.Counters[key] = value
-		return
+	d.counters.Add(key, value)
+}
+
+// GetAll returns a snapshot of all metrics. The caller owns the returned maps.
+func (d *tmpDriver) GetAll(_ context.Context) Data {
+	return Data{
+		Counters: d.counters.Snapshot(),
+		Gauges:   d.gauges.Snapshot(),
 	}
-	d.data.Counters[key] = oldValue + value
 }
 
-func (d *tmpDriver) GetAll() Data {
-	return *d.data
+func (d *tmpDriver) UpdateAll(_ context.Context, data Data) error {
+	return d.commit(data)
 }
 
-func (d *tmpDriver) UpdateAll(data Data) error {
-	for k, v := range data.Counters {
-		d.updateCounter(k, v)
-	}
-	for k, v := range data.Gauges {
-		d.updateGauge(k, v)
+// commit appends the batch to the WAL, if enabled, and applies it.
+// An update that could not be logged is rejected.
+func (d *tmpDriver) commit(data Data) error {
+	if d.wal != nil {
+		d.walMu.RLock()
+		defer d.walMu.RUnlock()
+		if err := d.wal.Append(data); err != nil {
+			return err
+		}
 	}
+	d.apply(data)
 	return nil
 }
 
-func (d *tmpDriver) Save() error {
+// apply adds counter deltas and sets gauges of the batch.
+func (d *tmpDriver) apply(data Data) {
+	d.counters.AddAll(data.Counters)
+	d.gauges.SetAll(data.Gauges)
+}
+
+// Save atomically replaces the store file with a snapshot of all metrics.
+func (d *tmpDriver) Save(ctx context.Context) error {
 
 	if d.storepath == memPath {
 		return nil
 	}
 
-	file, err := os.OpenFile(d.storepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0660)
-	if err != nil {
-		return err
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	if d.restoreErr != nil {
+		return fmt.Errorf("store is not saved after a failed restore: %w", d.restoreErr)
+	}
+
+	var snap snapshot
+	if d.wal != nil {
+		// No update may land between the snapshot and the start of the next segment
+		d.walMu.Lock()
+		snap.Data = d.GetAll(ctx)
+		seq, err := d.wal.Rotate()
+		d.walMu.Unlock()
+		if err != nil {
+			return err
+		}
+		snap.WALSeq = seq
+	} else {
+		snap.Data = d.GetAll(ctx)
 	}
-	defer file.Close()
-	data, err := json.MarshalIndent(d.GetAll(), "", "\t")
+
+	content, err := d.codec.encode(snap)
 	if err != nil {
 		return err
 	}
-	_, err = file.Write(data)
-	if err != nil {
+	if err := writeFileAtomic(d.storepath, content, d.backups); err != nil {
 		return err
 	}
-	return nil
+
+	if d.wal == nil {
+		return nil
+	}
+	d.snapSeqs = append([]uint64{snap.WALSeq}, d.snapSeqs...)
+	if len(d.snapSeqs) > d.backups+1 {
+		d.snapSeqs = d.snapSeqs[:d.backups+1]
+	}
+	// Until all retained files are known (after a restart), the older log is kept
+	if len(d.snapSeqs) < d.backups+1 {
+		return nil
+	}
+	return d.wal.Truncate(d.snapSeqs[len(d.snapSeqs)-1])
 }
 
-func (d *tmpDriver) Restore() error {
+// Restore loads the newest valid store file or backup and replays the WAL written after it.
+// If the WAL of the loaded file was already removed, Restore fails: the file alone misses updates.
+func (d *tmpDriver) Restore(_ context.Context) error {
 
 	if d.storepath == memPath {
 		return nil
 	}
 
-	if _, err := os.Stat(d.storepath); errors.Is(err, os.ErrNotExist) {
-		logger.Log.Info("no file found, skipping restore...")
-		return nil
-	}
-	file, err := os.OpenFile(d.storepath, os.O_RDONLY|os.O_CREATE, 0660)
+	snap, err := d.loadSnapshot()
 	if err != nil {
+		d.setRestoreErr(err)
 		return err
 	}
-	defer file.Close()
-	fileInfo, err := file.Stat()
-	if err != nil {
-		logger.Log.Warn("error getting file info, skipping...")
+	d.counters.Reset(snap.Counters)
+	d.gauges.Reset(snap.Gauges)
+
+	if d.wal == nil {
+		d.setRestoreErr(nil)
 		return nil
 	}
+	d.snapSeqs = []uint64{snap.WALSeq}
+	replayed, err := d.wal.Replay(snap.WALSeq, d.apply)
+	logger.Log.Info("wal replayed", zap.Int("records", replayed), zap.Uint64("after_segment", snap.WALSeq))
+	d.setRestoreErr(err)
+	return err
+}
 
-	if fileInfo.Size() == 0 {
-		logger.Log.Warn("file is empty, skipping restore...")
-		return nil
+// setRestoreErr records the result of a restore. After a failure Save refuses
+// to overwrite the store file and truncate the log with the partial state.
+func (d *tmpDriver) setRestoreErr(err error) {
+	d.saveMu.Lock()
+	defer d.saveMu.Unlock()
+	d.restoreErr = err
+}
+
+// loadSnapshot reads the store file, falling back to backups from the newest one
+// if it is missing or corrupt. Without a valid file it gives an empty snapshot,
+// unless the files could not be decrypted: then ErrSnapshotKey is returned,
+// so a wrong key is not mistaken for an empty store.
+func (d *tmpDriver) loadSnapshot() (snapshot, error) {
+	paths := []string{d.storepath}
+	for n := 1; n <= d.backups; n++ {
+		paths = append(paths, backupPath(d.storepath, n))
 	}
 
-	bytesData, err := io.ReadAll(file)
-	if err != nil {
-		logger.Log.Warn("no data found in store path, skipping restore...")
-		return nil
+	found, keyErrors := 0, 0
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		found++
+		if err != nil {
+			logger.Log.Warn("cannot read store file", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		snap, version, err := d.codec.decode(content)
+		if err != nil {
+			if errors.Is(err, ErrSnapshotKey) {
+				keyErrors++
+			}
+			logger.Log.Error("invalid store file, trying backup", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		if path != d.storepath {
+			logger.Log.Warn("restored from backup", zap.String("file", path))
+		}
+		if version < snapshotVersion {
+			logger.Log.Info("store file will be migrated on the next save",
+				zap.String("file", path), zap.Int("version", version))
+		}
+		return snap, nil
 	}
 
-	err = json.Unmarshal(bytesData, &d.data)
-	if err != nil {
-		logger.Log.Error("error unmarshalling JSON data", zap.Error(err))
-		return nil
+	switch {
+	case keyErrors > 0 && keyErrors == found:
+		return snapshot{}, ErrSnapshotKey
+	case found > 0:
+		logger.Log.Error("no valid store file found, skipping restore...")
+	default:
+		logger.Log.Info("no file found, skipping restore...")
 	}
-	return nil
+	return snapshot{}, nil
 }
@@ -1,12 +1,24 @@
 package storage
 
 import (
+	"context"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
 
+// newTestTmpDriver creates a driver filled with data.
+func newTestTmpDriver(data *Data, storepath string) *tmpDriver {
+	d := NewTmpDriver(storepath)
+	if data != nil {
+		d.counters.Reset(data.Counters)
+		d.gauges.Reset(data.Gauges)
+	}
+	return d
+}
+
 func Test_tmpDriver_Save(t *testing.T) {
-	storepath := "test.json"
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      Data
 		storepath string
@@ -62,11 +74,8 @@ func Test_tmpDriver_Save(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &tmpDriver{
-				data:      &tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := m.Save(); err != nil {
+			m := newTestTmpDriver(&tt.fields.data, tt.fields.storepath)
+			if err := m.Save(context.Background()); err != nil {
 				t.Errorf("tmpDriver.Save() error = %v", err)
 			}
 		})
@@ -74,6 +83,7 @@ func Test_tmpDriver_Save(t *testing.T) {
 }
 
 func Test_tmpDriver_Restore(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      Data
 		storepath string
@@ -85,20 +95,24 @@ func Test_tmpDriver_Restore(t *testing.T) {
 		{
 			name: "restore",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := &tmpDriver{
-				data:      &tt.fields.data,
-				storepath: tt.fields.storepath,
+			saved := newTestTmpDriver(&Data{
+				Counters: Counters{"counter1": 1, "counter2": 2},
+				Gauges:   Gauges{"gauge1": 10},
+			}, tt.fields.storepath)
+			if err := saved.Save(context.Background()); err != nil {
+				t.Fatalf("tmpDriver.Save() error = %v", err)
 			}
-			if err := m.Restore(); err != nil {
+			m := newTestTmpDriver(&tt.fields.data, tt.fields.storepath)
+			if err := m.Restore(context.Background()); err != nil {
 				t.Errorf("tmpDriver.Restore() error = %v", err)
 			}
-			if len(m.data.Counters) != 2 {
+			if len(m.GetAll(context.Background()).Counters) != 2 {
 				t.Error("tmpDriver.Restore() len Counters not 2")
 			}
 			if _, ok := m.getCounter("counter2"); !ok {
@@ -109,6 +123,7 @@ func Test_tmpDriver_Restore(t *testing.T) {
 }
 
 func Test_tmpDriver_GetAll(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      Data
 		storepath string
@@ -121,18 +136,15 @@ func Test_tmpDriver_GetAll(t *testing.T) {
 		{
 			name: "get_all_nill",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 			},
-			want: Data{},
+			want: Data{Counters: Counters{}, Gauges: Gauges{}},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      &tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if got := d.GetAll(); !reflect.DeepEqual(got, tt.want) {
+			d := newTestTmpDriver(&tt.fields.data, tt.fields.storepath)
+			if got := d.GetAll(context.Background()); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("tmpDriver.GetAll() = %v, want %v", got, tt.want)
 			}
 		})
@@ -140,6 +152,7 @@ func Test_tmpDriver_GetAll(t *testing.T) {
 }
 
 func Test_tmpDriver_getGauge(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	data := &Data{
 		Gauges: make(Gauges),
 	}
@@ -161,7 +174,7 @@ func Test_tmpDriver_getGauge(t *testing.T) {
 		{
 			name: "get_gauge_1",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:  args{key: "g1"},
@@ -171,7 +184,7 @@ func Test_tmpDriver_getGauge(t *testing.T) {
 		{
 			name: "get_gauge_nil",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:  args{key: "g2"},
@@ -182,10 +195,7 @@ func Test_tmpDriver_getGauge(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
 			got, got1 := d.getGauge(tt.args.key)
 			if got != tt.want {
 				t.Errorf("tmpDriver.getGauge() got = %v, want %v", got, tt.want)
@@ -198,6 +208,7 @@ func Test_tmpDriver_getGauge(t *testing.T) {
 }
 
 func Test_tmpDriver_getCounter(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	data := &Data{
 		Counters: make(Counters),
 	}
@@ -219,7 +230,7 @@ func Test_tmpDriver_getCounter(t *testing.T) {
 		{
 			name: "get_counter_1",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:  args{key: "c1"},
@@ -229,7 +240,7 @@ func Test_tmpDriver_getCounter(t *testing.T) {
 		{
 			name: "get_counter_nil",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:  args{key: "c2"},
@@ -240,10 +251,7 @@ func Test_tmpDriver_getCounter(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
 			got, got1 := d.getCounter(tt.args.key)
 			if got != tt.want {
 				t.Errorf("tmpDriver.getCounter() got = %v, want %v", got, tt.want)
@@ -256,6 +264,7 @@ func Test_tmpDriver_getCounter(t *testing.T) {
 }
 
 func Test_tmpDriver_Get(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	data := &Data{
 		Counters: make(Counters),
 		Gauges:   make(Gauges),
@@ -280,7 +289,7 @@ func Test_tmpDriver_Get(t *testing.T) {
 		{
 			name: "get_c1_1",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:    args{mtype: CounterType, mname: "c1"},
@@ -290,7 +299,7 @@ func Test_tmpDriver_Get(t *testing.T) {
 		{
 			name: "get_c2_nil",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args:    args{mtype: CounterType, mname: "c2"},
@@ -300,11 +309,8 @@ func Test_tmpDriver_Get(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			got, err := d.Get(tt.args.mtype, tt.args.mname)
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
+			got, err := GetString(context.Background(), d, tt.args.mtype, tt.args.mname)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.Get() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -317,6 +323,7 @@ func Test_tmpDriver_Get(t *testing.T) {
 }
 
 func Test_tmpDriver_Close(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      Data
 		storepath string
@@ -329,18 +336,15 @@ func Test_tmpDriver_Close(t *testing.T) {
 		{
 			name: "close",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 			},
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      &tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := d.Close(); (err != nil) != tt.wantErr {
+			d := newTestTmpDriver(&tt.fields.data, tt.fields.storepath)
+			if err := d.Close(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.Close() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -348,6 +352,7 @@ func Test_tmpDriver_Close(t *testing.T) {
 }
 
 func Test_tmpDriver_Ping(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      *Data
 		storepath string
@@ -360,18 +365,15 @@ func Test_tmpDriver_Ping(t *testing.T) {
 		{
 			name: "ping",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 			},
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := d.Ping(); (err != nil) != tt.wantErr {
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
+			if err := d.Ping(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.Ping() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -379,6 +381,7 @@ func Test_tmpDriver_Ping(t *testing.T) {
 }
 
 func Test_tmpDriver_updateGauge(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      *Data
 		storepath string
@@ -395,7 +398,7 @@ func Test_tmpDriver_updateGauge(t *testing.T) {
 		{
 			name: "update_gauge_g1",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data: &Data{
 					Counters: make(Counters),
 					Gauges:   make(Gauges),
@@ -406,16 +409,14 @@ func Test_tmpDriver_updateGauge(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
 			d.updateGauge(tt.args.key, tt.args.value)
 		})
 	}
 }
 
 func Test_tmpDriver_updateCounter(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	type fields struct {
 		data      *Data
 		storepath string
@@ -432,7 +433,7 @@ func Test_tmpDriver_updateCounter(t *testing.T) {
 		{
 			name: "update_counter_c1",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data: &Data{
 					Counters: make(Counters),
 					Gauges:   make(Gauges),
@@ -443,16 +444,14 @@ func Test_tmpDriver_updateCounter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
 			d.updateCounter(tt.args.key, tt.args.value)
 		})
 	}
 }
 
 func Test_tmpDriver_UpdateAll(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	data := &Data{
 		Counters: make(Counters),
 		Gauges:   make(Gauges),
@@ -473,7 +472,7 @@ func Test_tmpDriver_UpdateAll(t *testing.T) {
 		{
 			name: "update_data",
 			fields: fields{
-				storepath: "test.json",
+				storepath: storepath,
 				data:      data,
 			},
 			args: args{data: *data},
@@ -481,11 +480,8 @@ func Test_tmpDriver_UpdateAll(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := d.UpdateAll(tt.args.data); (err != nil) != tt.wantErr {
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
+			if err := d.UpdateAll(context.Background(), tt.args.data); (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.UpdateAll() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -493,6 +489,7 @@ func Test_tmpDriver_UpdateAll(t *testing.T) {
 }
 
 func Test_tmpDriver_Update(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "test.json")
 	data := &Data{
 		Counters: make(Counters),
 		Gauges:   make(Gauges),
@@ -516,7 +513,7 @@ func Test_tmpDriver_Update(t *testing.T) {
 			name: "update_some_value",
 			fields: fields{
 				data:      data,
-				storepath: "test.json",
+				storepath: storepath,
 			},
 			args: args{
 				mtype:  CounterType,
@@ -528,11 +525,8 @@ func Test_tmpDriver_Update(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := d.Update(tt.args.mtype, tt.args.mname, tt.args.mvalue); (err != nil) != tt.wantErr {
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
+			if err := UpdateString(context.Background(), d, tt.args.mtype, tt.args.mname, tt.args.mvalue); (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.Update() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -540,6 +534,7 @@ func Test_tmpDriver_Update(t *testing.T) {
 }
 
 func Test_tmpDriver_Open(t *testing.T) {
+	storepath := filepath.Join(t.TempDir(), "store-test.json")
 	cmap := make(Counters)
 	gmap := make(Gauges)
 	data := Data{
@@ -559,18 +554,15 @@ func Test_tmpDriver_Open(t *testing.T) {
 			name: "open_tmp_driver",
 			fields: fields{
 				data:      &data,
-				storepath: "store-test.json",
+				storepath: storepath,
 			},
 			wantErr: false,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			d := &tmpDriver{
-				data:      tt.fields.data,
-				storepath: tt.fields.storepath,
-			}
-			if err := d.Open(); (err != nil) != tt.wantErr {
+			d := newTestTmpDriver(tt.fields.data, tt.fields.storepath)
+			if err := d.Open(context.Background()); (err != nil) != tt.wantErr {
 				t.Errorf("tmpDriver.Open() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
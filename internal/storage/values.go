@@ -0,0 +1,57 @@
+// Package storage string-encoded values
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/rombintu/goyametricsv2/lib/myparser"
+)
+
+var (
+	// ErrNotFound is returned when there is no metric of the type and name.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalidType is returned for a metric type other than GaugeType and CounterType.
+	ErrInvalidType = errors.New("invalid metric type")
+)
+
+// UpdateString parses mval by the metric type and updates the metric.
+// It serves the URL-param handlers, the rest of the code uses the typed methods.
+func UpdateString(ctx context.Context, s Storage, mtype, mname, mval string) error {
+	switch mtype {
+	case CounterType:
+		delta, err := myparser.Str2Int64(mval)
+		if err != nil {
+			return err
+		}
+		return s.UpdateCounter(ctx, mname, delta)
+	case GaugeType:
+		value, err := myparser.Str2Float64(mval)
+		if err != nil {
+			return err
+		}
+		return s.UpdateGauge(ctx, mname, value)
+	}
+	return ErrInvalidType
+}
+
+// GetString returns the metric formatted as text: counters in base 10,
+// gauges in the shortest form that parses back to the same float.
+func GetString(ctx context.Context, s Storage, mtype, mname string) (string, error) {
+	switch mtype {
+	case CounterType:
+		delta, err := s.GetCounter(ctx, mname)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(delta, 10), nil
+	case GaugeType:
+		value, err := s.GetGauge(ctx, mname)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	}
+	return "", ErrInvalidType
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateString(t *testing.T) {
+	ctx := context.Background()
+	d := NewTmpDriver(memPath)
+
+	require.NoError(t, UpdateString(ctx, d, CounterType, "c", "2"))
+	require.NoError(t, UpdateString(ctx, d, CounterType, "c", "3"))
+	require.NoError(t, UpdateString(ctx, d, GaugeType, "g", "0.1"))
+	assert.Error(t, UpdateString(ctx, d, CounterType, "c", "1.5"))
+	assert.Error(t, UpdateString(ctx, d, GaugeType, "g", "abc"))
+	assert.ErrorIs(t, UpdateString(ctx, d, "histogram", "h", "1"), ErrInvalidType)
+
+	delta, err := d.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), delta)
+	value, err := d.GetGauge(ctx, "g")
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, value)
+}
+
+func TestGetString(t *testing.T) {
+	ctx := context.Background()
+	d := NewTmpDriver(memPath)
+	require.NoError(t, d.UpdateCounter(ctx, "c", 7))
+	require.NoError(t, d.UpdateGauge(ctx, "g", 123456789.125))
+
+	got, err := GetString(ctx, d, CounterType, "c")
+	require.NoError(t, err)
+	assert.Equal(t, "7", got)
+	got, err = GetString(ctx, d, GaugeType, "g")
+	require.NoError(t, err)
+	assert.Equal(t, "123456789.125", got)
+
+	// Счетчик и gauge с одним именем различаются
+	_, err = GetString(ctx, d, GaugeType, "c")
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = GetString(ctx, d, "histogram", "c")
+	assert.ErrorIs(t, err, ErrInvalidType)
+}
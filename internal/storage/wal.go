@@ -0,0 +1,331 @@
+// Package storage write-ahead log
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// walSuffix separates the store path and the segment number: store.json.wal.3
+const walSuffix = ".wal."
+
+// ErrWALGap is returned by a restore when a segment of the log after the snapshot is missing.
+var ErrWALGap = errors.New("wal segment is missing: updates after the snapshot are lost")
+
+// wal is an append-only log of accepted updates of the file driver.
+// Every record is one JSON line with a Data batch: counters are deltas, gauges are values.
+// With the store encryption the batch is sealed with the key of the store file (walRecord).
+// The log is split into numbered segments: a snapshot covers all segments
+// up to its wal_seq, so they are removed after the snapshot is written.
+type wal struct {
+	storepath    string
+	syncInterval time.Duration // 0 - fsync on every append
+	codec        *snapshotCodec
+
+	mu    sync.Mutex
+	file  *os.File
+	seq   uint64 // Number of the current segment
+	dirty bool   // Appended since the last fsync
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// walRecord is a sealed line of the log: the encrypted Data batch and the salt of its key.
+type walRecord struct {
+	Salt   []byte `json:"salt"`
+	Sealed []byte `json:"sealed"`
+}
+
+// walRecordAAD binds sealed records to the log, so a store payload cannot pass for one.
+var walRecordAAD = []byte("wal")
+
+func newWAL(storepath string, syncInterval time.Duration, codec *snapshotCodec) *wal {
+	return &wal{
+		storepath:    storepath,
+		syncInterval: syncInterval,
+		codec:        codec,
+	}
+}
+
+// encodeRecord returns the line of the batch, sealed if the codec encrypts.
+func (w *wal) encodeRecord(data Data) ([]byte, error) {
+	record, err := json.Marshal(data)
+	if err != nil || w.codec.aead == nil {
+		return record, err
+	}
+	sealed, err := w.codec.seal(record, walRecordAAD)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(walRecord{Salt: w.codec.salt, Sealed: sealed})
+}
+
+// decodeRecord parses a line of the log. A sealed record that cannot be
+// decrypted gives ErrSnapshotKey: the log is never read as empty with a wrong key.
+func (w *wal) decodeRecord(line []byte) (Data, error) {
+	var record walRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return Data{}, err
+	}
+	// Plain records of a log written before the encryption was enabled
+	plain := line
+	if record.Sealed != nil {
+		var err error
+		if plain, err = w.codec.unseal(record.Salt, record.Sealed, walRecordAAD); err != nil {
+			return Data{}, err
+		}
+	}
+	var data Data
+	err := json.Unmarshal(plain, &data)
+	return data, err
+}
+
+// HasWAL reports whether the store path has segments of the write-ahead log,
+// so the store cannot be read without it.
+func HasWAL(storepath string) (bool, error) {
+	seqs, err := newWAL(storepath, 0, nil).segments()
+	return len(seqs) > 0, err
+}
+
+// segmentPath returns the file of segment seq.
+func (w *wal) segmentPath(seq uint64) string {
+	return w.storepath + walSuffix + strconv.FormatUint(seq, 10)
+}
+
+// segments returns numbers of existing segments in ascending order.
+func (w *wal) segments() ([]uint64, error) {
+	matches, err := filepath.Glob(w.storepath + walSuffix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, m := range matches {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(m, w.storepath+walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// Open starts a new segment after the existing ones and the background fsync.
+func (w *wal) Open() error {
+	seqs, err := w.segments()
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq = 1
+	if len(seqs) > 0 {
+		w.seq = seqs[len(seqs)-1] + 1
+	}
+	if err := w.openSegment(); err != nil {
+		return err
+	}
+
+	if w.syncInterval > 0 {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return nil
+}
+
+func (w *wal) openSegment() error {
+	file, err := os.OpenFile(w.segmentPath(w.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	return nil
+}
+
+// syncLoop fsyncs appended records in batches every syncInterval.
+func (w *wal) syncLoop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				logger.Log.Error("cannot sync wal", zap.Error(err))
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Append writes the batch to the log. Without a sync interval it is fsynced at once.
+func (w *wal) Append(data Data) error {
+	record, err := w.encodeRecord(data)
+	if err != nil {
+		return err
+	}
+	record = append(record, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return errors.New("wal is closed")
+	}
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	if w.syncInterval == 0 {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// Sync fsyncs records appended since the last call.
+func (w *wal) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.syncLocked()
+}
+
+func (w *wal) syncLocked() error {
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+// Rotate closes the current segment and starts the next one.
+// It returns the number of the closed segment: a snapshot taken before
+// the rotation contains all records up to it.
+func (w *wal) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.syncLocked(); err != nil {
+		return 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	closed := w.seq
+	w.seq++
+	return closed, w.openSegment()
+}
+
+// Truncate removes segments already included in a snapshot.
+func (w *wal) Truncate(upTo uint64) error {
+	seqs, err := w.segments()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, seq := range seqs {
+		if seq > upTo {
+			break
+		}
+		if err := os.Remove(w.segmentPath(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Replay calls apply for every record of segments after the snapshot (after)
+// and before the current one. A torn last record of a segment is skipped.
+// A missing segment fails the replay before anything is applied.
+func (w *wal) Replay(after uint64, apply func(Data)) (int, error) {
+	seqs, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+	w.mu.Lock()
+	current := w.seq
+	w.mu.Unlock()
+
+	next := after + 1
+	for _, seq := range seqs {
+		if seq <= after || seq >= current {
+			continue
+		}
+		if seq != next {
+			break
+		}
+		next++
+	}
+	if next != current {
+		return 0, fmt.Errorf("%w: segment %d", ErrWALGap, next)
+	}
+
+	replayed := 0
+	for _, seq := range seqs {
+		if seq <= after || seq >= current {
+			continue
+		}
+		n, err := w.replaySegment(w.segmentPath(seq), apply)
+		replayed += n
+		if err != nil {
+			return replayed, fmt.Errorf("wal segment %d: %w", seq, err)
+		}
+	}
+	return replayed, nil
+}
+
+func (w *wal) replaySegment(path string, apply func(Data)) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	n := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		data, err := w.decodeRecord(scanner.Bytes())
+		if errors.Is(err, ErrSnapshotKey) {
+			return n, err
+		}
+		if err != nil {
+			// The process crashed in the middle of the append
+			logger.Log.Warn("skip torn wal record", zap.String("file", path), zap.Error(err))
+			continue
+		}
+		apply(data)
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// Close stops the background fsync, syncs and closes the current segment.
+func (w *wal) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+		w.stop = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := errors.Join(w.syncLocked(), w.file.Close())
+	w.file = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openWALDriver opens a file driver with the WAL and restores it, as the server does.
+func openWALDriver(t *testing.T, storepath string, syncInterval time.Duration) *tmpDriver {
+	d := NewTmpDriver(storepath, WithWAL(syncInterval))
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.Restore(context.Background()))
+	return d
+}
+
+func Test_tmpDriver_WAL(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+
+	// Обновления без снапшота: после "падения" восстанавливаются из журнала
+	d := openWALDriver(t, storepath, 0)
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 2))
+	require.NoError(t, d.UpdateAll(context.Background(), Data{Counters: Counters{"c": 3}, Gauges: Gauges{"g": 1.5}}))
+	require.NoError(t, d.wal.file.Close()) // Crash: no Save, no Close
+
+	d = openWALDriver(t, storepath, 0)
+	assert.Equal(t, Data{Counters: Counters{"c": 5}, Gauges: Gauges{"g": 1.5}}, d.GetAll(context.Background()))
+
+	// Снапшот обрезает журнал, последующие обновления снова в журнале
+	require.NoError(t, d.Save(context.Background()))
+	require.NoError(t, d.UpdateGauge(context.Background(), "g", 7))
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 1))
+	segments, err := d.wal.segments()
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{d.wal.seq}, segments)
+	require.NoError(t, d.Close(context.Background()))
+
+	// Счетчики из снапшота не применяются повторно
+	d = openWALDriver(t, storepath, 0)
+	assert.Equal(t, Data{Counters: Counters{"c": 6}, Gauges: Gauges{"g": 7}}, d.GetAll(context.Background()))
+	require.NoError(t, d.Close(context.Background()))
+}
+
+func Test_tmpDriver_WAL_SaveBeforeTruncate(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+
+	d := openWALDriver(t, storepath, 0)
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 1))
+	require.NoError(t, d.Save(context.Background()))
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 1))
+
+	// Crash after the snapshot but before the log was cut: restore the old segment
+	first := d.wal.segmentPath(d.wal.seq - 1)
+	require.NoError(t, os.WriteFile(first, []byte(`{"counters":{"c":1}}`+"\n"), 0660))
+	require.NoError(t, d.Close(context.Background()))
+
+	d = openWALDriver(t, storepath, 0)
+	assert.Equal(t, int64(2), d.GetAll(context.Background()).Counters["c"])
+	require.NoError(t, d.Close(context.Background()))
+}
+
+func Test_tmpDriver_WAL_TornRecord(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+
+	d := openWALDriver(t, storepath, time.Hour)
+	require.NoError(t, d.UpdateCounter(context.Background(), "c", 4))
+	require.NoError(t, d.Close(context.Background()))
+
+	// Запись оборвана на середине
+	file, err := os.OpenFile(d.wal.segmentPath(1), os.O_WRONLY|os.O_APPEND, 0660)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"counters":{"c":10`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	d = openWALDriver(t, storepath, time.Hour)
+	assert.Equal(t, int64(4), d.GetAll(context.Background()).Counters["c"])
+	require.NoError(t, d.Close(context.Background()))
+}
+
+func Test_tmpDriver_WAL_Encrypted(t *testing.T) {
+	storepath := path.Join(t.TempDir(), "store.json")
+	open := func(secret string) *tmpDriver {
+		return NewTmpDriver(storepath, WithWAL(0), WithEncryption([]byte(secret)))
+	}
+
+	d := open("passphrase")
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.Restore(context.Background()))
+	require.NoError(t, d.UpdateAll(context.Background(), Data{Counters: Counters{"requests": 3}, Gauges: Gauges{"load": 0.5}}))
+	require.NoError(t, d.Close(context.Background()))
+
+	// В журнале нет открытых имен и значений метрик
+	content, err := os.ReadFile(d.wal.segmentPath(1))
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "requests")
+	assert.NotContains(t, string(content), "counters")
+
+	// С чужим ключом журнал не считается пустым
+	d = open("wrong")
+	require.NoError(t, d.Open(context.Background()))
+	assert.ErrorIs(t, d.Restore(context.Background()), ErrSnapshotKey)
+	require.NoError(t, d.Close(context.Background()))
+
+	d = open("passphrase")
+	require.NoError(t, d.Open(context.Background()))
+	require.NoError(t, d.Restore(context.Background()))
+	assert.Equal(t, Data{Counters: Counters{"requests": 3}, Gauges: Gauges{"load": 0.5}}, d.GetAll(context.Background()))
+	require.NoError(t, d.Close(context.Background()))
+}
+
+func Test_wal_SyncInterval(t *testing.T) {
+	codec, err := newSnapshotCodec(CompressionNone, nil)
+	require.NoError(t, err)
+	w := newWAL(path.Join(t.TempDir(), "store.json"), time.Millisecond, codec)
+	require.NoError(t, w.Open())
+	require.NoError(t, w.Append(Data{Counters: Counters{"c": 1}}))
+	assert.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return !w.dirty
+	}, time.Second, time.Millisecond)
+	require.NoError(t, w.Close())
+	assert.Error(t, w.Append(Data{}))
+}
@@ -0,0 +1,299 @@
+// Package storage writeBehindStorage
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rombintu/goyametricsv2/internal/logger"
+	"go.uber.org/zap"
+)
+
+// WriteBehind configures the write-behind cache.
+type WriteBehind struct {
+	// FlushInterval is the period of flushes to the backend.
+	FlushInterval time.Duration
+	// MaxPending is the number of pending metrics that triggers an early flush. 0 - no limit.
+	MaxPending int
+}
+
+// WriteBehindStats describe the metrics not yet written to the backend.
+type WriteBehindStats struct {
+	// Pending is the number of metrics with unflushed updates.
+	Pending int `json:"pending"`
+	// LagMs is the age of the oldest unflushed update in milliseconds, 0 if there is none.
+	LagMs int64 `json:"lag_ms"`
+	// LastFlush is the time of the last successful flush.
+	LastFlush time.Time `json:"last_flush"`
+	// LastError is the error of the last flush, empty if it succeeded.
+	LastError string `json:"last_error,omitempty"`
+}
+
+// writeBehindStorage serves reads from memory and writes to the backend in batches.
+// Counter deltas are summed and gauges overwritten until the next flush, so a burst
+// of updates of one metric costs a single upsert. Updates are accepted in memory:
+// until they are flushed, a crash loses them and other servers do not see them.
+type writeBehindStorage struct {
+	backend Storage
+	conf    WriteBehind
+
+	counters *shardedMap[int64]
+	gauges   *shardedMap[float64]
+
+	mu           sync.Mutex // Guards pending and flush state
+	pending      Data
+	pendingSince time.Time // Time of the oldest pending update, zero if none
+	lastFlush    time.Time
+	lastErr      error
+	subscribed   bool // The cache follows the notifications of the backend
+
+	flushMu sync.Mutex    // Serializes flushes and reloads
+	kick    chan struct{} // Early flush on MaxPending
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// WithWriteBehind puts a write-behind cache in front of the storage.
+// A non-positive flush interval leaves the storage as is.
+func WithWriteBehind(s Storage, conf WriteBehind) Storage {
+	if conf.FlushInterval <= 0 {
+		return s
+	}
+	return &writeBehindStorage{
+		backend:  s,
+		conf:     conf,
+		counters: newCounters(),
+		gauges:   newGauges(),
+		pending:  Data{Counters: Counters{}, Gauges: Gauges{}},
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// WriteBehindStatsOf returns the stats of the write-behind cache of s, false if there is none.
+// Wrappers of the cache are looked through with their Unwrap method.
+func WriteBehindStatsOf(s Storage) (WriteBehindStats, bool) {
+	for s != nil {
+		if wb, ok := s.(*writeBehindStorage); ok {
+			return wb.Stats(), true
+		}
+		u, ok := s.(interface{ Unwrap() Storage })
+		if !ok {
+			break
+		}
+		s = u.Unwrap()
+	}
+	return WriteBehindStats{}, false
+}
+
+// Open opens the backend, loads all metrics from it and starts the flush loop.
+// If the backend notifies of updates of other servers, the cache follows them.
+func (s *writeBehindStorage) Open(ctx context.Context) error {
+	if err := s.backend.Open(ctx); err != nil {
+		return err
+	}
+	if n, ok := NotifierOf(s.backend); ok && !s.subscribed {
+		n.OnChange(s.applyChange)
+		s.subscribed = true
+	}
+	s.load(ctx)
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.flushLoop()
+	return nil
+}
+
+// Restore restores the backend and reloads the cache from it.
+func (s *writeBehindStorage) Restore(ctx context.Context) error {
+	if err := s.backend.Restore(ctx); err != nil {
+		return err
+	}
+	s.load(ctx)
+	return nil
+}
+
+// load replaces the cache with the metrics of the backend and the pending updates on top.
+// It waits for a running flush: its batch is neither pending nor in the backend yet.
+func (s *writeBehindStorage) load(ctx context.Context) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	data := s.backend.GetAll(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters.Reset(data.Counters)
+	s.gauges.Reset(data.Gauges)
+	s.counters.AddAll(s.pending.Counters)
+	s.gauges.SetAll(s.pending.Gauges)
+}
+
+// applyChange applies an update of another server to the cache.
+// Gauges with pending updates keep the local value: it is written to the backend later.
+func (s *writeBehindStorage) applyChange(change Change) {
+	if change.Reload {
+		s.load(context.Background())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters.AddAll(change.Data.Counters)
+	for mname, value := range change.Data.Gauges {
+		if _, ok := s.pending.Gauges[mname]; !ok {
+			s.gauges.Set(mname, value)
+		}
+	}
+}
+
+// Close stops the flush loop, flushes pending updates and closes the backend.
+func (s *writeBehindStorage) Close(ctx context.Context) error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	return errors.Join(s.Flush(ctx), s.backend.Close(ctx))
+}
+
+func (s *writeBehindStorage) Ping(ctx context.Context) error {
+	return s.backend.Ping(ctx)
+}
+
+// Save flushes pending updates and saves the backend.
+func (s *writeBehindStorage) Save(ctx context.Context) error {
+	if err := s.Flush(ctx); err != nil {
+		return err
+	}
+	return s.backend.Save(ctx)
+}
+
+func (s *writeBehindStorage) UpdateCounter(ctx context.Context, mname string, delta int64) error {
+	return s.UpdateAll(ctx, Data{Counters: Counters{mname: delta}})
+}
+
+func (s *writeBehindStorage) UpdateGauge(ctx context.Context, mname string, value float64) error {
+	return s.UpdateAll(ctx, Data{Gauges: Gauges{mname: value}})
+}
+
+// UpdateAll applies the batch to the cache and queues it for the next flush.
+func (s *writeBehindStorage) UpdateAll(_ context.Context, data Data) error {
+	if len(data.Counters)+len(data.Gauges) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	s.counters.AddAll(data.Counters)
+	s.gauges.SetAll(data.Gauges)
+	for mname, delta := range data.Counters {
+		s.pending.Counters[mname] += delta
+	}
+	for mname, value := range data.Gauges {
+		s.pending.Gauges[mname] = value
+	}
+	if s.pendingSince.IsZero() {
+		s.pendingSince = time.Now()
+	}
+	pending := len(s.pending.Counters) + len(s.pending.Gauges)
+	s.mu.Unlock()
+
+	if s.conf.MaxPending > 0 && pending >= s.conf.MaxPending {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *writeBehindStorage) GetCounter(_ context.Context, mname string) (int64, error) {
+	value, ok := s.counters.Get(mname)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *writeBehindStorage) GetGauge(_ context.Context, mname string) (float64, error) {
+	value, ok := s.gauges.Get(mname)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return value, nil
+}
+
+// GetAll returns a snapshot of the cache. The caller owns the returned maps.
+func (s *writeBehindStorage) GetAll(_ context.Context) Data {
+	return Data{
+		Counters: s.counters.Snapshot(),
+		Gauges:   s.gauges.Snapshot(),
+	}
+}
+
+// Flush writes pending updates to the backend in one batch.
+// A failed batch is merged back, so it is retried with the next flush:
+// counter deltas are summed, gauges updated since are kept.
+func (s *writeBehindStorage) Flush(ctx context.Context) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	batch, since := s.pending, s.pendingSince
+	s.pending, s.pendingSince = Data{Counters: Counters{}, Gauges: Gauges{}}, time.Time{}
+	s.mu.Unlock()
+	if len(batch.Counters)+len(batch.Gauges) == 0 {
+		return nil
+	}
+
+	err := s.backend.UpdateAll(ctx, batch)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastErr = err
+	if err == nil {
+		s.lastFlush = time.Now()
+		return nil
+	}
+	for mname, delta := range batch.Counters {
+		s.pending.Counters[mname] += delta
+	}
+	for mname, value := range batch.Gauges {
+		if _, ok := s.pending.Gauges[mname]; !ok {
+			s.pending.Gauges[mname] = value
+		}
+	}
+	s.pendingSince = since
+	return err
+}
+
+// Stats returns the state of pending updates.
+func (s *writeBehindStorage) Stats() WriteBehindStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := WriteBehindStats{
+		Pending:   len(s.pending.Counters) + len(s.pending.Gauges),
+		LastFlush: s.lastFlush,
+	}
+	if !s.pendingSince.IsZero() {
+		stats.LagMs = time.Since(s.pendingSince).Milliseconds()
+	}
+	if s.lastErr != nil {
+		stats.LastError = s.lastErr.Error()
+	}
+	return stats
+}
+
+// flushLoop flushes every FlushInterval and whenever MaxPending is reached.
+func (s *writeBehindStorage) flushLoop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.kick:
+		case <-s.stop:
+			return
+		}
+		if err := s.Flush(context.Background()); err != nil {
+			logger.Log.Error("cannot flush write-behind cache", zap.Error(err))
+		}
+	}
+}
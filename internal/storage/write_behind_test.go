@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingStorage is an in-memory backend that counts batch writes and can fail them.
+// Like a database, it keeps the data when it is closed and opened again.
+type recordingStorage struct {
+	*tmpDriver
+
+	mu      sync.Mutex
+	batches int
+	fail    error
+}
+
+func newRecordingStorage() *recordingStorage {
+	return &recordingStorage{tmpDriver: NewTmpDriver(memPath)}
+}
+
+func (s *recordingStorage) Open(_ context.Context) error {
+	return nil
+}
+
+func (s *recordingStorage) Close(_ context.Context) error {
+	return nil
+}
+
+func (s *recordingStorage) UpdateAll(ctx context.Context, data Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		return s.fail
+	}
+	s.batches++
+	return s.tmpDriver.UpdateAll(ctx, data)
+}
+
+func (s *recordingStorage) Batches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func TestWithWriteBehind(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStorage()
+	require.NoError(t, backend.UpdateAll(ctx, Data{Counters: Counters{"c": 10}}))
+
+	st := WithWriteBehind(backend, WriteBehind{FlushInterval: time.Hour})
+	require.NoError(t, st.Open(ctx))
+	defer st.Close(ctx)
+
+	// Чтения из памяти, включая загруженное из хранилища
+	require.NoError(t, st.UpdateCounter(ctx, "c", 1))
+	require.NoError(t, st.UpdateCounter(ctx, "c", 2))
+	require.NoError(t, st.UpdateGauge(ctx, "g", 1))
+	require.NoError(t, st.UpdateGauge(ctx, "g", 2))
+	value, err := st.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), value)
+	assert.Equal(t, Data{Counters: Counters{"c": 13}, Gauges: Gauges{"g": 2}}, st.GetAll(ctx))
+	assert.Equal(t, Data{Counters: Counters{"c": 10}, Gauges: Gauges{}}, backend.GetAll(ctx))
+
+	stats, ok := WriteBehindStatsOf(st)
+	require.True(t, ok)
+	assert.Equal(t, 2, stats.Pending)
+
+	// Обновления одной метрики сливаются в одну запись пачки
+	require.NoError(t, st.Save(ctx))
+	assert.Equal(t, 2, backend.Batches())
+	assert.Equal(t, Data{Counters: Counters{"c": 13}, Gauges: Gauges{"g": 2}}, backend.GetAll(ctx))
+	stats, _ = WriteBehindStatsOf(st)
+	assert.Equal(t, WriteBehindStats{LastFlush: stats.LastFlush}, stats)
+	assert.False(t, stats.LastFlush.IsZero())
+
+	// Без интервала кэш не включается
+	assert.Same(t, Storage(backend), WithWriteBehind(backend, WriteBehind{}))
+	_, ok = WriteBehindStatsOf(backend)
+	assert.False(t, ok)
+}
+
+func TestWithWriteBehind_FailedFlush(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStorage()
+	st := WithWriteBehind(backend, WriteBehind{FlushInterval: time.Hour})
+	require.NoError(t, st.Open(ctx))
+
+	backend.fail = errors.New("database is down")
+	require.NoError(t, st.UpdateAll(ctx, Data{Counters: Counters{"c": 1}, Gauges: Gauges{"g": 1}}))
+	assert.Error(t, st.Save(ctx))
+
+	// Неудачная пачка сливается с новыми обновлениями и пишется при закрытии
+	require.NoError(t, st.UpdateAll(ctx, Data{Counters: Counters{"c": 2}, Gauges: Gauges{"g": 5}}))
+	stats, _ := WriteBehindStatsOf(st)
+	assert.Equal(t, 2, stats.Pending)
+	assert.Equal(t, "database is down", stats.LastError)
+	assert.True(t, stats.LastFlush.IsZero())
+
+	backend.mu.Lock()
+	backend.fail = nil
+	backend.mu.Unlock()
+	require.NoError(t, st.Close(ctx))
+	assert.Equal(t, Data{Counters: Counters{"c": 3}, Gauges: Gauges{"g": 5}}, backend.tmpDriver.GetAll(ctx))
+}
+
+func TestWithWriteBehind_MaxPending(t *testing.T) {
+	ctx := context.Background()
+	backend := newRecordingStorage()
+	st := WithWriteBehind(backend, WriteBehind{FlushInterval: time.Hour, MaxPending: 2})
+	require.NoError(t, st.Open(ctx))
+	defer st.Close(ctx)
+
+	require.NoError(t, st.UpdateCounter(ctx, "c", 1))
+	require.NoError(t, st.UpdateCounter(ctx, "c", 1))
+	assert.Never(t, func() bool { return backend.Batches() > 0 }, 50*time.Millisecond, time.Millisecond)
+
+	require.NoError(t, st.UpdateGauge(ctx, "g", 1))
+	assert.Eventually(t, func() bool { return backend.Batches() == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(2), backend.tmpDriver.GetAll(ctx).Counters["c"])
+}
+
+// notifyingStorage is a backend shared with other servers that announces their updates.
+type notifyingStorage struct {
+	*recordingStorage
+	changeSubscribers
+}
+
+func TestWriteBehindNotifications(t *testing.T) {
+	ctx := context.Background()
+	backend := &notifyingStorage{recordingStorage: newRecordingStorage()}
+	require.NoError(t, backend.UpdateAll(ctx, Data{Counters: Counters{"c": 10}, Gauges: Gauges{"g": 1}}))
+
+	st := WithWriteBehind(backend, WriteBehind{FlushInterval: time.Hour})
+	require.NoError(t, st.Open(ctx))
+	defer st.Close(ctx)
+	require.NoError(t, st.UpdateGauge(ctx, "pending", 1))
+
+	// Другой сервер обновил метрики в общем хранилище
+	other := Data{Counters: Counters{"c": 5}, Gauges: Gauges{"g": 2, "pending": 3}}
+	require.NoError(t, backend.recordingStorage.UpdateAll(ctx, other))
+	backend.publish(Change{Origin: "other", Data: other})
+
+	// Локальное значение ожидающей записи датчика не перетирается
+	assert.Equal(t, Data{
+		Counters: Counters{"c": 15},
+		Gauges:   Gauges{"g": 2, "pending": 1},
+	}, st.GetAll(ctx))
+
+	// После потери уведомлений кэш перечитывается целиком
+	require.NoError(t, backend.recordingStorage.UpdateAll(ctx, Data{Counters: Counters{"c": 1}}))
+	backend.publish(Change{Reload: true})
+	counter, err := st.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), counter)
+}
+
+// blockingStorage blocks batch writes until release is closed.
+type blockingStorage struct {
+	*notifyingStorage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingStorage) UpdateAll(ctx context.Context, data Data) error {
+	close(s.started)
+	<-s.release
+	return s.notifyingStorage.UpdateAll(ctx, data)
+}
+
+func TestWriteBehindReloadDuringFlush(t *testing.T) {
+	ctx := context.Background()
+	backend := &blockingStorage{
+		notifyingStorage: &notifyingStorage{recordingStorage: newRecordingStorage()},
+		started:          make(chan struct{}),
+		release:          make(chan struct{}),
+	}
+	st := WithWriteBehind(backend, WriteBehind{FlushInterval: time.Hour})
+	require.NoError(t, st.Open(ctx))
+	defer st.Close(ctx)
+	require.NoError(t, st.UpdateCounter(ctx, "c", 1))
+
+	flushed := make(chan error)
+	go func() { flushed <- st.(*writeBehindStorage).Flush(ctx) }()
+	<-backend.started
+
+	// Пачка уже не ожидает записи, но еще не в хранилище: перечитывание ее не теряет
+	reloaded := make(chan struct{})
+	go func() {
+		backend.publish(Change{Reload: true})
+		close(reloaded)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(backend.release)
+	require.NoError(t, <-flushed)
+	<-reloaded
+
+	counter, err := st.GetCounter(ctx, "c")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), counter)
+}
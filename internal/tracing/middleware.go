@@ -0,0 +1,98 @@
+// Package tracing echo middlewares
+package tracing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts the server span of a request. The parent is taken from the
+// incoming traceparent header, so agent and server spans share one trace.
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := Tracer().Start(ctx, fmt.Sprintf("%s %s", req.Method, c.Path()),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.URLPath(req.URL.Path),
+				semconv.HTTPRoute(c.Path()),
+			),
+		)
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+
+		// The error is left to the error handler of echo, which writes the response
+		// after the middleware: its status is taken from the error
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			span.RecordError(err)
+			if !c.Response().Committed {
+				status = errorStatus(err)
+			}
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// errorStatus returns the status the error handler of echo answers the error with.
+func errorStatus(err error) int {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// Step wraps a middleware with a span that covers only its own work:
+// the span ends as soon as the wrapped middleware passes control to the next handler.
+func Step(name string, mw echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			parent := trace.SpanFromContext(c.Request().Context())
+			ctx, span := Start(c.Request().Context(), name)
+			c.SetRequest(c.Request().WithContext(ctx))
+
+			ended := false
+			err := mw(func(c echo.Context) error {
+				span.End()
+				ended = true
+				// Next stages are children of the parent span, not of this step
+				c.SetRequest(c.Request().WithContext(trace.ContextWithSpan(c.Request().Context(), parent)))
+				return next(c)
+			})(c)
+
+			// The middleware stopped the chain, e.g. invalid hash or decrypt error
+			if !ended {
+				span.SetAttributes(attribute.Int("http.response.status_code", c.Response().Status))
+				End(span, err)
+			}
+			return err
+		}
+	}
+}
+
+// Handler wraps the rest of the chain (the route handler) with a span.
+func Handler(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, span := Start(c.Request().Context(), "handler", semconv.HTTPRoute(c.Path()))
+		c.SetRequest(c.Request().WithContext(ctx))
+		err := next(c)
+		End(span, err)
+		return err
+	}
+}
@@ -0,0 +1,148 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInitialize(t *testing.T) {
+	traceFile := path.Join(t.TempDir(), "trace.json")
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "none", cfg: Config{}},
+		{name: "stdout", cfg: Config{Exporter: StdoutExporter}},
+		{name: "file", cfg: Config{Exporter: FileExporter, File: traceFile}},
+		{name: "file_without_path", cfg: Config{Exporter: FileExporter}, wantErr: true},
+		{name: "otlp", cfg: Config{Exporter: OTLPExporter, Endpoint: "http://localhost:4318"}},
+		{name: "unknown", cfg: Config{Exporter: "jaeger"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown, err := Initialize(context.Background(), "test", tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Initialize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			_, span := Start(context.Background(), "span")
+			span.End()
+			// OTLP collector is not running in tests, so only local exporters must flush cleanly
+			if err := shutdown(context.Background()); err != nil && tt.cfg.Exporter != OTLPExporter {
+				t.Errorf("shutdown() error = %v", err)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(traceFile)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"span"`)
+}
+
+// setupRecorder installs an in-memory exporter instead of the global provider.
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	// Обычный middleware, который передает управление дальше
+	pass := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error { return next(c) }
+	}
+	// Middleware, который обрывает цепочку
+	reject := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error { return c.String(http.StatusBadRequest, "rejected") }
+	}
+
+	e := echo.New()
+	e.Use(Middleware, Step("gzip", pass), Handler)
+	e.POST("/updates/", func(c echo.Context) error {
+		_, span := Start(c.Request().Context(), "storage.UpdateAll")
+		End(span, errors.New("db is down"))
+		return c.String(http.StatusOK, "ok")
+	})
+	e.POST("/rejected/", func(c echo.Context) error { return c.String(http.StatusOK, "ok") }, Step("hash_check", reject))
+
+	// traceparent от агента
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	spans := recorder.Ended()
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		names[s.Name()] = s
+		assert.Equal(t, traceID, s.SpanContext().TraceID().String())
+	}
+	assert.Len(t, spans, 4)
+	root := names["POST /updates/"]
+	if assert.NotNil(t, root) {
+		// gzip и handler — дочерние спаны запроса, storage — дочерний спан handler
+		assert.Equal(t, root.SpanContext().SpanID(), names["gzip"].Parent().SpanID())
+		assert.Equal(t, root.SpanContext().SpanID(), names["handler"].Parent().SpanID())
+		assert.Equal(t, names["handler"].SpanContext().SpanID(), names["storage.UpdateAll"].Parent().SpanID())
+		assert.Len(t, names["storage.UpdateAll"].Events(), 1)
+	}
+
+	// Middleware оборвал цепочку: его спан закрыт, handler не вызван
+	req = httptest.NewRequest(http.MethodPost, "/rejected/", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Len(t, recorder.Ended(), 8)
+
+	// Ошибка обработчика: ответ пишет обработчик ошибок echo один раз, статус ошибки в спане
+	e.GET("/failed/", func(c echo.Context) error { return errors.New("db is down") })
+	req = httptest.NewRequest(http.MethodGet, "/failed/", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.JSONEq(t, `{"message":"Internal Server Error"}`, rec.Body.String())
+	spans = recorder.Ended()
+	root = spans[len(spans)-1]
+	assert.Equal(t, "GET /failed/", root.Name())
+	assert.Equal(t, codes.Error, root.Status().Code)
+	assert.Len(t, root.Events(), 1)
+}
+
+func TestInject(t *testing.T) {
+	setupRecorder(t)
+
+	ctx, span := Start(context.Background(), "client")
+	defer span.End()
+
+	header := make(http.Header)
+	Inject(ctx, propagation.HeaderCarrier(header))
+	assert.Contains(t, header.Get("traceparent"), span.SpanContext().TraceID().String())
+
+	extracted := Extract(context.Background(), propagation.HeaderCarrier(header))
+	_, child := Start(extracted, "server")
+	defer child.End()
+	assert.Equal(t, span.SpanContext().TraceID(), child.SpanContext().TraceID())
+}
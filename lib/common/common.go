@@ -3,6 +3,8 @@ package common
 
 import (
 	"os"
+	"sort"
+	"strings"
 )
 
 // FileIsExists checks if a file exists at the specified path.
@@ -19,3 +21,24 @@ func FileIsExists(filePath string) bool {
 func ReWriteFile(filePath string, data []byte) error {
 	return os.WriteFile(filePath, data, 0600)
 }
+
+// SplitList splits a comma-separated list, trimming spaces and skipping empty items.
+func SplitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SortedKeys returns the keys of m in ascending order.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
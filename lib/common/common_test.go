@@ -3,6 +3,7 @@ package common
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -91,3 +92,30 @@ func TestReWriteFile(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitList(t *testing.T) {
+	testCases := []struct {
+		name     string
+		list     string
+		expected []string
+	}{
+		{name: "Empty", list: "", expected: nil},
+		{name: "Spaces_And_Empty_Items", list: " a:1, ,b:2,", expected: []string{"a:1", "b:2"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SplitList(tc.list); !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("SplitList(%q) = %v, expected %v", tc.list, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	got := SortedKeys(map[string]int{"b": 1, "a": 2, "c": 3})
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SortedKeys() = %v, want %v", got, want)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/rombintu/goyametricsv2/internal/logger"
 	"github.com/rombintu/goyametricsv2/lib/common"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/scrypt"
 )
 
 // ValidPrivateKey checks if the private key file at the specified path is valid.
@@ -207,3 +208,43 @@ func EncryptWithPublicKey(pubKey *rsa.PublicKey, buff *bytes.Buffer) error {
 
 	return nil
 }
+
+// symmetricKeyLabel separates keys derived for data at rest from other uses of the secret.
+const symmetricKeyLabel = "goyametrics/storage/v1\x00"
+
+// Parameters of scrypt for SymmetricKey: about 32 MiB of memory per derivation.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// SaltSize is the size of a random salt for SymmetricKey.
+const SaltSize = 16
+
+// NewSalt returns a random salt for SymmetricKey.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// SymmetricKey derives a 256-bit key (e.g. for AES-GCM) from a secret and a salt
+// with scrypt, so weak passphrases are expensive to brute-force.
+// The secret is a passphrase from the config or private key material.
+func SymmetricKey(secret, salt []byte) ([]byte, error) {
+	labeled := append([]byte(symmetricKeyLabel), secret...)
+	return scrypt.Key(labeled, salt, scryptN, scryptR, scryptP, 32)
+}
+
+// PrivateKeySecret loads the RSA private key from the file and returns its material
+// as a secret for SymmetricKey, so the server needs no extra secret.
+func PrivateKeySecret(filename string) ([]byte, error) {
+	privateKey, err := LoadPrivateKey(filename)
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS1PrivateKey(privateKey), nil
+}
@@ -521,3 +521,49 @@ func TestEncryptWithPublicKey(t *testing.T) {
 		})
 	}
 }
+
+func TestSymmetricKey(t *testing.T) {
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatalf("NewSalt() error = %v", err)
+	}
+	key, err := SymmetricKey([]byte("passphrase"), salt)
+	if err != nil {
+		t.Fatalf("SymmetricKey() error = %v", err)
+	}
+	if len(key) != 32 {
+		t.Errorf("SymmetricKey() len = %d, want 32", len(key))
+	}
+	if same, _ := SymmetricKey([]byte("passphrase"), salt); !bytes.Equal(key, same) {
+		t.Error("SymmetricKey() is not deterministic")
+	}
+	if other, _ := SymmetricKey([]byte("other"), salt); bytes.Equal(key, other) {
+		t.Error("SymmetricKey() gives the same key for different secrets")
+	}
+	otherSalt, err := NewSalt()
+	if err != nil {
+		t.Fatalf("NewSalt() error = %v", err)
+	}
+	if salted, _ := SymmetricKey([]byte("passphrase"), otherSalt); bytes.Equal(key, salted) {
+		t.Error("SymmetricKey() gives the same key for different salts")
+	}
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	filePath := path.Join(t.TempDir(), "private.pem")
+	if err := SavePrivateKey(filePath, privateKey); err != nil {
+		t.Fatalf("Failed to save private key: %v", err)
+	}
+	secret, err := PrivateKeySecret(filePath)
+	if err != nil {
+		t.Fatalf("PrivateKeySecret() error = %v", err)
+	}
+	if !bytes.Equal(secret, x509.MarshalPKCS1PrivateKey(privateKey)) {
+		t.Error("PrivateKeySecret() differs from the private key material")
+	}
+	if _, err := PrivateKeySecret(path.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("PrivateKeySecret() expected error for a missing file")
+	}
+}
@@ -71,10 +71,10 @@ func HashCheckMiddleware(key string) echo.MiddlewareFunc {
 			if hashPayload == "" {
 				return c.String(http.StatusBadRequest, hashIsEmpty)
 			} else if hashPayload != hashOriginal {
-				logger.Log.Debug(hashIsNotValid, zap.String("payload", hashPayload), zap.String("original", hashOriginal))
+				logger.FromContext(c.Request().Context()).Debug(hashIsNotValid, zap.String("payload", hashPayload), zap.String("original", hashOriginal))
 				return c.String(http.StatusBadRequest, hashIsNotValid)
 			} else {
-				logger.Log.Debug(hashIsValid, zap.String("hash", hashPayload))
+				logger.FromContext(c.Request().Context()).Debug(hashIsValid, zap.String("hash", hashPayload))
 			}
 
 			// Replace the request body with the original body for further processing